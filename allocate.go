@@ -0,0 +1,179 @@
+package mongrel2
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+//Allocator decides the addresses of the spec for a handler name that a registry
+//hasn't seen before.  Taken holds the specs the registry has already handed out,
+//whose addresses must not be reused.  The registries call their Allocator with
+//their lock held, so an Allocator doesn't need locking of its own.
+type Allocator interface {
+	Allocate(name string, taken map[string]*HandlerSpec) (*HandlerSpec, error)
+}
+
+//TCPAllocator gives each handler a pair of tcp ports on Host, the lowest free pair in
+//the range MinPort to MaxPort.  The Pull socket gets the lower port.  The zero value
+//uses 127.0.0.1 and the ports from 10070 up, which is what GetHandlerSpec has always
+//done.
+//
+//"Free" only means not handed out by the same registry: by default the allocator
+//does not look at what is listening on the machine, so it can hand out a port some
+//other program is using.  That is deliberate.  Mongrel2 binds the ports of its
+//handlers, so while it runs the ports of every handler it is configured with are
+//in use, and a handler that restarts with the default in-memory registry has to
+//get those same ports again or mongrel2 will never hear from it.  Set
+//CheckListening when the ports are only ever handed out once (a FileRegistry that
+//outlives mongrel2, say, or a config generated with WriteM2Config before mongrel2
+//starts), or use LoadConfigDB to find the ports mongrel2 really uses.
+type TCPAllocator struct {
+	Host    string
+	MinPort int
+	MaxPort int
+	//CheckListening makes the allocator skip ports that something on this machine is
+	//already listening on.
+	CheckListening bool
+}
+
+//Allocate returns the spec with the lowest free pair of ports.
+func (self *TCPAllocator) Allocate(name string, taken map[string]*HandlerSpec) (*HandlerSpec, error) {
+	host, min, max := self.Host, self.MinPort, self.MaxPort
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if min == 0 {
+		min = firstPort
+	}
+	if max == 0 {
+		max = 65535
+	}
+	used := takenAddresses(taken)
+	for port := min; port < max; port++ {
+		pull := "tcp://" + net.JoinHostPort(host, strconv.Itoa(port))
+		pub := "tcp://" + net.JoinHostPort(host, strconv.Itoa(port+1))
+		if used[pull] || used[pub] {
+			continue
+		}
+		if self.CheckListening && (listening(host, port) || listening(host, port+1)) {
+			continue
+		}
+		return &HandlerSpec{Name: name, PullSpec: pull, PubSpec: pub, Identity: Checksum(name)}, nil
+	}
+	return nil, fmt.Errorf("mongrel2: no free ports for %s between %d and %d", name, min, max)
+}
+
+//listening reports whether the port on host can't be listened on, which usually
+//means something else already is.
+func listening(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return true
+	}
+	l.Close()
+	return false
+}
+
+//IPCAllocator gives each handler a pair of unix sockets in Dir, named after the
+//handler.  Mongrel2 resolves ipc paths inside its chroot, so a relative Dir (such
+//as "run") is usually what is wanted.
+type IPCAllocator struct {
+	Dir string
+}
+
+//Allocate returns the spec with the sockets for name.
+func (self *IPCAllocator) Allocate(name string, taken map[string]*HandlerSpec) (*HandlerSpec, error) {
+	base := filepath.Join(self.Dir, specFileName(name))
+	return checkTaken(&HandlerSpec{
+		Name:     name,
+		PullSpec: "ipc://" + base + "-pull",
+		PubSpec:  "ipc://" + base + "-pub",
+		Identity: Checksum(name),
+	}, taken)
+}
+
+//InprocAllocator gives each handler inproc addresses named after it.  Inproc
+//sockets only connect within one zmq context, so this is only useful for tests that
+//play the mongrel2 side in the same process.
+type InprocAllocator struct {
+}
+
+//Allocate returns the spec with the inproc addresses for name.
+func (self *InprocAllocator) Allocate(name string, taken map[string]*HandlerSpec) (*HandlerSpec, error) {
+	return checkTaken(&HandlerSpec{
+		Name:     name,
+		PullSpec: "inproc://" + name + "/pull",
+		PubSpec:  "inproc://" + name + "/pub",
+		Identity: Checksum(name),
+	}, taken)
+}
+
+//StaticAllocator uses the spec in Specs for the handlers listed there, and Fallback
+//(a TCPAllocator if it is nil) for the rest.  The Fallback is kept away from the
+//addresses of the static specs.  Missing fields of a static spec are filled in: the
+//Name from the key and the Identity with Checksum.
+type StaticAllocator struct {
+	Specs    map[string]*HandlerSpec
+	Fallback Allocator
+}
+
+//Allocate returns the static spec for name if there is one.
+func (self *StaticAllocator) Allocate(name string, taken map[string]*HandlerSpec) (*HandlerSpec, error) {
+	static, ok := self.Specs[name]
+	if !ok {
+		reserved := make(map[string]*HandlerSpec, len(taken)+len(self.Specs))
+		for n, spec := range self.Specs {
+			reserved[n] = spec
+		}
+		for n, spec := range taken {
+			reserved[n] = spec
+		}
+		return allocatorOrDefault(self.Fallback).Allocate(name, reserved)
+	}
+	result := *static
+	result.Name = name
+	if result.Identity == "" {
+		result.Identity = Checksum(name)
+	}
+	if result.PullSpec == "" || result.PubSpec == "" {
+		return nil, fmt.Errorf("mongrel2: static spec for %s needs both addresses", name)
+	}
+	return checkTaken(&result, taken)
+}
+
+//checkTaken returns spec unless one of its addresses belongs to another handler.
+func checkTaken(spec *HandlerSpec, taken map[string]*HandlerSpec) (*HandlerSpec, error) {
+	if spec.PullSpec == spec.PubSpec {
+		return nil, fmt.Errorf("mongrel2: spec for %s uses %s twice", spec.Name, spec.PullSpec)
+	}
+	for _, other := range taken {
+		for _, addr := range []string{spec.PullSpec, spec.PubSpec} {
+			if addr == other.PullSpec || addr == other.PubSpec {
+				return nil, fmt.Errorf("mongrel2: %s for %s is already used by %s", addr, spec.Name, other.Name)
+			}
+		}
+	}
+	return spec, nil
+}
+
+func takenAddresses(taken map[string]*HandlerSpec) map[string]bool {
+	result := make(map[string]bool, 2*len(taken))
+	for _, spec := range taken {
+		result[spec.PullSpec] = true
+		result[spec.PubSpec] = true
+	}
+	return result
+}
+
+//specFileName replaces the characters of name that don't belong in a file name.
+func specFileName(name string) string {
+	result := []byte(name)
+	for i, c := range result {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			result[i] = '_'
+		}
+	}
+	return string(result)
+}
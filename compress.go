@@ -0,0 +1,269 @@
+package mongrel2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//DefaultMinCompressSize is the MinSize of a Compressor that doesn't set one.
+const DefaultMinCompressSize = 1024
+
+//DefaultSkipTypes are the content types that a Compressor doesn't compress unless
+//it is given a list of its own, because they are compressed already.  A type that
+//ends with '/' stands for all the types that start with it.
+var DefaultSkipTypes = []string{
+	"image/gif", "image/jpeg", "image/png", "image/webp",
+	"audio/", "video/", "font/woff", "font/woff2",
+	"application/gzip", "application/x-gzip", "application/zip", "application/x-bzip2",
+	"application/x-xz", "application/x-7z-compressed", "application/x-rar-compressed",
+}
+
+//Compressor compresses response bodies with gzip or deflate when the client says,
+//in its Accept-Encoding header, that it will take them.  Responses whose content
+//type is in SkipTypes (DefaultSkipTypes if it is nil), that already have a
+//Content-Encoding, that are smaller than MinSize bytes (DefaultMinCompressSize if
+//it is zero) or that have no body to compress are sent as they are.  Level is the
+//compression level from compress/flate; zero means the default one.  A streamed
+//response is compressed as it is sent, flushing the compressor after each piece, so
+//it is still sent in pieces; it is chunked since its length can't be known.
+type Compressor struct {
+	Level     int
+	MinSize   int64
+	SkipTypes []string
+}
+
+//Compress is middleware that compresses responses with a Compressor's defaults.
+//Compression is opt-in: responses are only compressed by handlers wrapped in it (or
+//in a Compressor's Wrap).
+func Compress(next HandlerFunc) HandlerFunc {
+	return new(Compressor).Wrap(next)
+}
+
+//Wrap is middleware that compresses the responses of next with Compress.
+func (self *Compressor) Wrap(next HandlerFunc) HandlerFunc {
+	return func(req *HttpRequest) *HttpResponse {
+		return self.Compress(req, next(req))
+	}
+}
+
+//Compress returns response, to req, with its body compressed if it should be.
+//Vary: Accept-Encoding is added to any response that could have been compressed.
+//A strong ETag on a response that is compressed is made weak, since the compressed
+//body is not byte for byte the one it names; If-None-Match, which compares tags
+//weakly, still matches it.
+func (self *Compressor) Compress(req *HttpRequest, response *HttpResponse) *HttpResponse {
+	if response == nil || response.Body == nil || !self.compressible(req, response) {
+		return response
+	}
+	if response.Header == nil {
+		response.Header = make(map[string]string)
+	}
+	addVary(response.Header, "Accept-Encoding")
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return response
+	}
+
+	if response.Stream {
+		pr, pw := io.Pipe()
+		go self.compressStream(encoding, response.Body, pw)
+		response.Body = pr
+		response.ContentLength = 0
+	} else {
+		buffer := new(bytes.Buffer)
+		w, err := self.newWriter(encoding, buffer)
+		if err != nil {
+			return response
+		}
+		_, err = io.Copy(w, response.Body)
+		response.Body.Close()
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return plainResponse(req, http.StatusInternalServerError, "")
+		}
+		response.Body = ioutil.NopCloser(buffer)
+		response.ContentLength = int64(buffer.Len())
+	}
+	deleteHeader(response.Header, "Content-Length")
+	response.Header["Content-Encoding"] = encoding
+	weakenETag(response.Header)
+	return response
+}
+
+//weakenETag turns the ETag in header, if there is one, into a weak one.
+func weakenETag(header map[string]string) {
+	for k, v := range header {
+		if strings.EqualFold(k, "ETag") && v != "" && !strings.HasPrefix(v, "W/") {
+			header[k] = "W/" + v
+		}
+	}
+}
+
+//compressible reports whether the response is one that gets compressed for clients
+//that accept it.
+func (self *Compressor) compressible(req *HttpRequest, response *HttpResponse) bool {
+	code := response.StatusCode
+	if req.Method == "HEAD" || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent || (code >= 100 && code < 200) {
+		return false
+	}
+	if _, ok := lookupHeader(response.Header, "Content-Encoding"); ok {
+		return false
+	}
+	minSize := self.MinSize
+	if minSize == 0 {
+		minSize = DefaultMinCompressSize
+	}
+	if response.ContentLength > 0 && response.ContentLength < minSize {
+		return false
+	}
+	if !response.Stream && response.ContentLength <= 0 {
+		return false
+	}
+
+	contentType, _ := lookupHeader(response.Header, "Content-Type")
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	skip := self.SkipTypes
+	if skip == nil {
+		skip = DefaultSkipTypes
+	}
+	for _, t := range skip {
+		if contentType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t)) {
+			return false
+		}
+	}
+	return true
+}
+
+//flushWriter is what compress/gzip and compress/zlib both make.
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (self *Compressor) newWriter(encoding string, w io.Writer) (flushWriter, error) {
+	level := self.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if encoding == "gzip" {
+		return gzip.NewWriterLevel(w, level)
+	}
+	return zlib.NewWriterLevel(w, level)
+}
+
+//compressStream copies body to pw through the compressor, flushing it whenever a
+//read returns, until body runs out or the reader of the pipe goes away.
+func (self *Compressor) compressStream(encoding string, body io.ReadCloser, pw *io.PipeWriter) {
+	defer body.Close()
+	w, err := self.newWriter(encoding, pw)
+	if err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				pw.CloseWithError(werr)
+				return
+			}
+			if werr := w.Flush(); werr != nil {
+				pw.CloseWithError(werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+	pw.CloseWithError(w.Close())
+}
+
+//negotiateEncoding picks gzip or deflate, whichever the Accept-Encoding header gives
+//the higher q-value (gzip if they are equal), or "" if it accepts neither.  A coding
+//that isn't named gets the q-value of *, if that is there, and is not acceptable if
+//it isn't.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		value := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					value = v
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q[coding] = value
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		value, ok := q[coding]
+		if !ok {
+			value = q["*"]
+		}
+		if value > bestQ {
+			best, bestQ = coding, value
+		}
+	}
+	return best
+}
+
+//lookupHeader finds a header of a response regardless of the case of its name.
+func lookupHeader(header map[string]string, key string) (string, bool) {
+	for k, v := range header {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func deleteHeader(header map[string]string, key string) {
+	for k := range header {
+		if strings.EqualFold(k, key) {
+			delete(header, k)
+		}
+	}
+}
+
+//addVary adds field to the response's Vary header, unless it is already there.
+func addVary(header map[string]string, field string) {
+	for k, v := range header {
+		if strings.EqualFold(k, "Vary") {
+			if headerHasToken(v, field) || strings.TrimSpace(v) == "*" {
+				return
+			}
+			header[k] = v + ", " + field
+			return
+		}
+	}
+	header["Vary"] = field
+}
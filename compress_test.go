@@ -0,0 +1,150 @@
+package mongrel2
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"path/filepath"
+	"strings"
+)
+
+type CompressSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&CompressSuite{})
+
+var longText = strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+
+func compressRequest(accept string) *HttpRequest {
+	req := routerRequest("GET", "/", "/")
+	req.Header = make(Header)
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	return req
+}
+
+func bodyResponse(req *HttpRequest, contentType, body string) *HttpResponse {
+	result := NewHttpResponse(req)
+	result.Header["Content-Type"] = contentType
+	result.Body = ioutil.NopCloser(strings.NewReader(body))
+	result.ContentLength = int64(len(body))
+	return result
+}
+
+func (s *CompressSuite) TestNegotiate(c *gocheck.C) {
+	for accept, want := range map[string]string{
+		"":                             "",
+		"gzip":                         "gzip",
+		"deflate, gzip":                "gzip",
+		"gzip;q=0.5, deflate":          "deflate",
+		"gzip;q=0, deflate;q=0":        "",
+		"br, *;q=0.1":                  "gzip",
+		"*;q=0.5, gzip;q=0":            "deflate",
+		"identity":                     "",
+		"x-gzip;q=0.8, deflate;q=0.7 ": "gzip",
+	} {
+		c.Check(negotiateEncoding(accept), gocheck.Equals, want, gocheck.Commentf(accept))
+	}
+}
+
+func (s *CompressSuite) TestGzip(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	h := Compress(func(req *HttpRequest) *HttpResponse {
+		return bodyResponse(req, "text/plain", longText)
+	})
+	c.Assert(handler.WriteMessage(h(compressRequest("gzip, deflate"))), gocheck.IsNil)
+
+	_, resp := sentResponse(c, transport)
+	c.Check(resp.Header.Get("Content-Encoding"), gocheck.Equals, "gzip")
+	c.Check(resp.Header.Get("Vary"), gocheck.Equals, "Accept-Encoding")
+	c.Check(resp.ContentLength < int64(len(longText)), gocheck.Equals, true)
+	compressed, _ := ioutil.ReadAll(resp.Body)
+	c.Check(int64(len(compressed)), gocheck.Equals, resp.ContentLength)
+	r, err := gzip.NewReader(strings.NewReader(string(compressed)))
+	c.Assert(err, gocheck.IsNil)
+	body, _ := ioutil.ReadAll(r)
+	c.Check(string(body), gocheck.Equals, longText)
+	handler.Shutdown(context.Background())
+}
+
+func (s *CompressSuite) TestDeflate(c *gocheck.C) {
+	req := compressRequest("deflate")
+	resp := new(Compressor).Compress(req, bodyResponse(req, "application/json", longText))
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "deflate")
+	r, err := zlib.NewReader(resp.Body)
+	c.Assert(err, gocheck.IsNil)
+	body, _ := ioutil.ReadAll(r)
+	c.Check(string(body), gocheck.Equals, longText)
+}
+
+func (s *CompressSuite) TestSkipped(c *gocheck.C) {
+	compressor := &Compressor{MinSize: 100}
+	req := compressRequest("gzip")
+
+	resp := compressor.Compress(req, bodyResponse(req, "text/plain", "short"))
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(5))
+
+	resp = compressor.Compress(req, bodyResponse(req, "image/png", longText))
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "")
+	c.Check(resp.Header["Vary"], gocheck.Equals, "")
+
+	//the response varies even for a client that doesn't accept compression
+	req = compressRequest("")
+	resp = bodyResponse(req, "text/html; charset=utf-8", longText)
+	resp.Header["Vary"] = "Cookie"
+	resp = compressor.Compress(req, resp)
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "")
+	c.Check(resp.Header["Vary"], gocheck.Equals, "Cookie, Accept-Encoding")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(len(longText)))
+}
+
+func (s *CompressSuite) TestStream(c *gocheck.C) {
+	req := compressRequest("gzip")
+	resp := bodyResponse(req, "text/event-stream", longText)
+	resp.ContentLength = 0
+	resp.Stream = true
+	resp = new(Compressor).Compress(req, resp)
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "gzip")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(0))
+
+	r, err := gzip.NewReader(resp.Body)
+	c.Assert(err, gocheck.IsNil)
+	body, _ := ioutil.ReadAll(r)
+	c.Check(string(body), gocheck.Equals, longText)
+	resp.Body.Close()
+}
+
+func (s *CompressSuite) TestFileServer(c *gocheck.C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "text.txt"), []byte(longText), 0644), gocheck.IsNil)
+	h := Compress(NewFileServer(dir).ServeRequest)
+	request := func(header map[string]string) *HttpResponse {
+		return h(fileRequest("GET", "/text.txt", header))
+	}
+
+	plain := request(nil)
+	plain.Body.Close()
+	etag := plain.Header["ETag"]
+	c.Check(etag, gocheck.Matches, `"[0-9a-f]+-[0-9a-f]+"`)
+	c.Check(plain.Header["Content-Encoding"], gocheck.Equals, "")
+
+	//the compressed body gets a tag of its own, which still validates the file
+	compressed := request(map[string]string{"Accept-Encoding": "gzip"})
+	compressed.Body.Close()
+	c.Check(compressed.Header["Content-Encoding"], gocheck.Equals, "gzip")
+	c.Check(compressed.Header["ETag"], gocheck.Equals, "W/"+etag)
+	resp := request(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": compressed.Header["ETag"]})
+	c.Check(resp.StatusCode, gocheck.Equals, 304)
+
+	//a weak tag can't be used for ranges, so the whole file is sent
+	resp = request(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9", "If-Range": compressed.Header["ETag"]})
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(resp.Header["Content-Encoding"], gocheck.Equals, "gzip")
+	resp.Body.Close()
+}
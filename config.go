@@ -0,0 +1,257 @@
+package mongrel2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//ServerConfig describes a mongrel2 server whose configuration is generated from the
+//HandlerSpecs used by the Go side, so the two can't drift apart.  Zero fields get the
+//defaults of the example configuration that comes with mongrel2; an empty Uuid is
+//derived from Name with Checksum, so it is stable from one run to the next.
+type ServerConfig struct {
+	Name      string
+	Uuid      string
+	Chroot    string
+	AccessLog string
+	ErrorLog  string
+	PidFile   string
+	BindAddr  string
+	Port      int
+	//DefaultHost defaults to the name of the first host.
+	DefaultHost string
+	Hosts       []HostConfig
+}
+
+//HostConfig is one virtual host of a server and the routes it serves.  An empty
+//Matching is the same as Name.
+type HostConfig struct {
+	Name     string
+	Matching string
+	Routes   []Route
+}
+
+//Route sends requests whose path starts with Path to the handler Handler, which is
+//the name of a HandlerSpec (the name passed to Bind).
+type Route struct {
+	Path    string
+	Handler string
+}
+
+//withDefaults returns a copy of the config with the zero fields filled in.
+func (self *ServerConfig) withDefaults() (*ServerConfig, error) {
+	result := *self
+	if result.Name == "" {
+		result.Name = "main"
+	}
+	if result.Uuid == "" {
+		result.Uuid = Checksum(result.Name)
+	}
+	if result.Chroot == "" {
+		result.Chroot = "./"
+	}
+	if result.AccessLog == "" {
+		result.AccessLog = "/logs/access.log"
+	}
+	if result.ErrorLog == "" {
+		result.ErrorLog = "/logs/error.log"
+	}
+	if result.PidFile == "" {
+		result.PidFile = "/run/mongrel2.pid"
+	}
+	if result.BindAddr == "" {
+		result.BindAddr = "0.0.0.0"
+	}
+	if result.Port == 0 {
+		result.Port = 6767
+	}
+	if len(result.Hosts) == 0 {
+		return nil, fmt.Errorf("mongrel2 config: server %s has no hosts", result.Name)
+	}
+	if result.DefaultHost == "" {
+		result.DefaultHost = result.Hosts[0].Name
+	}
+	return &result, nil
+}
+
+//routedSpecs returns the specs used by the routes of the server, in the order they
+//are first used, checking that every route has one.
+func (self *ServerConfig) routedSpecs(specs []*HandlerSpec) ([]*HandlerSpec, error) {
+	byName := make(map[string]*HandlerSpec, len(specs))
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+	var result []*HandlerSpec
+	seen := make(map[string]bool)
+	for _, host := range self.Hosts {
+		for _, route := range host.Routes {
+			spec, ok := byName[route.Handler]
+			if !ok {
+				return nil, fmt.Errorf("mongrel2 config: route %s on %s uses handler %s which has no spec", route.Path, host.Name, route.Handler)
+			}
+			if !seen[spec.Name] {
+				seen[spec.Name] = true
+				result = append(result, spec)
+			}
+		}
+	}
+	return result, nil
+}
+
+//WriteM2Config writes the configuration of server, with a Handler for each of the
+//specs used by its routes, in the format read by "m2sh load".  The specs are usually
+//HandlerSpecs().
+func WriteM2Config(w io.Writer, server *ServerConfig, specs []*HandlerSpec) error {
+	server, err := server.withDefaults()
+	if err != nil {
+		return err
+	}
+	used, err := server.routedSpecs(specs)
+	if err != nil {
+		return err
+	}
+
+	variables := make(map[string]string, len(used))
+	taken := make(map[string]bool, len(used)+1)
+	for _, spec := range used {
+		variables[spec.Name] = handlerVariable(spec.Name, taken)
+	}
+
+	out := bufio.NewWriter(w)
+	for _, spec := range used {
+		protocol, err := spec.protocol()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s = Handler(send_spec=%s,\n", variables[spec.Name], pythonString(spec.PullSpec))
+		fmt.Fprintf(out, "    send_ident=%s,\n", pythonString(spec.Identity))
+		fmt.Fprintf(out, "    recv_spec=%s,\n", pythonString(spec.PubSpec))
+		if protocol != "json" {
+			fmt.Fprintf(out, "    protocol=%s,\n", pythonString(protocol))
+		}
+		fmt.Fprintf(out, "    recv_ident='')\n\n")
+	}
+
+	variable := handlerVariable(server.Name, taken)
+	fmt.Fprintf(out, "%s = Server(\n", variable)
+	fmt.Fprintf(out, "    uuid=%s,\n", pythonString(server.Uuid))
+	fmt.Fprintf(out, "    access_log=%s,\n", pythonString(server.AccessLog))
+	fmt.Fprintf(out, "    error_log=%s,\n", pythonString(server.ErrorLog))
+	fmt.Fprintf(out, "    chroot=%s,\n", pythonString(server.Chroot))
+	fmt.Fprintf(out, "    pid_file=%s,\n", pythonString(server.PidFile))
+	fmt.Fprintf(out, "    default_host=%s,\n", pythonString(server.DefaultHost))
+	fmt.Fprintf(out, "    name=%s,\n", pythonString(server.Name))
+	fmt.Fprintf(out, "    bind_addr=%s,\n", pythonString(server.BindAddr))
+	fmt.Fprintf(out, "    port=%d,\n", server.Port)
+	fmt.Fprintf(out, "    hosts=[\n")
+	for i, host := range server.Hosts {
+		fmt.Fprintf(out, "        Host(name=%s, ", pythonString(host.Name))
+		if host.Matching != "" {
+			fmt.Fprintf(out, "matching=%s, ", pythonString(host.Matching))
+		}
+		fmt.Fprintf(out, "routes={\n")
+		for j, route := range host.Routes {
+			fmt.Fprintf(out, "            %s: %s", pythonString(route.Path), variables[route.Handler])
+			if j < len(host.Routes)-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString("        })")
+		if i < len(server.Hosts)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("    ]\n)\n\n")
+	fmt.Fprintf(out, "servers = [%s]\n", variable)
+	return out.Flush()
+}
+
+//WriteM2SQL writes the configuration of server as SQL statements that fill in the
+//tables of mongrel2's config database (the one m2sh creates), for deployments that
+//manage the database directly.  The statements are wrapped in a transaction.  The
+//ids of the rows are left to sqlite and the rows are tied together by the server's
+//uuid, the handlers' send_ident and the hosts' names, so the statements can be run
+//against a database that already holds other servers.
+func WriteM2SQL(w io.Writer, server *ServerConfig, specs []*HandlerSpec) error {
+	server, err := server.withDefaults()
+	if err != nil {
+		return err
+	}
+	used, err := server.routedSpecs(specs)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*HandlerSpec, len(used))
+	for _, spec := range used {
+		byName[spec.Name] = spec
+	}
+
+	out := bufio.NewWriter(w)
+	out.WriteString("BEGIN TRANSACTION;\n")
+	fmt.Fprintf(out, "INSERT INTO server (uuid, access_log, error_log, chroot, pid_file, default_host, name, bind_addr, port, use_ssl) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %d, 0);\n",
+		sqlString(server.Uuid), sqlString(server.AccessLog), sqlString(server.ErrorLog), sqlString(server.Chroot),
+		sqlString(server.PidFile), sqlString(server.DefaultHost), sqlString(server.Name), sqlString(server.BindAddr), server.Port)
+	serverId := fmt.Sprintf("(SELECT max(id) FROM server WHERE uuid = %s)", sqlString(server.Uuid))
+
+	for _, spec := range used {
+		protocol, err := spec.protocol()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "INSERT INTO handler (send_spec, send_ident, recv_spec, recv_ident, raw_payload, protocol) VALUES (%s, %s, %s, '', 0, %s);\n",
+			sqlString(spec.PullSpec), sqlString(spec.Identity), sqlString(spec.PubSpec), sqlString(protocol))
+	}
+
+	for _, host := range server.Hosts {
+		matching := host.Matching
+		if matching == "" {
+			matching = host.Name
+		}
+		fmt.Fprintf(out, "INSERT INTO host (server_id, maintenance, name, matching) VALUES (%s, 0, %s, %s);\n",
+			serverId, sqlString(host.Name), sqlString(matching))
+		hostId := fmt.Sprintf("(SELECT max(id) FROM host WHERE server_id = %s AND name = %s)", serverId, sqlString(host.Name))
+		for _, route := range host.Routes {
+			handlerId := fmt.Sprintf("(SELECT max(id) FROM handler WHERE send_ident = %s)", sqlString(byName[route.Handler].Identity))
+			fmt.Fprintf(out, "INSERT INTO route (path, reversed, host_id, target_id, target_type) VALUES (%s, 0, %s, %s, 'handler');\n",
+				sqlString(route.Path), hostId, handlerId)
+		}
+	}
+	out.WriteString("COMMIT;\n")
+	return out.Flush()
+}
+
+//handlerVariable turns a name into something that can be used as a variable in an
+//m2sh config file.  Names that only differ in the characters that have to be
+//replaced would get the same variable, so a number is added to make it different
+//from the ones already taken, and the result is added to taken.
+func handlerVariable(name string, taken map[string]bool) string {
+	result := []byte("handler_")
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			result = append(result, c)
+		} else {
+			result = append(result, '_')
+		}
+	}
+	variable := string(result)
+	for n := 2; taken[variable]; n++ {
+		variable = fmt.Sprintf("%s_%d", result, n)
+	}
+	taken[variable] = true
+	return variable
+}
+
+//pythonString quotes s for the python-like m2sh config format.
+func pythonString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`).Replace(s) + "'"
+}
+
+//sqlString quotes s as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,91 @@
+package mongrel2
+
+import (
+	"bytes"
+	"launchpad.net/gocheck"
+	"strings"
+)
+
+type ConfigSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ConfigSuite{})
+
+var configSpecs = []*HandlerSpec{
+	{Name: "chat", PullSpec: "tcp://127.0.0.1:10070", PubSpec: "tcp://127.0.0.1:10071", Identity: "abc"},
+	{Name: "unused", PullSpec: "tcp://127.0.0.1:10072", PubSpec: "tcp://127.0.0.1:10073", Identity: "def"},
+}
+
+func (s *ConfigSuite) TestWriteM2Config(c *gocheck.C) {
+	server := &ServerConfig{Hosts: []HostConfig{
+		{Name: "localhost", Routes: []Route{{"/chat/", "chat"}, {"/chat's/", "chat"}}},
+	}}
+	out := new(bytes.Buffer)
+	c.Assert(WriteM2Config(out, server, configSpecs), gocheck.IsNil)
+	conf := out.String()
+
+	c.Check(strings.Count(conf, "Handler("), gocheck.Equals, 1)
+	c.Check(conf, gocheck.Matches, `(?s)handler_chat = Handler\(send_spec='tcp://127.0.0.1:10070',\s+send_ident='abc',\s+recv_spec='tcp://127.0.0.1:10071',\s+recv_ident=''\).*`)
+	c.Check(conf, gocheck.Matches, `(?s).*uuid='`+Checksum("main")+`'.*port=6767.*`)
+	c.Check(conf, gocheck.Matches, `(?s).*'/chat/': handler_chat,\s+'/chat\\'s/': handler_chat\s+}\).*`)
+	c.Check(strings.HasSuffix(conf, "servers = [handler_main]\n"), gocheck.Equals, true)
+}
+
+func (s *ConfigSuite) TestWriteM2SQL(c *gocheck.C) {
+	specs := []*HandlerSpec{
+		configSpecs[0],
+		{Name: "feed", PullSpec: "ipc://run/feed-send", PubSpec: "ipc://run/feed-recv", Identity: "f'd", Protocol: "tnetstring"},
+	}
+	server := &ServerConfig{Name: "it's", Uuid: "f400bf85", Port: 80, Hosts: []HostConfig{
+		{Name: "example", Matching: "example.com", Routes: []Route{{"/", "chat"}, {"/feed", "feed"}}},
+		{Name: "localhost", Routes: []Route{{"/", "chat"}}},
+	}}
+	out := new(bytes.Buffer)
+	c.Assert(WriteM2SQL(out, server, specs), gocheck.IsNil)
+	serverId := "(SELECT max(id) FROM server WHERE uuid = 'f400bf85')"
+	c.Check(strings.Split(out.String(), "\n"), gocheck.DeepEquals, []string{
+		"BEGIN TRANSACTION;",
+		"INSERT INTO server (uuid, access_log, error_log, chroot, pid_file, default_host, name, bind_addr, port, use_ssl) VALUES ('f400bf85', '/logs/access.log', '/logs/error.log', './', '/run/mongrel2.pid', 'example', 'it''s', '0.0.0.0', 80, 0);",
+		"INSERT INTO handler (send_spec, send_ident, recv_spec, recv_ident, raw_payload, protocol) VALUES ('tcp://127.0.0.1:10070', 'abc', 'tcp://127.0.0.1:10071', '', 0, 'json');",
+		"INSERT INTO handler (send_spec, send_ident, recv_spec, recv_ident, raw_payload, protocol) VALUES ('ipc://run/feed-send', 'f''d', 'ipc://run/feed-recv', '', 0, 'tnetstring');",
+		"INSERT INTO host (server_id, maintenance, name, matching) VALUES (" + serverId + ", 0, 'example', 'example.com');",
+		"INSERT INTO route (path, reversed, host_id, target_id, target_type) VALUES ('/', 0, (SELECT max(id) FROM host WHERE server_id = " + serverId + " AND name = 'example'), (SELECT max(id) FROM handler WHERE send_ident = 'abc'), 'handler');",
+		"INSERT INTO route (path, reversed, host_id, target_id, target_type) VALUES ('/feed', 0, (SELECT max(id) FROM host WHERE server_id = " + serverId + " AND name = 'example'), (SELECT max(id) FROM handler WHERE send_ident = 'f''d'), 'handler');",
+		"INSERT INTO host (server_id, maintenance, name, matching) VALUES (" + serverId + ", 0, 'localhost', 'localhost');",
+		"INSERT INTO route (path, reversed, host_id, target_id, target_type) VALUES ('/', 0, (SELECT max(id) FROM host WHERE server_id = " + serverId + " AND name = 'localhost'), (SELECT max(id) FROM handler WHERE send_ident = 'abc'), 'handler');",
+		"COMMIT;",
+		"",
+	})
+
+	specs[1] = &HandlerSpec{Name: "feed", Protocol: "xml"}
+	c.Check(WriteM2SQL(new(bytes.Buffer), server, specs), gocheck.ErrorMatches, `.*unknown protocol "xml"`)
+}
+
+func (s *ConfigSuite) TestVariableCollisions(c *gocheck.C) {
+	specs := []*HandlerSpec{
+		{Name: "a-b", PullSpec: "tcp://127.0.0.1:1", Identity: "1"},
+		{Name: "a_b", PullSpec: "tcp://127.0.0.1:2", Identity: "2", Protocol: "tnetstring"},
+		{Name: "a.b", PullSpec: "tcp://127.0.0.1:3", Identity: "3"},
+		{Name: "main", PullSpec: "tcp://127.0.0.1:4", Identity: "4"},
+	}
+	server := &ServerConfig{Hosts: []HostConfig{
+		{Name: "localhost", Routes: []Route{{"/1", "a-b"}, {"/2", "a_b"}, {"/3", "a.b"}, {"/4", "main"}}},
+	}}
+	out := new(bytes.Buffer)
+	c.Assert(WriteM2Config(out, server, specs), gocheck.IsNil)
+	conf := out.String()
+	c.Check(conf, gocheck.Matches, `(?s)handler_a_b = Handler\(send_spec='tcp://127.0.0.1:1'.*`)
+	c.Check(conf, gocheck.Matches, `(?s).*\nhandler_a_b_2 = Handler\(send_spec='tcp://127.0.0.1:2',.*protocol='tnetstring',.*`)
+	c.Check(conf, gocheck.Matches, `(?s).*\nhandler_a_b_3 = Handler\(send_spec='tcp://127.0.0.1:3'.*`)
+	c.Check(conf, gocheck.Matches, `(?s).*'/1': handler_a_b,\s+'/2': handler_a_b_2,\s+'/3': handler_a_b_3,\s+'/4': handler_main\s.*`)
+	//the server's variable doesn't clash with the handler called main either
+	c.Check(conf, gocheck.Matches, `(?s).*\nhandler_main_2 = Server\(.*servers = \[handler_main_2\]\n`)
+	c.Check(strings.Count(conf, "protocol="), gocheck.Equals, 1)
+}
+
+func (s *ConfigSuite) TestUnknownHandler(c *gocheck.C) {
+	server := &ServerConfig{Hosts: []HostConfig{{Name: "localhost", Routes: []Route{{"/", "missing"}}}}}
+	c.Check(WriteM2Config(new(bytes.Buffer), server, configSpecs), gocheck.ErrorMatches, ".*handler missing which has no spec")
+	c.Check(WriteM2SQL(new(bytes.Buffer), &ServerConfig{}, configSpecs), gocheck.ErrorMatches, ".*has no hosts")
+}
@@ -0,0 +1,135 @@
+package mongrel2
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+//ConfigDB holds the handlers and routes of a mongrel2 config database (the sqlite
+//file m2sh writes, usually config.sqlite), so that a handler can bind to the specs
+//mongrel2 is really configured with instead of the ones GetHandlerSpec invents.
+//Mongrel2 binds its end of the sockets, so the send_spec of a handler is the
+//PullSpec of the HandlerSpec and the recv_spec is the PubSpec.  A spec that binds to
+//every interface, such as tcp://*:9997 or tcp://0.0.0.0:9997, is turned into one on
+//the loopback interface, which the handler can connect to.
+type ConfigDB struct {
+	//Specs are the handlers in the database, in the order of their ids.  Handlers
+	//have no name in mongrel2's database, so the Name of these specs is their
+	//send_ident.
+	Specs []*HandlerSpec
+
+	byId   map[int64]*HandlerSpec
+	routes []configRoute
+}
+
+//configRoute is a row of the route table that targets a handler.
+type configRoute struct {
+	Host    string
+	Path    string
+	Handler int64
+}
+
+//LoadConfigDB reads the handler and route tables from db.  The package doesn't
+//depend on a particular sqlite driver; open the database with the driver of your
+//choice and pass it in.
+func LoadConfigDB(db *sql.DB) (*ConfigDB, error) {
+	result := &ConfigDB{byId: make(map[int64]*HandlerSpec)}
+
+	rows, err := db.Query("SELECT id, send_spec, send_ident, recv_spec, coalesce(protocol, '') FROM handler ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var sendSpec, sendIdent, recvSpec, protocol string
+		if err := rows.Scan(&id, &sendSpec, &sendIdent, &recvSpec, &protocol); err != nil {
+			return nil, err
+		}
+		result.addHandler(id, sendSpec, sendIdent, recvSpec).Protocol = protocol
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT host.name, route.path, route.target_id FROM route JOIN host ON route.host_id = host.id WHERE route.target_type = 'handler' ORDER BY route.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r configRoute
+		if err := rows.Scan(&r.Host, &r.Path, &r.Handler); err != nil {
+			return nil, err
+		}
+		result.routes = append(result.routes, r)
+	}
+	return result, rows.Err()
+}
+
+func (self *ConfigDB) addHandler(id int64, sendSpec, sendIdent, recvSpec string) *HandlerSpec {
+	spec := &HandlerSpec{Name: sendIdent, PullSpec: connectSpec(sendSpec), PubSpec: connectSpec(recvSpec), Identity: sendIdent}
+	self.Specs = append(self.Specs, spec)
+	self.byId[id] = spec
+	return spec
+}
+
+//connectSpec returns the address to connect to for a tcp spec that mongrel2 binds.
+//Binding to * or 0.0.0.0 (or :: for IPv6) means every interface, which can't be
+//connected to, so the loopback address is used instead.
+func connectSpec(spec string) string {
+	if !strings.HasPrefix(spec, "tcp://") {
+		return spec
+	}
+	host, port, err := net.SplitHostPort(spec[len("tcp://"):])
+	if err != nil {
+		return spec
+	}
+	switch host {
+	case "*", "0.0.0.0", "":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return "tcp://" + net.JoinHostPort(host, port)
+}
+
+//ByRoute returns the spec of the handler that the route with the path supplied (the
+//pattern in mongrel2's configuration, which is also the PATTERN of the requests it
+//sends) points at.  It is an error if there is no such route or if several hosts
+//route the path to different handlers.
+func (self *ConfigDB) ByRoute(pattern string) (*HandlerSpec, error) {
+	var result *HandlerSpec
+	for _, r := range self.routes {
+		if r.Path != pattern {
+			continue
+		}
+		spec := self.byId[r.Handler]
+		if spec == nil {
+			return nil, fmt.Errorf("mongrel2 config: route %s on %s points at missing handler %d", r.Path, r.Host, r.Handler)
+		}
+		if result != nil && result != spec {
+			return nil, fmt.Errorf("mongrel2 config: route %s points at more than one handler", pattern)
+		}
+		result = spec
+	}
+	if result == nil {
+		return nil, fmt.Errorf("mongrel2 config: no handler route %s", pattern)
+	}
+	return result, nil
+}
+
+//ByName returns the spec of the handler whose send_ident is name, or is the Checksum
+//of name as it is for the specs handed out by GetHandlerSpec and written by
+//WriteM2Config.
+func (self *ConfigDB) ByName(name string) (*HandlerSpec, error) {
+	sum := Checksum(name)
+	for _, spec := range self.Specs {
+		if spec.Identity == name || spec.Identity == sum {
+			return spec, nil
+		}
+	}
+	return nil, fmt.Errorf("mongrel2 config: no handler named %s", name)
+}
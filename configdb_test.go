@@ -0,0 +1,139 @@
+package mongrel2
+
+import (
+	"bytes"
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"path/filepath"
+)
+
+type ConfigDBSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ConfigDBSuite{})
+
+func testConfigDB() *ConfigDB {
+	result := &ConfigDB{byId: make(map[int64]*HandlerSpec)}
+	result.addHandler(1, "tcp://127.0.0.1:9997", Checksum("chat"), "tcp://127.0.0.1:9996")
+	result.addHandler(2, "ipc://run/send", "54c6755b-9628-40a4-9a2d-cc82a816345e", "ipc://run/recv")
+	result.routes = []configRoute{
+		{"localhost", "/chat/", 1},
+		{"example.com", "/chat/", 1},
+		{"localhost", "/handler", 2},
+		{"example.com", "/handler", 1},
+		{"localhost", "/broken", 3},
+	}
+	return result
+}
+
+func (s *ConfigDBSuite) TestByRoute(c *gocheck.C) {
+	config := testConfigDB()
+	spec, err := config.ByRoute("/chat/")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Equals, "tcp://127.0.0.1:9997")
+	c.Check(spec.PubSpec, gocheck.Equals, "tcp://127.0.0.1:9996")
+
+	_, err = config.ByRoute("/handler")
+	c.Check(err, gocheck.ErrorMatches, ".*more than one handler")
+	_, err = config.ByRoute("/broken")
+	c.Check(err, gocheck.ErrorMatches, ".*missing handler 3")
+	_, err = config.ByRoute("/nowhere")
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *ConfigDBSuite) TestByName(c *gocheck.C) {
+	config := testConfigDB()
+	spec, err := config.ByName("chat")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec, gocheck.Equals, config.Specs[0])
+	spec, err = config.ByName("54c6755b-9628-40a4-9a2d-cc82a816345e")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Equals, "ipc://run/send")
+	_, err = config.ByName("nobody")
+	c.Check(err, gocheck.NotNil)
+}
+
+// openFixture opens a copy of testdata/config.sqlite, a config database as m2sh
+// writes it.
+func openFixture(c *gocheck.C) *sql.DB {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "config.sqlite"))
+	c.Assert(err, gocheck.IsNil)
+	name := filepath.Join(c.MkDir(), "config.sqlite")
+	c.Assert(ioutil.WriteFile(name, data, 0644), gocheck.IsNil)
+	db, err := sql.Open("sqlite3", name)
+	c.Assert(err, gocheck.IsNil)
+	return db
+}
+
+func (s *ConfigDBSuite) TestLoadFixture(c *gocheck.C) {
+	db := openFixture(c)
+	defer db.Close()
+	config, err := LoadConfigDB(db)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(config.Specs, gocheck.HasLen, 3)
+	//mongrel2 binds to every interface, the handler connects to the loopback one
+	c.Check(*config.Specs[0], gocheck.Equals, HandlerSpec{
+		Name:     "34f9ceee-cd52-4b7f-b197-88bf2f0ec378",
+		PullSpec: "tcp://127.0.0.1:9997",
+		PubSpec:  "tcp://127.0.0.1:9996",
+		Identity: "34f9ceee-cd52-4b7f-b197-88bf2f0ec378",
+		Protocol: "json",
+	})
+	c.Check(config.Specs[2].PullSpec, gocheck.Equals, "ipc://run/send")
+	c.Check(config.Specs[2].Protocol, gocheck.Equals, "")
+
+	spec, err := config.ByRoute("/chat/")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Equals, "tcp://127.0.0.1:9999")
+	c.Check(spec.PubSpec, gocheck.Equals, "tcp://127.0.0.1:9998")
+	c.Check(spec.Protocol, gocheck.Equals, "tnetstring")
+	named, err := config.ByName("chat")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(named, gocheck.Equals, spec)
+
+	spec, err = config.ByRoute("/handlertest")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec, gocheck.Equals, config.Specs[0])
+	//a route to a directory is not a handler, even though ids overlap
+	_, err = config.ByRoute("/tests/")
+	c.Check(err, gocheck.ErrorMatches, ".*no handler route /tests/")
+}
+
+func (s *ConfigDBSuite) TestGeneratedSQLLoads(c *gocheck.C) {
+	db := openFixture(c)
+	defer db.Close()
+	specs := []*HandlerSpec{{Name: "gen", PullSpec: "tcp://*:10070", PubSpec: "tcp://*:10071", Identity: Checksum("gen"), Protocol: "tnetstring"}}
+	server := &ServerConfig{Name: "second", Port: 6768, Hosts: []HostConfig{
+		{Name: "localhost", Routes: []Route{{"/gen/", "gen"}}},
+	}}
+	out := new(bytes.Buffer)
+	c.Assert(WriteM2SQL(out, server, specs), gocheck.IsNil)
+	_, err := db.Exec(out.String())
+	c.Assert(err, gocheck.IsNil)
+
+	config, err := LoadConfigDB(db)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(config.Specs, gocheck.HasLen, 4)
+	spec, err := config.ByRoute("/gen/")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(*spec, gocheck.Equals, HandlerSpec{Checksum("gen"), "tcp://127.0.0.1:10071", "tcp://127.0.0.1:10070", Checksum("gen"), "tnetstring"})
+	var hostServer string
+	c.Assert(db.QueryRow("SELECT server.name FROM host JOIN server ON host.server_id = server.id WHERE host.id = (SELECT max(id) FROM host)").Scan(&hostServer), gocheck.IsNil)
+	c.Check(hostServer, gocheck.Equals, "second")
+}
+
+func (s *ConfigDBSuite) TestConnectSpec(c *gocheck.C) {
+	for spec, want := range map[string]string{
+		"tcp://*:9997":        "tcp://127.0.0.1:9997",
+		"tcp://0.0.0.0:9997":  "tcp://127.0.0.1:9997",
+		"tcp://[::]:9997":     "tcp://[::1]:9997",
+		"tcp://10.0.0.5:9997": "tcp://10.0.0.5:9997",
+		"ipc://run/send":      "ipc://run/send",
+		"tcp://no-port":       "tcp://no-port",
+	} {
+		c.Check(connectSpec(spec), gocheck.Equals, want, gocheck.Commentf(spec))
+	}
+}
@@ -0,0 +1,382 @@
+package mongrel2
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//DefaultControlSpec is where mongrel2 listens for control commands unless its
+//configuration says otherwise.  It is relative to mongrel2's chroot.
+const DefaultControlSpec = "ipc://run/control"
+
+//DefaultControlTimeout is how long a ControlClient waits for an answer unless its
+//Timeout says otherwise.
+const DefaultControlTimeout = 5 * time.Second
+
+//ErrControlTimeout is returned when mongrel2 doesn't answer a control command within
+//the ControlClient's Timeout.
+var ErrControlTimeout = errors.New("mongrel2 control: timed out waiting for an answer")
+
+//ControlClient talks to the control port of a running mongrel2 server, which is what
+//m2sh does for commands such as "m2sh running" and "m2sh reload".  Requests are
+//tnetstring lists of the command name and a dict of arguments; mongrel2 answers with
+//a tnetstring dict that is usually a table of headers and rows.  A ControlClient may
+//be used from several goroutines, but the commands are sent one at a time.  Each
+//waits for up to Timeout (DefaultControlTimeout if it is zero) for its answer.
+type ControlClient struct {
+	Spec    string
+	Timeout time.Duration
+
+	socket controlSocket
+	dial   func() (controlSocket, error)
+	closed bool
+	lock   sync.Mutex
+}
+
+//controlSocket is the REQ socket of a ControlClient.  Recv gives up with
+//ErrControlTimeout if nothing arrives within timeout.
+type controlSocket interface {
+	Send(data []byte) error
+	Recv(timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+//ControlResult is mongrel2's answer to a control command.  Most commands answer with
+//a table, in Headers and Rows; a few just send a message, in Msg.
+type ControlResult struct {
+	Headers []string
+	Rows    [][]interface{}
+	Msg     string
+}
+
+//ControlError is returned when mongrel2 refuses a control command.
+type ControlError struct {
+	Code    string
+	Message string
+}
+
+func (self *ControlError) Error() string {
+	if self.Code == "" {
+		return "mongrel2 control: " + self.Message
+	}
+	return fmt.Sprintf("mongrel2 control: %s (%s)", self.Message, self.Code)
+}
+
+//ControlTask is a row of "status what=tasks", one of the tasks (coroutines) running
+//inside mongrel2.
+type ControlTask struct {
+	Id     int64
+	System bool
+	Name   string
+	State  string
+	Status string
+}
+
+//ControlConnection is a row of "status what=net", one of the client connections
+//that mongrel2 has open.  The times are in seconds since the epoch.
+type ControlConnection struct {
+	Id           int64
+	Fd           int64
+	Type         string
+	LastPing     int64
+	LastRead     int64
+	LastWrite    int64
+	BytesRead    int64
+	BytesWritten int64
+}
+
+//ServerInfo is the result of the "info" command, which describes the server's
+//configuration.
+type ServerInfo struct {
+	Port            int64
+	BindAddr        string
+	Uuid            string
+	Chroot          string
+	AccessLog       string
+	ErrorLog        string
+	PidFile         string
+	DefaultHostname string
+}
+
+//Close releases the client's socket.  Commands called afterwards fail with
+//ErrTransportClosed.
+func (self *ControlClient) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	if self.socket == nil {
+		return nil
+	}
+	err := self.socket.Close()
+	self.socket = nil
+	return err
+}
+
+//Call sends any control command to mongrel2 and waits for the answer.  The typed
+//methods of ControlClient are built on this.  The arguments may be nil.  If sending
+//fails or no answer arrives in time the socket is thrown away, since a REQ socket
+//can't send again until it has had its answer, and the next command is sent on a
+//new one.
+func (self *ControlClient) Call(command string, args map[string]interface{}) (*ControlResult, error) {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	req, err := EncodeTnetstring([]interface{}{command, args})
+	if err != nil {
+		return nil, err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil, ErrTransportClosed
+	}
+	if self.socket == nil {
+		if self.socket, err = self.dial(); err != nil {
+			return nil, err
+		}
+	}
+	err = self.socket.Send(req)
+	var resp []byte
+	if err == nil {
+		resp, err = self.socket.Recv(self.timeout())
+	}
+	if err != nil {
+		self.socket.Close()
+		self.socket = nil
+		return nil, err
+	}
+	return decodeControlResult(resp)
+}
+
+func (self *ControlClient) timeout() time.Duration {
+	if self.Timeout <= 0 {
+		return DefaultControlTimeout
+	}
+	return self.Timeout
+}
+
+//decodeControlResult interprets mongrel2's answer to a control command.
+func decodeControlResult(data []byte) (*ControlResult, error) {
+	v, _, err := DecodeTnetstring(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mongrel2 control: expected a dict but got %T", v)
+	}
+	if msg, ok := dict["error"]; ok {
+		return nil, &ControlError{controlString(dict["code"]), controlString(msg)}
+	}
+
+	result := new(ControlResult)
+	result.Msg = controlString(dict["msg"])
+	if headers, ok := dict["headers"].([]interface{}); ok {
+		for _, h := range headers {
+			result.Headers = append(result.Headers, controlString(h))
+		}
+	}
+	if rows, ok := dict["rows"].([]interface{}); ok {
+		for _, r := range rows {
+			row, ok := r.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("mongrel2 control: expected a row but got %T", r)
+			}
+			result.Rows = append(result.Rows, row)
+		}
+	}
+	return result, nil
+}
+
+//Maps returns the rows of the result as maps from header name to value.
+func (self *ControlResult) Maps() []map[string]interface{} {
+	result := make([]map[string]interface{}, len(self.Rows))
+	for i, row := range self.Rows {
+		result[i] = make(map[string]interface{}, len(self.Headers))
+		for j, h := range self.Headers {
+			if j < len(row) {
+				result[i][h] = row[j]
+			}
+		}
+	}
+	return result
+}
+
+//first returns the first row of a result that should have exactly one.
+func (self *ControlResult) first() (map[string]interface{}, error) {
+	rows := self.Maps()
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("mongrel2 control: expected one row but got %d", len(rows))
+	}
+	return rows[0], nil
+}
+
+//Tasks returns the tasks running in mongrel2 ("status what=tasks").
+func (self *ControlClient) Tasks() ([]ControlTask, error) {
+	r, err := self.Call("status", map[string]interface{}{"what": "tasks"})
+	if err != nil {
+		return nil, err
+	}
+	var result []ControlTask
+	for _, row := range r.Maps() {
+		result = append(result, ControlTask{
+			Id:     controlInt(row["id"]),
+			System: controlBool(row["system"]),
+			Name:   controlString(row["name"]),
+			State:  controlString(row["state"]),
+			Status: controlString(row["status"]),
+		})
+	}
+	return result, nil
+}
+
+//Connections returns the client connections mongrel2 has open, with their
+//statistics ("status what=net").
+func (self *ControlClient) Connections() ([]ControlConnection, error) {
+	r, err := self.Call("status", map[string]interface{}{"what": "net"})
+	if err != nil {
+		return nil, err
+	}
+	var result []ControlConnection
+	for _, row := range r.Maps() {
+		result = append(result, ControlConnection{
+			Id:           controlInt(row["id"]),
+			Fd:           controlInt(row["fd"]),
+			Type:         controlString(row["type"]),
+			LastPing:     controlInt(row["last_ping"]),
+			LastRead:     controlInt(row["last_read"]),
+			LastWrite:    controlInt(row["last_write"]),
+			BytesRead:    controlInt(row["bytes_read"]),
+			BytesWritten: controlInt(row["bytes_written"]),
+		})
+	}
+	return result, nil
+}
+
+//Info returns the configuration of the server.
+func (self *ControlClient) Info() (*ServerInfo, error) {
+	r, err := self.Call("info", nil)
+	if err != nil {
+		return nil, err
+	}
+	row, err := r.first()
+	if err != nil {
+		return nil, err
+	}
+	return &ServerInfo{
+		Port:            controlInt(row["port"]),
+		BindAddr:        controlString(row["bind_addr"]),
+		Uuid:            controlString(row["uuid"]),
+		Chroot:          controlString(row["chroot"]),
+		AccessLog:       controlString(row["access_log"]),
+		ErrorLog:        controlString(row["error_log"]),
+		PidFile:         controlString(row["pid_file"]),
+		DefaultHostname: controlString(row["default_hostname"]),
+	}, nil
+}
+
+//Time returns the server's idea of the current time.
+func (self *ControlClient) Time() (time.Time, error) {
+	r, err := self.Call("time", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	row, err := r.first()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(controlInt(row["time"]), 0), nil
+}
+
+//Uuid returns the uuid of the server, which is the ServerId of its requests.
+func (self *ControlClient) Uuid() (string, error) {
+	r, err := self.Call("uuid", nil)
+	if err != nil {
+		return "", err
+	}
+	row, err := r.first()
+	if err != nil {
+		return "", err
+	}
+	return controlString(row["uuid"]), nil
+}
+
+//Kill closes the client connection with the id supplied, which is the ClientId of
+//the requests from that client.
+func (self *ControlClient) Kill(id int) (*ControlResult, error) {
+	return self.Call("kill", map[string]interface{}{"id": id})
+}
+
+//Reload asks mongrel2 to reload its configuration.
+func (self *ControlClient) Reload() (string, error) {
+	return self.message("reload")
+}
+
+//Stop asks mongrel2 to shut down gracefully, letting open connections finish.
+func (self *ControlClient) Stop() (string, error) {
+	return self.message("stop")
+}
+
+//Terminate asks mongrel2 to shut down immediately.
+func (self *ControlClient) Terminate() (string, error) {
+	return self.message("terminate")
+}
+
+//Control returns the result of the "control" command, which reports on the control
+//port itself.
+func (self *ControlClient) Control() (*ControlResult, error) {
+	return self.Call("control", nil)
+}
+
+//message sends a command that is answered with a message rather than a table.
+func (self *ControlClient) message(command string) (string, error) {
+	r, err := self.Call(command, nil)
+	if err != nil {
+		return "", err
+	}
+	return r.Msg, nil
+}
+
+func controlString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	}
+	return fmt.Sprint(v)
+}
+
+func controlInt(v interface{}) int64 {
+	switch x := v.(type) {
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	case string:
+		i, _ := strconv.ParseInt(x, 10, 64)
+		return i
+	case bool:
+		if x {
+			return 1
+		}
+	}
+	return 0
+}
+
+func controlBool(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case int64:
+		return x != 0
+	case string:
+		b, _ := strconv.ParseBool(x)
+		return b
+	}
+	return false
+}
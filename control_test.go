@@ -0,0 +1,146 @@
+package mongrel2
+
+import (
+	"launchpad.net/gocheck"
+	"time"
+)
+
+type ControlSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ControlSuite{})
+
+func (s *ControlSuite) TestDecodeTable(c *gocheck.C) {
+	b, err := EncodeTnetstring(map[string]interface{}{
+		"headers": []string{"id", "fd", "type", "bytes_read"},
+		"rows": []interface{}{
+			[]interface{}{1, 9, "socket", 300},
+			[]interface{}{2, 10, "websocket", 12},
+		},
+	})
+	c.Assert(err, gocheck.IsNil)
+	r, err := decodeControlResult(b)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(r.Headers, gocheck.DeepEquals, []string{"id", "fd", "type", "bytes_read"})
+	maps := r.Maps()
+	c.Assert(maps, gocheck.HasLen, 2)
+	c.Check(maps[1]["type"], gocheck.Equals, "websocket")
+	c.Check(controlInt(maps[0]["bytes_read"]), gocheck.Equals, int64(300))
+}
+
+func (s *ControlSuite) TestDecodeMessage(c *gocheck.C) {
+	r, err := decodeControlResult([]byte("29:3:msg,19:the server will die,}"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(r.Msg, gocheck.Equals, "the server will die")
+}
+
+func (s *ControlSuite) TestDecodeError(c *gocheck.C) {
+	b, _ := EncodeTnetstring(map[string]string{"code": "INVALID_ARGUMENT", "error": "no such id"})
+	_, err := decodeControlResult(b)
+	c.Check(err, gocheck.DeepEquals, &ControlError{"INVALID_ARGUMENT", "no such id"})
+}
+
+//fakeControlSocket records the requests sent to it and answers each with the next of
+//its replies.  A reply that is an error is returned as the error from Recv.
+type fakeControlSocket struct {
+	sent     []string
+	replies  []interface{}
+	timeouts []time.Duration
+	closed   bool
+}
+
+func (self *fakeControlSocket) Send(data []byte) error {
+	self.sent = append(self.sent, string(data))
+	return nil
+}
+
+func (self *fakeControlSocket) Recv(timeout time.Duration) ([]byte, error) {
+	self.timeouts = append(self.timeouts, timeout)
+	reply := self.replies[0]
+	self.replies = self.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return EncodeTnetstring(reply)
+}
+
+func (self *fakeControlSocket) Close() error {
+	self.closed = true
+	return nil
+}
+
+func table(headers []string, rows ...[]interface{}) map[string]interface{} {
+	return map[string]interface{}{"headers": headers, "rows": rows}
+}
+
+func (s *ControlSuite) TestCommands(c *gocheck.C) {
+	socket := &fakeControlSocket{replies: []interface{}{
+		map[string]string{"msg": "killed"},
+		table([]string{"port", "bind_addr", "uuid", "chroot", "default_hostname"},
+			[]interface{}{6767, "0.0.0.0", "f400bf85", "./", "localhost"}),
+		table([]string{"time"}, []interface{}{1700000000}),
+		table([]string{"id", "system", "name", "state", "status"},
+			[]interface{}{1, false, "SERVER", "", "idle"}),
+		map[string]string{"code": "INVALID_ARGUMENT", "error": "no such id"},
+	}}
+	client := &ControlClient{socket: socket}
+
+	r, err := client.Kill(42)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(r.Msg, gocheck.Equals, "killed")
+
+	info, err := client.Info()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(*info, gocheck.Equals, ServerInfo{Port: 6767, BindAddr: "0.0.0.0", Uuid: "f400bf85", Chroot: "./", DefaultHostname: "localhost"})
+
+	now, err := client.Time()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(now.Equal(time.Unix(1700000000, 0)), gocheck.Equals, true)
+
+	tasks, err := client.Tasks()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(tasks, gocheck.DeepEquals, []ControlTask{{Id: 1, Name: "SERVER", Status: "idle"}})
+
+	_, err = client.Kill(7)
+	c.Check(err, gocheck.DeepEquals, &ControlError{"INVALID_ARGUMENT", "no such id"})
+
+	//each command is a list of its name and a dict of its arguments
+	c.Check(socket.sent, gocheck.DeepEquals, []string{
+		"21:4:kill,10:2:id,2:42#}]",
+		"10:4:info,0:}]",
+		"10:4:time,0:}]",
+		"28:6:status,15:4:what,5:tasks,}]",
+		"19:4:kill,9:2:id,1:7#}]",
+	})
+
+	c.Check(client.Close(), gocheck.IsNil)
+	c.Check(socket.closed, gocheck.Equals, true)
+}
+
+func (s *ControlSuite) TestFailedSocketIsReplaced(c *gocheck.C) {
+	first := &fakeControlSocket{replies: []interface{}{ErrControlTimeout}}
+	second := &fakeControlSocket{replies: []interface{}{map[string]string{"msg": "killed"}}}
+	sockets := []*fakeControlSocket{second}
+	client := &ControlClient{Timeout: time.Second, socket: first, dial: func() (controlSocket, error) {
+		next := sockets[0]
+		sockets = sockets[1:]
+		return next, nil
+	}}
+
+	_, err := client.Kill(1)
+	c.Check(err, gocheck.Equals, ErrControlTimeout)
+	c.Check(first.timeouts, gocheck.DeepEquals, []time.Duration{time.Second})
+	c.Check(first.closed, gocheck.Equals, true)
+
+	//the REQ socket still waits for the lost answer, so the next command gets a new one
+	r, err := client.Kill(1)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(r.Msg, gocheck.Equals, "killed")
+	c.Check(second.sent, gocheck.HasLen, 1)
+
+	c.Check(client.Close(), gocheck.IsNil)
+	c.Check(second.closed, gocheck.Equals, true)
+	_, err = client.Kill(1)
+	c.Check(err, gocheck.Equals, ErrTransportClosed)
+}
@@ -0,0 +1,152 @@
+package mongrel2
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+//DefaultMaxClients is the MaxClients of a handler that doesn't set one.
+const DefaultMaxClients = 10000
+
+//DisconnectEvent describes mongrel2's report that a client has gone away.  The read
+//methods of the handlers don't return disconnects; they cancel the context for the
+//client (see ClientContext), pass the event to the handler's OnDisconnect, if it is
+//set, and go on to the next message.
+type DisconnectEvent struct {
+	ServerId string
+	ClientId int
+}
+
+//clientKey identifies one client connection.  Client ids are only unique within
+//a single mongrel2 server.
+type clientKey struct {
+	serverId string
+	clientId int
+}
+
+type clientConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	//age is the connection's place in clientTracker's order
+	age *list.Element
+}
+
+//clientTracker keeps a context for every connection that has sent a request and
+//not yet disconnected or been closed by the handler.
+type clientTracker struct {
+	sync.Mutex
+	conns map[clientKey]*clientConn
+	//order holds the keys of conns, oldest first
+	order list.List
+
+	//watchers are told about disconnects by the types built on the handler
+	watchers []func(clientKey)
+}
+
+//ClientContext returns the context for the connection identified by serverId and
+//clientId.  The context is cancelled when mongrel2 reports that the client has
+//disconnected, or when the handler closes the connection with Close, so work being
+//done for the client can be abandoned.  All requests read from the same connection
+//share the same context.  Mongrel2 only reports a disconnect to one of the handlers
+//sharing its socket, so the handler keeps the contexts of at most MaxClients
+//connections and cancels the oldest one to make room for another.
+func (self *RawHandlerDefault) ClientContext(serverId string, clientId int) context.Context {
+	self.clients.Lock()
+	key := clientKey{serverId, clientId}
+	if conn, ok := self.clients.conns[key]; ok {
+		self.clients.Unlock()
+		return conn.ctx
+	}
+	if self.clients.conns == nil {
+		self.clients.conns = make(map[clientKey]*clientConn)
+	}
+	var evicted []clientKey
+	for self.clients.order.Len() > 0 && self.clients.order.Len() >= self.maxClients() {
+		oldest := self.clients.order.Front().Value.(clientKey)
+		self.clients.remove(oldest)
+		evicted = append(evicted, oldest)
+	}
+	conn := new(clientConn)
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.age = self.clients.order.PushBack(key)
+	self.clients.conns[key] = conn
+	watchers := self.clients.watchers
+	self.clients.Unlock()
+
+	for _, old := range evicted {
+		for _, watcher := range watchers {
+			watcher(old)
+		}
+	}
+	return conn.ctx
+}
+
+func (self *RawHandlerDefault) maxClients() int {
+	if self.MaxClients <= 0 {
+		return DefaultMaxClients
+	}
+	return self.MaxClients
+}
+
+//remove cancels and forgets the context of a client; the caller must hold the lock.
+func (self *clientTracker) remove(key clientKey) {
+	if conn, ok := self.conns[key]; ok {
+		conn.cancel()
+		self.order.Remove(conn.age)
+		delete(self.conns, key)
+	}
+}
+
+//forget cancels and forgets the contexts of clients that are gone and tells the
+//watchers about them.  Mongrel2 reuses client ids, so the next request with the same
+//id will get a fresh context.
+func (self *RawHandlerDefault) forget(serverId string, clientIds ...int) {
+	self.clients.Lock()
+	for _, clientId := range clientIds {
+		self.clients.remove(clientKey{serverId, clientId})
+	}
+	watchers := self.clients.watchers
+	self.clients.Unlock()
+
+	for _, clientId := range clientIds {
+		for _, watcher := range watchers {
+			watcher(clientKey{serverId, clientId})
+		}
+	}
+}
+
+//disconnected forgets a client that has gone away and reports the disconnect to
+//OnDisconnect.
+func (self *RawHandlerDefault) disconnected(serverId string, clientId int) *DisconnectEvent {
+	self.forget(serverId, clientId)
+	event := &DisconnectEvent{serverId, clientId}
+	if self.OnDisconnect != nil {
+		self.OnDisconnect(event)
+	}
+	return event
+}
+
+//watchDisconnects arranges for f to be called with each client that disconnects.
+func (self *RawHandlerDefault) watchDisconnects(f func(clientKey)) {
+	self.clients.Lock()
+	defer self.clients.Unlock()
+	self.clients.watchers = append(self.clients.watchers, f)
+}
+
+//isDisconnect reports whether a message is mongrel2's notice that a client has gone
+//away.  These are sent with METHOD set to JSON and a body of {"type":"disconnect"},
+//whatever kind of handler they are sent to.
+func isDisconnect(method string, body []byte) bool {
+	if method != "JSON" || len(body) == 0 {
+		return false
+	}
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return false
+	}
+	return msg.Type == "disconnect"
+}
@@ -0,0 +1,141 @@
+package mongrel2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//HandlerFunc is the shape of a handler written against this package's own types
+//rather than net/http: it answers a request with the response to send back.  It may
+//return nil if it has dealt with the client itself, for example with StartStream.
+type HandlerFunc func(*HttpRequest) *HttpResponse
+
+//DefaultRetryAfter is the Retry-After given by a Dispatcher that doesn't set one.
+const DefaultRetryAfter = time.Second
+
+//Dispatcher reads requests from Handler and answers them with Serve, in a pool of
+//Workers goroutines (runtime.NumCPU() if it is zero).  Requests wait for a worker
+//in a queue of QueueSize (Workers if it is zero, none at all if it is less than
+//zero).  When the queue is full the request is answered at once with Overloaded's
+//response, which is by default a 503 telling the client to come back after
+//RetryAfter, so that the requests don't pile up in mongrel2.  A Dispatcher does not
+//recover from panics in Serve; wrap it in Recover (see Chain) if that is wanted.  A
+//panic while a response is being sent is recovered from and logged, like an error
+//sending it.
+type Dispatcher struct {
+	Handler    *HttpHandlerDefault
+	Serve      HandlerFunc
+	Workers    int
+	QueueSize  int
+	RetryAfter time.Duration
+	Overloaded HandlerFunc
+}
+
+//NewDispatcher returns a Dispatcher with the default pool and queue sizes.
+func NewDispatcher(handler *HttpHandlerDefault, serve HandlerFunc) *Dispatcher {
+	return &Dispatcher{Handler: handler, Serve: serve}
+}
+
+//Run dispatches requests until reading from mongrel2 stops, because ctx is cancelled,
+//the handler's Shutdown is called or there is an error (which is returned).  It
+//returns once the workers have answered the requests left in the queue.  As with
+//Serve, large uploads are only dispatched once mongrel2 has received all of them
+//and their temporary files are removed after they have been answered.
+func (self *Dispatcher) Run(ctx context.Context) error {
+	queue := make(chan *HttpRequest, self.queueSize())
+	var workers sync.WaitGroup
+	for i := 0; i < self.workers(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for req := range queue {
+				self.dispatch(self.Serve, req)
+			}
+		}()
+	}
+
+	in := make(chan *HttpRequest)
+	read := make(chan error, 1)
+	go func() {
+		read <- self.Handler.RunReadLoop(ctx, in)
+		close(in)
+	}()
+	for req := range in {
+		if req.Upload != nil && !req.Upload.Done {
+			//wait for the rest of a large upload
+			continue
+		}
+		select {
+		case queue <- req:
+		default:
+			self.dispatch(self.overloaded, req)
+		}
+	}
+	close(queue)
+	workers.Wait()
+	return <-read
+}
+
+//dispatch answers req with h and sends the response, if there is one.
+func (self *Dispatcher) dispatch(h HandlerFunc, req *HttpRequest) {
+	if req.Upload != nil {
+		defer req.Upload.Remove()
+	}
+	response := h(req)
+	if response == nil {
+		return
+	}
+	if err := self.send(response); err != nil {
+		fmt.Fprintf(os.Stderr, "HTTP dispatcher unable to send response to %s %d: %s\n", req.ServerId, req.ClientId, err)
+	}
+}
+
+//send writes response to mongrel2, turning a panic while doing so, such as from a
+//Body that panics when it is read, into an error so that it doesn't take the
+//workers down with it.
+func (self *Dispatcher) send(response *HttpResponse) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return self.Handler.WriteMessage(response)
+}
+
+//overloaded answers a request that there was no room in the queue for.
+func (self *Dispatcher) overloaded(req *HttpRequest) *HttpResponse {
+	if self.Overloaded != nil {
+		return self.Overloaded(req)
+	}
+	retry := self.RetryAfter
+	if retry <= 0 {
+		retry = DefaultRetryAfter
+	}
+	seconds := int((retry + time.Second - 1) / time.Second)
+	result := plainResponse(req, http.StatusServiceUnavailable, "")
+	result.Header["Retry-After"] = strconv.Itoa(seconds)
+	return result
+}
+
+func (self *Dispatcher) workers() int {
+	if self.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return self.Workers
+}
+
+func (self *Dispatcher) queueSize() int {
+	switch {
+	case self.QueueSize == 0:
+		return self.workers()
+	case self.QueueSize < 0:
+		return 0
+	}
+	return self.QueueSize
+}
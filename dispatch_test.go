@@ -0,0 +1,137 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"strings"
+)
+
+type DispatchSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&DispatchSuite{})
+
+func getRequest(clientId int, path string) []byte {
+	return []byte(fmt.Sprintf(`server-1 %d %s 16:{"METHOD":"GET"},0:,`, clientId, path))
+}
+
+//sentResponse decodes the next response a chanTransport was given.
+func sentResponse(c *gocheck.C, transport *chanTransport) (int, *http.Response) {
+	_, ids, data, err := DecodeResponse(<-transport.sent)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(ids, gocheck.HasLen, 1)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	c.Assert(err, gocheck.IsNil)
+	return ids[0], resp
+}
+
+func echoPath(req *HttpRequest) *HttpResponse {
+	response := NewHttpResponse(req)
+	response.Body = ioutil.NopCloser(strings.NewReader(req.Path))
+	response.ContentLength = int64(len(req.Path))
+	return response
+}
+
+func (s *DispatchSuite) TestDispatch(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	dispatcher := NewDispatcher(handler, echoPath)
+	dispatcher.Workers = 3
+	dispatcher.QueueSize = 5
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(ctx) }()
+
+	for i := 1; i <= 5; i++ {
+		transport.in <- getRequest(i, fmt.Sprintf("/%d", i))
+	}
+	paths := make(map[int]string)
+	for i := 1; i <= 5; i++ {
+		id, resp := sentResponse(c, transport)
+		c.Check(resp.StatusCode, gocheck.Equals, 200)
+		body, _ := ioutil.ReadAll(resp.Body)
+		paths[id] = string(body)
+	}
+	c.Check(paths, gocheck.DeepEquals, map[int]string{1: "/1", 2: "/2", 3: "/3", 4: "/4", 5: "/5"})
+	cancel()
+	c.Check(<-result, gocheck.IsNil)
+}
+
+func (s *DispatchSuite) TestOverloaded(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	started := make(chan bool)
+	release := make(chan bool)
+	dispatcher := NewDispatcher(handler, func(req *HttpRequest) *HttpResponse {
+		started <- true
+		<-release
+		return echoPath(req)
+	})
+	dispatcher.Workers = 1
+	dispatcher.QueueSize = 2
+	dispatcher.QueueSize = 1
+	dispatcher.RetryAfter = 1500e6
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(context.Background()) }()
+
+	//the first request keeps the worker busy, the second waits in the queue and
+	//there is no room for the third
+	transport.in <- getRequest(1, "/1")
+	<-started
+	transport.in <- getRequest(2, "/2")
+	transport.in <- getRequest(3, "/3")
+	id, resp := sentResponse(c, transport)
+	c.Check(id, gocheck.Equals, 3)
+	c.Check(resp.StatusCode, gocheck.Equals, 503)
+	c.Check(resp.Header.Get("Retry-After"), gocheck.Equals, "2")
+
+	close(release)
+	<-started
+	for _, want := range []int{1, 2} {
+		id, resp = sentResponse(c, transport)
+		c.Check(id, gocheck.Equals, want)
+		c.Check(resp.StatusCode, gocheck.Equals, 200)
+	}
+	c.Check(handler.Shutdown(context.Background()), gocheck.IsNil)
+	c.Check(<-result, gocheck.IsNil)
+}
+
+//panicReader is a body that panics when it is read.
+type panicReader struct{}
+
+func (panicReader) Read(p []byte) (int, error) {
+	panic("broken body")
+}
+
+func (s *DispatchSuite) TestSendPanics(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	dispatcher := NewDispatcher(handler, func(req *HttpRequest) *HttpResponse {
+		if req.Path == "/broken" {
+			response := NewHttpResponse(req)
+			response.Body = ioutil.NopCloser(panicReader{})
+			return response
+		}
+		return echoPath(req)
+	})
+	dispatcher.Workers = 1
+	dispatcher.QueueSize = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(ctx) }()
+
+	//the worker lives on to answer the next request
+	transport.in <- getRequest(1, "/broken")
+	transport.in <- getRequest(2, "/fine")
+	id, resp := sentResponse(c, transport)
+	c.Check(id, gocheck.Equals, 2)
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	cancel()
+	c.Check(<-result, gocheck.IsNil)
+}
@@ -0,0 +1,124 @@
+package mongrel2
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+//FileRegistry is a SpecRegistry that keeps the specs in a JSON file, so that several
+//handler processes on the same machine get the same, non-overlapping assignments and
+//keep them when they are restarted.  The file is locked while it is read and
+//updated, so processes can share it safely.  It is created when the first spec is
+//allocated.  New specs come from Allocator, or a TCPAllocator if it is nil; every
+//process sharing the file should use the same kind of Allocator.
+type FileRegistry struct {
+	Path      string
+	Allocator Allocator
+}
+
+//NewFileRegistry returns a registry that keeps its specs in the file at path.
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{Path: path}
+}
+
+//Get returns the spec for name from the file, allocating one and adding it to the
+//file if it isn't there.
+func (self *FileRegistry) Get(name string) (*HandlerSpec, error) {
+	var result *HandlerSpec
+	var allocErr error
+	err := self.update(func(specs map[string]*HandlerSpec) bool {
+		if result = specs[name]; result != nil {
+			return false
+		}
+		result, allocErr = allocatorOrDefault(self.Allocator).Allocate(name, specs)
+		if allocErr != nil {
+			return false
+		}
+		specs[name] = result
+		return true
+	})
+	if err == nil {
+		err = allocErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Specs returns all the specs in the file, sorted by name.  The file is only read,
+//never created: if it doesn't exist yet there are no specs.
+func (self *FileRegistry) Specs() ([]*HandlerSpec, error) {
+	f, err := os.Open(self.Path)
+	if os.IsNotExist(err) {
+		return sortedSpecs(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = lockFile(f); err != nil {
+		return nil, err
+	}
+	defer unlockFile(f)
+
+	specs, err := readSpecs(f)
+	if err != nil {
+		return nil, err
+	}
+	return sortedSpecs(specs), nil
+}
+
+//update reads the specs from the file with it locked and calls fn with them.  If fn
+//returns true the specs are written back before the lock is released.
+func (self *FileRegistry) update(fn func(map[string]*HandlerSpec) bool) error {
+	f, err := os.OpenFile(self.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	specs, err := readSpecs(f)
+	if err != nil {
+		return err
+	}
+	if !fn(specs) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(sortedSpecs(specs), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+//readSpecs decodes the specs in a registry file, which may be empty.
+func readSpecs(f *os.File) (map[string]*HandlerSpec, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	specs := make(map[string]*HandlerSpec)
+	if len(data) > 0 {
+		var list []*HandlerSpec
+		if err = json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		for _, spec := range list {
+			specs[spec.Name] = spec
+		}
+	}
+	return specs, nil
+}
@@ -0,0 +1,361 @@
+package mongrel2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultFileStreamSize is the StreamSize of a FileServer that doesn't set one.
+const DefaultFileStreamSize = 1 << 20
+
+//FileServer is a HandlerFunc, in ServeRequest, that serves the files under Root.
+//The file is found from the request's path relative to the mongrel2 route's
+//PATTERN (see Router) with Prefix, if it is set, taken off the front as a whole
+//number of segments, and then percent-decoded.  A request for
+//a directory is answered with the first of its IndexFiles ("index.html" if that is
+//nil) that exists; there are no directory listings.  The content type comes from
+//the file's extension or, failing that, from its first 512 bytes.  Responses carry
+//an ETag and Last-Modified, so that If-None-Match and If-Modified-Since requests
+//can be answered with 304, and Range requests, for one range or several, are
+//answered with 206 (multipart/byteranges for several) as long as If-Range, if
+//present, still matches.  A body bigger than StreamSize (DefaultFileStreamSize if
+//it is zero) is streamed to mongrel2 in pieces instead of being read into memory.
+type FileServer struct {
+	Root       string
+	Prefix     string
+	IndexFiles []string
+	StreamSize int64
+}
+
+//stripPrefix takes Prefix off the front of p if p is Prefix or goes on from it with a
+//slash, so that a Prefix of /static leaves /staticfoo alone.
+func (self *FileServer) stripPrefix(p string) string {
+	prefix := strings.TrimSuffix(self.Prefix, "/")
+	if prefix != "" && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+		return p[len(prefix):]
+	}
+	return p
+}
+
+//NewFileServer returns a FileServer for the directory root.
+func NewFileServer(root string) *FileServer {
+	return &FileServer{Root: root}
+}
+
+//byteRange is a part of a file, as asked for in a Range header.
+type byteRange struct {
+	start, length int64
+}
+
+func (self byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", self.start, self.start+self.length-1, size)
+}
+
+//errUnsatisfiable is returned by parseRange for a Range none of whose ranges overlap
+//the file.
+var errUnsatisfiable = errors.New("requested range not satisfiable")
+
+//ServeRequest answers req with the file it asks for.
+func (self *FileServer) ServeRequest(req *HttpRequest) *HttpResponse {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		result := plainResponse(req, http.StatusMethodNotAllowed, "")
+		result.Header["Allow"] = "GET, HEAD"
+		return result
+	}
+	name := path.Clean("/" + unescapePath(self.stripPrefix(relativePath(req))))
+	f, info, err := self.open(name)
+	if err == nil && info.IsDir() {
+		f.Close()
+		if !strings.HasSuffix(req.Path, "/") {
+			//relative links in the index only work from a path ending in a slash
+			target := req.Path + "/"
+			if req.Query != "" {
+				target += "?" + req.Query
+			}
+			result := plainResponse(req, http.StatusMovedPermanently, "")
+			result.Header["Location"] = target
+			return result
+		}
+		f, info, err = self.openIndex(name)
+	}
+	if err != nil {
+		if os.IsPermission(err) {
+			return plainResponse(req, http.StatusForbidden, "")
+		}
+		return plainResponse(req, http.StatusNotFound, "")
+	}
+
+	result := NewHttpResponse(req)
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	modified := info.ModTime().UTC().Truncate(time.Second)
+	result.Header["ETag"] = etag
+	result.Header["Last-Modified"] = modified.Format(http.TimeFormat)
+	result.Header["Accept-Ranges"] = "bytes"
+	if notModified(req, etag, modified) {
+		f.Close()
+		result.StatusCode = http.StatusNotModified
+		//with no body, this is just the length the client already has
+		result.ContentLength = info.Size()
+		return result
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(info.Name()))
+	if contentType == "" {
+		buf := make([]byte, 512)
+		n, _ := io.ReadFull(f, buf)
+		contentType = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return plainResponse(req, http.StatusInternalServerError, "")
+		}
+	}
+	result.Header["Content-Type"] = contentType
+
+	size := info.Size()
+	var ranges []byteRange
+	if r := req.Header.Get("Range"); r != "" && ifRangeMatches(req, etag, modified) {
+		ranges, err = parseRange(r, size)
+		if err == errUnsatisfiable {
+			f.Close()
+			result = plainResponse(req, http.StatusRequestedRangeNotSatisfiable, "")
+			result.Header["Content-Range"] = fmt.Sprintf("bytes */%d", size)
+			return result
+		}
+	}
+
+	var body io.ReadCloser
+	switch len(ranges) {
+	case 0:
+		body = f
+		result.ContentLength = size
+	case 1:
+		result.StatusCode = http.StatusPartialContent
+		result.Header["Content-Range"] = ranges[0].contentRange(size)
+		body = &fileSection{io.NewSectionReader(f, ranges[0].start, ranges[0].length), f}
+		result.ContentLength = ranges[0].length
+	default:
+		result.StatusCode = http.StatusPartialContent
+		boundary := multipart.NewWriter(nil).Boundary()
+		result.Header["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+		result.ContentLength = multipartSize(ranges, contentType, size, boundary)
+		pr, pw := io.Pipe()
+		go writeRanges(pw, f, ranges, contentType, size, boundary)
+		body = pr
+	}
+
+	if req.Method == "HEAD" || result.ContentLength == 0 {
+		//the Content-Length is still sent, as it would be for a GET
+		body.Close()
+		return result
+	}
+	result.Body = body
+	streamSize := self.StreamSize
+	if streamSize == 0 {
+		streamSize = DefaultFileStreamSize
+	}
+	result.Stream = result.ContentLength > streamSize
+	return result
+}
+
+//open opens the file called name (a cleaned, rooted path) under Root.
+func (self *FileServer) open(name string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(filepath.Join(self.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+//openIndex opens the first of the index files in the directory dir.
+func (self *FileServer) openIndex(dir string) (*os.File, os.FileInfo, error) {
+	indexes := self.IndexFiles
+	if indexes == nil {
+		indexes = []string{"index.html"}
+	}
+	for _, index := range indexes {
+		f, info, err := self.open(path.Join(dir, index))
+		if err == nil && !info.IsDir() {
+			return f, info, nil
+		}
+		if err == nil {
+			f.Close()
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+//fileSection reads part of a file and closes the file.
+type fileSection struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (self *fileSection) Close() error {
+	return self.f.Close()
+}
+
+//notModified reports whether the client's copy, described by If-None-Match or (if
+//that is missing) If-Modified-Since, is still good.
+func notModified(req *HttpRequest, etag string, modified time.Time) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return etagListMatches(match, etag)
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.After(since)
+}
+
+//ifRangeMatches reports whether a Range should be honoured: If-Range, if there is
+//one, must be the current ETag or Last-Modified date.
+func ifRangeMatches(req *HttpRequest, etag string, modified time.Time) bool {
+	ifRange := strings.TrimSpace(req.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+	date, err := http.ParseTime(ifRange)
+	return err == nil && date.Equal(modified)
+}
+
+//etagListMatches compares etag with the list in an If-None-Match header, weakly as
+//RFC 7232 says to.
+func etagListMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//parseRange parses a Range header for a file of size bytes.  Ranges that start past
+//the end of the file are dropped, and errUnsatisfiable is returned if that leaves
+//none.  Any other problem with the header is also an error, in which case the whole
+//file should be sent, as is the case if the ranges add up to more than the file.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, fmt.Errorf("unsupported range unit in %q", header)
+	}
+	var result []byteRange
+	total := int64(0)
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '-')
+		if i < 0 {
+			return nil, fmt.Errorf("bad range %q", spec)
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var r byteRange
+		if first == "" {
+			//the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad range %q", spec)
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, fmt.Errorf("bad range %q", spec)
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, fmt.Errorf("bad range %q", spec)
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start, end - start + 1}
+		}
+		result = append(result, r)
+		total += r.length
+	}
+	if len(result) == 0 {
+		return nil, errUnsatisfiable
+	}
+	if total > size {
+		return nil, errors.New("ranges cover more than the file")
+	}
+	return result, nil
+}
+
+//rangeHeader is the header of the part of a multipart/byteranges body for r.
+func rangeHeader(r byteRange, contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+//countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (self *countingWriter) Write(p []byte) (int, error) {
+	*self += countingWriter(len(p))
+	return len(p), nil
+}
+
+//multipartSize works out the length of the multipart/byteranges body that
+//writeRanges writes.
+func multipartSize(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(rangeHeader(r, contentType, size))
+		w += countingWriter(r.length)
+	}
+	mw.Close()
+	return int64(w)
+}
+
+//writeRanges writes the ranges of f to pw as a multipart/byteranges body and closes
+//them both.
+func writeRanges(pw *io.PipeWriter, f *os.File, ranges []byteRange, contentType string, size int64, boundary string) {
+	defer f.Close()
+	mw := multipart.NewWriter(pw)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(rangeHeader(r, contentType, size))
+		if err == nil {
+			_, err = io.Copy(part, io.NewSectionReader(f, r.start, r.length))
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+	pw.CloseWithError(mw.Close())
+}
@@ -0,0 +1,193 @@
+package mongrel2
+
+import (
+	"context"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type FileServerSuite struct {
+	dir    string
+	server *FileServer
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&FileServerSuite{})
+
+const alphabet = "abcdefghijklmnopqrstuvwxyz"
+
+func (s *FileServerSuite) SetUpTest(c *gocheck.C) {
+	s.dir = c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "letters.txt"), []byte(alphabet), 0644), gocheck.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "noext"), []byte("<html><body>hi</body></html>"), 0644), gocheck.IsNil)
+	c.Assert(os.Mkdir(filepath.Join(s.dir, "docs"), 0755), gocheck.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "docs", "index.html"), []byte("<p>docs</p>"), 0644), gocheck.IsNil)
+	s.server = NewFileServer(s.dir)
+}
+
+func fileRequest(method, path string, header map[string]string) *HttpRequest {
+	req := routerRequest(method, "/static/", "/static"+path)
+	req.Header = make(Header)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func readBody(c *gocheck.C, resp *HttpResponse) string {
+	c.Assert(resp.Body, gocheck.NotNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	return string(body)
+}
+
+func (s *FileServerSuite) TestServeFile(c *gocheck.C) {
+	resp := s.server.ServeRequest(fileRequest("GET", "/letters.txt", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(resp.Header["Content-Type"], gocheck.Equals, "text/plain; charset=utf-8")
+	c.Check(resp.Header["ETag"], gocheck.Matches, `"[0-9a-f]+-1a"`)
+	c.Check(resp.Header["Accept-Ranges"], gocheck.Equals, "bytes")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(26))
+	c.Check(resp.Stream, gocheck.Equals, false)
+	c.Check(readBody(c, resp), gocheck.Equals, alphabet)
+
+	resp = s.server.ServeRequest(fileRequest("GET", "/noext", nil))
+	c.Check(resp.Header["Content-Type"], gocheck.Equals, "text/html; charset=utf-8")
+	c.Check(readBody(c, resp), gocheck.Matches, "<html>.*")
+
+	resp = s.server.ServeRequest(fileRequest("HEAD", "/letters.txt", nil))
+	c.Check(resp.ContentLength, gocheck.Equals, int64(26))
+	c.Check(resp.Body, gocheck.IsNil)
+}
+
+func (s *FileServerSuite) TestNotFound(c *gocheck.C) {
+	for _, path := range []string{"/missing", "/../" + filepath.Base(s.dir) + "/letters.txt/x", "/docs/../../etc/passwd"} {
+		resp := s.server.ServeRequest(fileRequest("GET", path, nil))
+		c.Check(resp.StatusCode, gocheck.Equals, 404, gocheck.Commentf(path))
+	}
+	resp := s.server.ServeRequest(fileRequest("POST", "/letters.txt", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 405)
+}
+
+func (s *FileServerSuite) TestPaths(c *gocheck.C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "my file.txt"), []byte("spaced"), 0644), gocheck.IsNil)
+	resp := s.server.ServeRequest(fileRequest("GET", "/my%20file.txt", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(readBody(c, resp), gocheck.Equals, "spaced")
+	resp = s.server.ServeRequest(fileRequest("GET", "/%2e%2e/%2e%2e/etc/passwd", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 404)
+
+	//the prefix only comes off as a whole segment
+	s.server.Prefix = "/files/"
+	resp = s.server.ServeRequest(fileRequest("GET", "/files/letters.txt", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(readBody(c, resp), gocheck.Equals, alphabet)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "filesfoo"), []byte("foo"), 0644), gocheck.IsNil)
+	resp = s.server.ServeRequest(fileRequest("GET", "/filesfoo", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(readBody(c, resp), gocheck.Equals, "foo")
+	resp = s.server.ServeRequest(fileRequest("GET", "/filesletters.txt", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 404)
+}
+
+func (s *FileServerSuite) TestIndex(c *gocheck.C) {
+	resp := s.server.ServeRequest(fileRequest("GET", "/docs/", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(resp.Header["Content-Type"], gocheck.Equals, "text/html; charset=utf-8")
+	c.Check(readBody(c, resp), gocheck.Equals, "<p>docs</p>")
+
+	resp = s.server.ServeRequest(fileRequest("GET", "/docs", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 301)
+	c.Check(resp.Header["Location"], gocheck.Equals, "/static/docs/")
+
+	resp = s.server.ServeRequest(fileRequest("GET", "/", nil))
+	c.Check(resp.StatusCode, gocheck.Equals, 404)
+}
+
+func (s *FileServerSuite) TestConditional(c *gocheck.C) {
+	first := s.server.ServeRequest(fileRequest("GET", "/letters.txt", nil))
+	first.Body.Close()
+	etag := first.Header["ETag"]
+
+	resp := s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"If-None-Match": `"other", W/` + etag}))
+	c.Check(resp.StatusCode, gocheck.Equals, 304)
+	c.Check(resp.Body, gocheck.IsNil)
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"If-None-Match": `"other"`}))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	resp.Body.Close()
+
+	modified := first.Header["Last-Modified"]
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"If-Modified-Since": modified}))
+	c.Check(resp.StatusCode, gocheck.Equals, 304)
+	earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"If-Modified-Since": earlier}))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	resp.Body.Close()
+}
+
+func (s *FileServerSuite) TestRange(c *gocheck.C) {
+	resp := s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"Range": "bytes=2-4"}))
+	c.Check(resp.StatusCode, gocheck.Equals, 206)
+	c.Check(resp.Header["Content-Range"], gocheck.Equals, "bytes 2-4/26")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(3))
+	c.Check(readBody(c, resp), gocheck.Equals, "cde")
+
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"Range": "bytes=-3"}))
+	c.Check(readBody(c, resp), gocheck.Equals, "xyz")
+
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"Range": "bytes=30-"}))
+	c.Check(resp.StatusCode, gocheck.Equals, 416)
+	c.Check(resp.Header["Content-Range"], gocheck.Equals, "bytes */26")
+
+	//a range for an old version of the file is ignored
+	resp = s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"Range": "bytes=2-4", "If-Range": `"old"`}))
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(readBody(c, resp), gocheck.Equals, alphabet)
+}
+
+func (s *FileServerSuite) TestMultiRange(c *gocheck.C) {
+	resp := s.server.ServeRequest(fileRequest("GET", "/letters.txt", map[string]string{"Range": "bytes=0-1, 24-"}))
+	c.Check(resp.StatusCode, gocheck.Equals, 206)
+	mediaType, params, err := mime.ParseMediaType(resp.Header["Content-Type"])
+	c.Assert(err, gocheck.IsNil)
+	c.Check(mediaType, gocheck.Equals, "multipart/byteranges")
+
+	body := readBody(c, resp)
+	c.Check(int64(len(body)), gocheck.Equals, resp.ContentLength)
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, want := range []struct{ contentRange, data string }{{"bytes 0-1/26", "ab"}, {"bytes 24-25/26", "yz"}} {
+		part, err := r.NextPart()
+		c.Assert(err, gocheck.IsNil)
+		c.Check(part.Header.Get("Content-Type"), gocheck.Equals, "text/plain; charset=utf-8")
+		c.Check(part.Header.Get("Content-Range"), gocheck.Equals, want.contentRange)
+		data, _ := ioutil.ReadAll(part)
+		c.Check(string(data), gocheck.Equals, want.data)
+	}
+	_, err = r.NextPart()
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *FileServerSuite) TestLargeFileStreamed(c *gocheck.C) {
+	s.server.StreamSize = 10
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	resp := s.server.ServeRequest(fileRequest("GET", "/letters.txt", nil))
+	c.Check(resp.Stream, gocheck.Equals, true)
+	c.Assert(handler.WriteMessage(resp), gocheck.IsNil)
+
+	//the head and the body go in separate messages
+	c.Check(len(transport.sent), gocheck.Equals, 2)
+	_, _, head, _ := DecodeResponse(<-transport.sent)
+	c.Check(string(head), gocheck.Matches, "(?s)HTTP/1.1 200 OK\r\nContent-Length: 26\r\n.*\r\n\r\n")
+	_, _, data, _ := DecodeResponse(<-transport.sent)
+	c.Check(string(data), gocheck.Equals, alphabet)
+	handler.Shutdown(context.Background())
+}
@@ -0,0 +1,305 @@
+package mongrel2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+)
+
+//DefaultMaxFormSize is the most that PostForm will read of a urlencoded body.
+const DefaultMaxFormSize = 10 << 20
+
+//DefaultMaxValueSize is the MaxValueSize of a FormReader that doesn't set one.
+const DefaultMaxValueSize = 10 << 20
+
+var (
+	//ErrFormTooLarge is returned when a form is bigger than the limits set for it.
+	ErrFormTooLarge = errors.New("mongrel2: form too large")
+	//ErrNotMultipart is returned by MultipartReader for a request whose body is not
+	//multipart/form-data.
+	ErrNotMultipart = errors.New("mongrel2: request is not multipart/form-data")
+)
+
+//QueryValues returns the parameters in the query string of the request, which
+//mongrel2 sends as QUERY.  Parameters that can't be decoded are left out.
+func (self *HttpRequest) QueryValues() url.Values {
+	if self.query == nil {
+		self.query, _ = url.ParseQuery(self.Query)
+	}
+	return self.query
+}
+
+//PostForm returns the values in an application/x-www-form-urlencoded body, which may
+//be in mongrel2's upload file if it was large (see BodyReader).  For any other
+//content type the result is empty.  A body of more than DefaultMaxFormSize bytes is
+//ErrFormTooLarge.
+func (self *HttpRequest) PostForm() (url.Values, error) {
+	if self.form != nil {
+		return self.form, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(self.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		self.form = make(url.Values)
+		return self.form, nil
+	}
+
+	body, err := self.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, DefaultMaxFormSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > DefaultMaxFormSize {
+		return nil, ErrFormTooLarge
+	}
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	self.form = form
+	return form, nil
+}
+
+//FormValue returns the first value for key in the urlencoded body, or if it isn't
+//there, in the query string, like net/http's FormValue.  Errors reading the body
+//are ignored.
+func (self *HttpRequest) FormValue(key string) string {
+	if form, err := self.PostForm(); err == nil {
+		if values, ok := form[key]; ok && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return self.QueryValues().Get(key)
+}
+
+//FormReader reads a multipart/form-data body a part at a time, so that files can be
+//dealt with without holding them in memory.  If MaxPartSize is more than zero, reading
+//more than that from a part is ErrFormTooLarge, and the same goes for MaxSize and
+//the body as a whole.  MaxValueSize (DefaultMaxValueSize if it is zero) bounds the
+//values that aren't files read by ReadForm.  The body is read from mongrel2's upload
+//file if it was too big to send in the message, so Close should be called when done
+//with it.
+type FormReader struct {
+	MaxPartSize  int64
+	MaxSize      int64
+	MaxValueSize int64
+
+	body   io.ReadCloser
+	reader *multipart.Reader
+	read   int64
+}
+
+//FormPart is a part of a multipart form, read through the limits of its FormReader.
+type FormPart struct {
+	*multipart.Part
+
+	form *FormReader
+	read int64
+}
+
+//MultipartReader returns a FormReader for the body of a multipart/form-data request,
+//or ErrNotMultipart if the request is something else.
+func (self *HttpRequest) MultipartReader() (*FormReader, error) {
+	mediaType, params, err := mime.ParseMediaType(self.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ErrNotMultipart
+	}
+	body, err := self.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+	result := &FormReader{body: body}
+	result.reader = multipart.NewReader(formBody{result}, params["boundary"])
+	return result, nil
+}
+
+//formBody is the body of a FormReader, as seen by its multipart.Reader: reading past
+//MaxSize is an error.
+type formBody struct {
+	form *FormReader
+}
+
+func (self formBody) Read(p []byte) (int, error) {
+	n, err := self.form.body.Read(p)
+	self.form.read += int64(n)
+	if self.form.tooLarge() {
+		return n, ErrFormTooLarge
+	}
+	return n, err
+}
+
+func (self *FormReader) tooLarge() bool {
+	return self.MaxSize > 0 && self.read > self.MaxSize
+}
+
+//NextPart returns the next part of the form, or io.EOF after the last one.
+func (self *FormReader) NextPart() (*FormPart, error) {
+	part, err := self.reader.NextPart()
+	if err != nil {
+		if self.tooLarge() {
+			err = ErrFormTooLarge
+		}
+		return nil, err
+	}
+	return &FormPart{Part: part, form: self}, nil
+}
+
+//Close closes the body.
+func (self *FormReader) Close() error {
+	return self.body.Close()
+}
+
+func (self *FormPart) Read(p []byte) (int, error) {
+	n, err := self.Part.Read(p)
+	self.read += int64(n)
+	if self.form.tooLarge() || (self.form.MaxPartSize > 0 && self.read > self.form.MaxPartSize) {
+		return n, ErrFormTooLarge
+	}
+	return n, err
+}
+
+//MultipartForm is a whole multipart form, as read by ReadForm.
+type MultipartForm struct {
+	Value url.Values
+	File  map[string][]*FormFile
+}
+
+//FormFile is a file from a multipart form.  It is kept in memory if it is small and
+//in a temporary file otherwise.
+type FormFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+
+	data []byte
+	path string
+}
+
+//ReadForm reads the rest of the form, keeping up to memory bytes of it in memory
+//in all, like net/http's ParseMultipartForm.  The values that aren't files are
+//always kept in memory, and take their size off what is left for files.  Each file
+//that fits in what is left is kept in memory too, and the others are written to
+//temporary files in dir (os.TempDir() if it is empty), which RemoveAll deletes.
+//The values together may use MaxValueSize bytes more than memory; beyond that, as
+//when the limits of the FormReader are exceeded, the result is ErrFormTooLarge.  If
+//anything goes wrong, no temporary files are left behind.
+func (self *FormReader) ReadForm(memory int64, dir string) (*MultipartForm, error) {
+	result := &MultipartForm{Value: make(url.Values), File: make(map[string][]*FormFile)}
+	budget := &formBudget{memory: memory, values: memory + self.MaxValueSize}
+	if self.MaxValueSize == 0 {
+		budget.values = memory + DefaultMaxValueSize
+	}
+	for {
+		part, err := self.NextPart()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err == nil {
+			err = result.add(part, budget, dir)
+		}
+		if err != nil {
+			result.RemoveAll()
+			return nil, err
+		}
+	}
+}
+
+//formBudget is what ReadForm has left to spend: memory for all the parts it keeps in
+//memory and values for the values that aren't files.
+type formBudget struct {
+	memory, values int64
+}
+
+//add reads part into the form, taking what it keeps in memory off budget.
+func (self *MultipartForm) add(part *FormPart, budget *formBudget, dir string) error {
+	name := part.FormName()
+	if name == "" {
+		return nil
+	}
+	if part.FileName() == "" {
+		data, err := ioutil.ReadAll(io.LimitReader(part, budget.values+1))
+		if err != nil {
+			return err
+		}
+		budget.values -= int64(len(data))
+		if budget.values < 0 {
+			return ErrFormTooLarge
+		}
+		budget.memory -= int64(len(data))
+		self.Value.Add(name, string(data))
+		return nil
+	}
+
+	file := &FormFile{Filename: part.FileName(), Header: part.Header}
+	memory := budget.memory
+	if memory < 0 {
+		memory = 0
+	}
+	buffer := new(bytes.Buffer)
+	n, err := io.CopyN(buffer, part, memory+1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n <= memory {
+		file.data = buffer.Bytes()
+		file.Size = n
+		budget.memory -= n
+		budget.values -= n
+	} else {
+		//too big to keep, so it goes to disk
+		tmp, err := ioutil.TempFile(dir, "mongrel2-form-")
+		if err != nil {
+			return err
+		}
+		file.path = tmp.Name()
+		file.Size, err = io.Copy(tmp, io.MultiReader(buffer, part))
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file.path)
+			return err
+		}
+	}
+	self.File[name] = append(self.File[name], file)
+	return nil
+}
+
+//Open returns a reader for the contents of the file.
+func (self *FormFile) Open() (io.ReadCloser, error) {
+	if self.path == "" {
+		return ioutil.NopCloser(bytes.NewReader(self.data)), nil
+	}
+	return os.Open(self.path)
+}
+
+//TempPath is the name of the temporary file the file was written to, or "" if it is
+//kept in memory.
+func (self *FormFile) TempPath() string {
+	return self.path
+}
+
+//RemoveAll deletes the temporary files of the form.
+func (self *MultipartForm) RemoveAll() error {
+	var result error
+	for _, files := range self.File {
+		for _, f := range files {
+			if f.path == "" {
+				continue
+			}
+			if err := os.Remove(f.path); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
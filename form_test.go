@@ -0,0 +1,215 @@
+package mongrel2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type FormSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&FormSuite{})
+
+func formRequest(contentType, body string) *HttpRequest {
+	req := routerRequest("POST", "/", "/")
+	req.Header = make(Header)
+	req.Header.Set("Content-Type", contentType)
+	req.Body = []byte(body)
+	return req
+}
+
+//multipartBody makes a form with a field and two files, one small and one big.
+func multipartBody(c *gocheck.C) (string, string) {
+	buffer := new(bytes.Buffer)
+	w := multipart.NewWriter(buffer)
+	c.Assert(w.WriteField("title", "holiday"), gocheck.IsNil)
+	f, err := w.CreateFormFile("photo", "small.txt")
+	c.Assert(err, gocheck.IsNil)
+	f.Write([]byte("tiny"))
+	f, err = w.CreateFormFile("photo", "big.txt")
+	c.Assert(err, gocheck.IsNil)
+	f.Write([]byte(strings.Repeat("x", 1000)))
+	c.Assert(w.Close(), gocheck.IsNil)
+	return w.FormDataContentType(), buffer.String()
+}
+
+func (s *FormSuite) TestQueryAndUrlencoded(c *gocheck.C) {
+	req := formRequest("application/x-www-form-urlencoded; charset=utf-8", "a=1&b=two+words&a=3")
+	req.Query = "a=query&c=%2Fx"
+	c.Check(req.QueryValues()["a"], gocheck.DeepEquals, []string{"query"})
+	form, err := req.PostForm()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(form["a"], gocheck.DeepEquals, []string{"1", "3"})
+	c.Check(req.FormValue("a"), gocheck.Equals, "1")
+	c.Check(req.FormValue("b"), gocheck.Equals, "two words")
+	c.Check(req.FormValue("c"), gocheck.Equals, "/x")
+	c.Check(req.FormValue("d"), gocheck.Equals, "")
+
+	req = formRequest("text/plain", "a=1")
+	form, err = req.PostForm()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(form, gocheck.HasLen, 0)
+
+	req = formRequest("application/x-www-form-urlencoded", strings.Repeat("a", DefaultMaxFormSize+1))
+	_, err = req.PostForm()
+	c.Check(err, gocheck.Equals, ErrFormTooLarge)
+}
+
+func (s *FormSuite) TestReadForm(c *gocheck.C) {
+	contentType, body := multipartBody(c)
+	r, err := formRequest(contentType, body).MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	defer r.Close()
+	dir := c.MkDir()
+	form, err := r.ReadForm(100, dir)
+	c.Assert(err, gocheck.IsNil)
+
+	c.Check(form.Value["title"], gocheck.DeepEquals, []string{"holiday"})
+	files := form.File["photo"]
+	c.Assert(files, gocheck.HasLen, 2)
+	c.Check(files[0].Filename, gocheck.Equals, "small.txt")
+	c.Check(files[0].Size, gocheck.Equals, int64(4))
+	c.Check(files[0].TempPath(), gocheck.Equals, "")
+	c.Check(files[1].Size, gocheck.Equals, int64(1000))
+	c.Check(filepath.Dir(files[1].TempPath()), gocheck.Equals, dir)
+	f, err := files[1].Open()
+	c.Assert(err, gocheck.IsNil)
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	c.Check(string(data), gocheck.Equals, strings.Repeat("x", 1000))
+
+	c.Assert(form.RemoveAll(), gocheck.IsNil)
+	_, err = os.Stat(files[1].TempPath())
+	c.Check(os.IsNotExist(err), gocheck.Equals, true)
+}
+
+func (s *FormSuite) TestLimits(c *gocheck.C) {
+	contentType, body := multipartBody(c)
+	req := formRequest(contentType, body)
+
+	r, err := req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	r.MaxPartSize = 500
+	dir := c.MkDir()
+	_, err = r.ReadForm(2, dir)
+	c.Check(err, gocheck.Equals, ErrFormTooLarge)
+	//the small file had already gone to disk, but it has been cleaned up
+	left, _ := ioutil.ReadDir(dir)
+	c.Check(left, gocheck.HasLen, 0)
+
+	r, err = req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	r.MaxSize = 600
+	_, err = r.ReadForm(1<<20, "")
+	c.Check(err, gocheck.Equals, ErrFormTooLarge)
+
+	_, err = formRequest("application/json", "{}").MultipartReader()
+	c.Check(err, gocheck.Equals, ErrNotMultipart)
+}
+
+//fieldsBody makes a form of the fields and files given, in order; names that start
+//with "file" are files.
+func fieldsBody(c *gocheck.C, fields ...string) *HttpRequest {
+	buffer := new(bytes.Buffer)
+	w := multipart.NewWriter(buffer)
+	for i := 0; i < len(fields); i += 2 {
+		if strings.HasPrefix(fields[i], "file") {
+			f, err := w.CreateFormFile(fields[i], fields[i]+".txt")
+			c.Assert(err, gocheck.IsNil)
+			f.Write([]byte(fields[i+1]))
+		} else {
+			c.Assert(w.WriteField(fields[i], fields[i+1]), gocheck.IsNil)
+		}
+	}
+	c.Assert(w.Close(), gocheck.IsNil)
+	return formRequest(w.FormDataContentType(), buffer.String())
+}
+
+func (s *FormSuite) TestMemoryBudget(c *gocheck.C) {
+	dir := c.MkDir()
+	sixty := strings.Repeat("x", 60)
+	for _, fields := range [][]string{
+		{"file1", sixty, "file2", sixty},
+		{"title", strings.Repeat("t", 50), "file2", sixty},
+	} {
+		r, err := fieldsBody(c, fields...).MultipartReader()
+		c.Assert(err, gocheck.IsNil)
+		form, err := r.ReadForm(100, dir)
+		c.Assert(err, gocheck.IsNil)
+		//what came first used up the memory, so the second file went to disk
+		if files, ok := form.File["file1"]; ok {
+			c.Check(files[0].TempPath(), gocheck.Equals, "")
+		}
+		c.Assert(form.File["file2"], gocheck.HasLen, 1)
+		c.Check(form.File["file2"][0].TempPath(), gocheck.Not(gocheck.Equals), "")
+		c.Check(form.File["file2"][0].Size, gocheck.Equals, int64(60))
+		c.Assert(form.RemoveAll(), gocheck.IsNil)
+	}
+}
+
+func (s *FormSuite) TestValueLimit(c *gocheck.C) {
+	req := fieldsBody(c, "a", "holiday", "b", strings.Repeat("v", 20))
+	r, err := req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	r.MaxValueSize = 30
+	form, err := r.ReadForm(0, "")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(form.Value["a"], gocheck.DeepEquals, []string{"holiday"})
+
+	//the values together are over the limit, even with nothing else set
+	r, err = req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	r.MaxValueSize = 20
+	_, err = r.ReadForm(0, "")
+	c.Check(err, gocheck.Equals, ErrFormTooLarge)
+
+	//memory left over from the files can be used by the values
+	r, err = req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	r.MaxValueSize = 20
+	_, err = r.ReadForm(10, "")
+	c.Check(err, gocheck.IsNil)
+}
+
+func (s *FormSuite) TestStreamingParts(c *gocheck.C) {
+	contentType, body := multipartBody(c)
+	r, err := formRequest(contentType, body).MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	var names []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		names = append(names, part.FormName()+":"+part.FileName())
+	}
+	c.Check(names, gocheck.DeepEquals, []string{"title:", "photo:small.txt", "photo:big.txt"})
+}
+
+func (s *FormSuite) TestFromUpload(c *gocheck.C) {
+	contentType, body := multipartBody(c)
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "upload.XXXXXX"), []byte(body), 0600), gocheck.IsNil)
+	//mongrel2 sends the body of a large request in a file instead of the message
+	req := formRequest(contentType, "")
+	req.Body = nil
+	req.Upload = &Upload{Path: "/tmp/upload.XXXXXX", Done: true, dir: dir}
+
+	r, err := req.MultipartReader()
+	c.Assert(err, gocheck.IsNil)
+	form, err := r.ReadForm(1<<20, "")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(r.Close(), gocheck.IsNil)
+	c.Check(form.Value.Get("title"), gocheck.Equals, "holiday")
+	c.Check(form.File["photo"], gocheck.HasLen, 2)
+
+	req.Upload.Done = false
+	_, err = req.MultipartReader()
+	c.Check(err, gocheck.Equals, ErrUploadNotDone)
+}
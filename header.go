@@ -0,0 +1,141 @@
+package mongrel2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+//Header holds the HTTP headers of a request.  It has the same semantics, and the
+//same underlying type, as net/http.Header: keys are case insensitive (they are
+//stored in canonical form, so "x-forwarded-for" becomes "X-Forwarded-For") and
+//each key may have several values, in the order the client sent them.  A Header
+//can be converted to an http.Header with a simple type conversion.
+type Header map[string][]string
+
+//Add adds the value to key, keeping any values that are already there.
+func (self Header) Add(key, value string) {
+	textproto.MIMEHeader(self).Add(key, value)
+}
+
+//Set replaces any values of key with the single value supplied.
+func (self Header) Set(key, value string) {
+	textproto.MIMEHeader(self).Set(key, value)
+}
+
+//Get returns the first value of key, or "" if there are none.
+func (self Header) Get(key string) string {
+	return textproto.MIMEHeader(self).Get(key)
+}
+
+//Values returns all the values of key.  The returned slice is not a copy.
+func (self Header) Values(key string) []string {
+	return textproto.MIMEHeader(self).Values(key)
+}
+
+//Del removes all the values of key.
+func (self Header) Del(key string) {
+	textproto.MIMEHeader(self).Del(key)
+}
+
+//Clone returns a copy of the header that shares nothing with the original.
+func (self Header) Clone() Header {
+	if self == nil {
+		return nil
+	}
+	result := make(Header, len(self))
+	for k, v := range self {
+		result[k] = append([]string(nil), v...)
+	}
+	return result
+}
+
+//headerHasToken reports whether the comma separated header value contains token,
+//ignoring case, as in "Connection: keep-alive, Upgrade".
+func headerHasToken(value, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+//isMetaKey reports whether k is one of the keys mongrel2 adds to the header block
+//itself, rather than a header from the client.  Mongrel2 lower cases all client
+//headers and uses upper case (METHOD, PATH, URL_SCHEME...) for its own.
+func isMetaKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !(c >= 'A' && c <= 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+//decodeJsonHeader decodes the JSON header block.  Repeated headers are sent by
+//mongrel2 as an array of strings.
+func decodeJsonHeader(block []byte) (map[string][]string, error) {
+	result := make(map[string][]string)
+	if len(block) == 0 {
+		return result, nil
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(block, &raw); err != nil {
+		return nil, err
+	}
+	for k, v := range raw {
+		values, err := headerValues(k, v)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = values
+	}
+	return result, nil
+}
+
+//decodeTnetHeader decodes the tnetstring dict sent by mongrel2 in place of the
+//JSON header block.  Repeated headers are sent as a list.
+func decodeTnetHeader(block []byte) (map[string][]string, error) {
+	dict, err := decodeTnetDict(block)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string, len(dict))
+	for k, v := range dict {
+		values, err := headerValues(k, v)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = values
+	}
+	return result, nil
+}
+
+//headerValues flattens a single decoded header value, which may be a scalar or a
+//list of scalars, into strings.
+func headerValues(k string, v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		switch x := item.(type) {
+		case string:
+			result = append(result, x)
+		case nil:
+			result = append(result, "")
+		case bool, int64, float64:
+			result = append(result, fmt.Sprint(x))
+		default:
+			return nil, fmt.Errorf("header %s has unexpected type %T", k, item)
+		}
+	}
+	return result, nil
+}
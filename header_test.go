@@ -0,0 +1,77 @@
+package mongrel2
+
+import (
+	"launchpad.net/gocheck"
+	"net/http"
+)
+
+type HeaderSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&HeaderSuite{})
+
+var (
+	MULTI_SAMPLE      = `0de9b17e-e958-4502-8de9-b17ee958d502 12 /app 180:{"PATH":"/app","METHOD":"GET","VERSION":"HTTP/1.1","URI":"/app?a=1","QUERY":"a=1","PATTERN":"/app","cookie":["a=1","b=2"],"x-forwarded-for":"10.0.0.1","accept":["text/html","*/*"]},0:,`
+	TNET_MULTI_SAMPLE = `0de9b17e-e958-4502-8de9-b17ee958d502 12 /app 40:6:cookie,12:3:a=1,3:b=2,]6:METHOD,3:GET,}0:,`
+)
+
+func (s *HeaderSuite) TestHeaderIsCaseInsensitive(c *gocheck.C) {
+	h := make(Header)
+	h.Add("x-forwarded-for", "10.0.0.1")
+	h.Add("X-FORWARDED-FOR", "10.0.0.2")
+	c.Check(h.Get("X-Forwarded-For"), gocheck.Equals, "10.0.0.1")
+	c.Check(h.Values("x-forwarded-for"), gocheck.DeepEquals, []string{"10.0.0.1", "10.0.0.2"})
+	c.Check(http.Header(h).Get("x-forwarded-for"), gocheck.Equals, "10.0.0.1")
+
+	h.Set("x-forwarded-for", "10.0.0.3")
+	c.Check(h.Values("X-Forwarded-For"), gocheck.DeepEquals, []string{"10.0.0.3"})
+	h.Del("X-forwarded-For")
+	c.Check(h.Get("x-forwarded-for"), gocheck.Equals, "")
+}
+
+func (s *HeaderSuite) TestDecodeRepeatedJsonHeaders(c *gocheck.C) {
+	p, err := DecodePayload([]byte(MULTI_SAMPLE))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(p.Header.Values("Cookie"), gocheck.DeepEquals, []string{"a=1", "b=2"})
+	c.Check(p.Header.Values("Accept"), gocheck.DeepEquals, []string{"text/html", "*/*"})
+	c.Check(p.Header.Get("X-Forwarded-For"), gocheck.Equals, "10.0.0.1")
+	c.Check(p.Header.Get("Method"), gocheck.Equals, "")
+	c.Check(p.Meta["METHOD"], gocheck.Equals, "GET")
+	c.Check(p.Meta["QUERY"], gocheck.Equals, "a=1")
+}
+
+func (s *HeaderSuite) TestDecodeRepeatedTnetHeaders(c *gocheck.C) {
+	p, err := DecodePayload([]byte(TNET_MULTI_SAMPLE))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(p.Header.Values("cookie"), gocheck.DeepEquals, []string{"a=1", "b=2"})
+	c.Check(p.Meta["METHOD"], gocheck.Equals, "GET")
+}
+
+func (s *HeaderSuite) TestDecodePayloadStartJoinsValues(c *gocheck.C) {
+	_, _, _, header, _, _, err := DecodePayloadStart([]byte(MULTI_SAMPLE))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(header["cookie"], gocheck.Equals, "a=1, b=2")
+	c.Check(header["URI"], gocheck.Equals, "/app?a=1")
+}
+
+func (s *HeaderSuite) TestKeepAlive(c *gocheck.C) {
+	for _, t := range []struct {
+		version, connection string
+		keepAlive           bool
+	}{
+		{"HTTP/1.1", "", true},
+		{"HTTP/1.1", "Close", false},
+		{"HTTP/1.0", "", false},
+		{"HTTP/1.0", "Keep-Alive", true},
+		{"HTTP/1.0", "keep-alive, Upgrade", true},
+	} {
+		req := &HttpRequest{Version: t.version, Header: make(Header)}
+		if t.connection != "" {
+			req.Header.Set("connection", t.connection)
+		}
+		c.Check(req.KeepAlive(), gocheck.Equals, t.keepAlive, gocheck.Commentf("%v", t))
+		resp := NewHttpResponse(req)
+		c.Check(resp.CloseAfter, gocheck.Equals, !t.keepAlive)
+	}
+}
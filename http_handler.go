@@ -2,10 +2,14 @@ package mongrel2
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/alecthomas/gozmq"
 	"io"
-	//"os"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 )
 
 //HttpHandler is an interface that allows communication with the mongrel2 for serving
@@ -14,7 +18,8 @@ import (
 //with the channels supplied to it at the ReadLoop() and WriteLoop() methods; this
 //object deals ONLY with sockets.  Anyone using ReadLoop() or WriteLoop() should close
 //the channels themselves AND close the ZMQ context so that any goroutines blocked
-//on a read of a socket will get ETERM and die.
+//on a read of a socket will get ETERM and die.  RunReadLoop() and RunWriteLoop() are
+//stopped with a context.Context or Shutdown() instead.
 type HttpHandler interface {
 	ReadMessage() (*HttpRequest, error)
 	WriteMessage(*HttpResponse) error
@@ -22,7 +27,12 @@ type HttpHandler interface {
 
 //HttpRequest structs are the "raw" information sent to the handler by the Mongrel2 server.
 //The primary fields of the mongrel2 protocol are broken out in this struct and the
-//headers (supplied by the client, passed through by Mongrel2) are included as a map.
+//headers (supplied by the client, passed through by Mongrel2) are included as a Header,
+//which keeps every value of a repeated header.  The keys that mongrel2 adds to the
+//headers itself are not in Header; the common ones are broken out into the Method,
+//URI, Query, Version and Pattern fields and all of them are in Meta.  A body that
+//was too big for mongrel2 to send in the message is described by Upload instead.
+//Params holds the parts of the path matched by the pattern of a Router's route.
 //The RawRequest slice is the byte slice that holds all the data.  The Body byte slice
 //points to the same underlying storage.  The other fields, for convenience have been
 //parsed and _copied_ out of the RawRequest byte slice.
@@ -33,7 +43,30 @@ type HttpRequest struct {
 	ClientId   int
 	BodySize   int
 	Path       string
-	Header     map[string]string
+	Method     string
+	URI        string
+	Query      string
+	Version    string
+	Pattern    string
+	Meta       map[string]string
+	Header     Header
+	Upload     *Upload
+	Params     map[string]string
+
+	ctx context.Context
+
+	//the query string and urlencoded body, once parsed by QueryValues and PostForm
+	query url.Values
+	form  url.Values
+}
+
+//Context returns the context of the client connection the request arrived on.  It
+//is cancelled when the client disconnects.
+func (self *HttpRequest) Context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
 }
 
 //HttpResponse structss are sent back to Mongrel2 servers. The Mongrel2 server you wish
@@ -42,7 +75,13 @@ type HttpRequest struct {
 //can target up to 128 clients with a single HttpResponse struct.  The other fields are
 //passed through at the HTTP level to the client or clients.  The easiest way
 //to correctly target a HttpResponse is by looking at the values supplied in a Request
-//struct.
+//struct, or by using NewHttpResponse.  Setting Stream sends the body in pieces as it
+//is read, rather than buffering all of it; if ContentLength is not known in advance
+//(zero or less) a streamed body is sent with chunked transfer encoding, or for an
+//HTTP/1.0 client, which can't decode that, ended by closing the connection.  Version
+//is the HTTP version of the request being answered.  Setting CloseAfter closes the
+//client connections once the response has been sent and tells the clients so with
+//a Connection: close header.
 type HttpResponse struct {
 	ServerId      string
 	ClientId      []int
@@ -52,31 +91,89 @@ type HttpResponse struct {
 	StatusMsg     string
 	Header        map[string]string
 	Stream        bool
+	CloseAfter    bool
+	Version       string
+}
+
+//NewHttpResponse returns a 200 response addressed to the client that sent req.  If the
+//client does not want its connection kept open (see KeepAlive) CloseAfter is set, and
+//an HTTP/1.0 client that asked for keep-alive is told that it has it.
+func NewHttpResponse(req *HttpRequest) *HttpResponse {
+	result := new(HttpResponse)
+	result.ServerId = req.ServerId
+	result.ClientId = []int{req.ClientId}
+	result.StatusCode = http.StatusOK
+	result.Version = req.Version
+	result.Header = make(map[string]string)
+	if !req.KeepAlive() {
+		result.CloseAfter = true
+	} else if req.Version == "HTTP/1.0" {
+		result.Header["Connection"] = "keep-alive"
+	}
+	return result
+}
+
+//plainResponse returns a response to req with the status code and a plain text body,
+//the standard reason phrase if body is empty.
+func plainResponse(req *HttpRequest, code int, body string) *HttpResponse {
+	if body == "" {
+		body = http.StatusText(code) + "\n"
+	}
+	result := NewHttpResponse(req)
+	result.StatusCode = code
+	result.Header["Content-Type"] = "text/plain; charset=utf-8"
+	result.Body = ioutil.NopCloser(strings.NewReader(body))
+	result.ContentLength = int64(len(body))
+	return result
+}
+
+//KeepAlive reports whether the client that sent the request expects the connection
+//to stay open after the response.  HTTP/1.1 clients do unless they send Connection:
+//close; HTTP/1.0 clients only do if they send Connection: keep-alive.
+func (self *HttpRequest) KeepAlive() bool {
+	connection := self.Header.Get("Connection")
+	if self.Version == "HTTP/1.0" {
+		return headerHasToken(connection, "keep-alive")
+	}
+	return !headerHasToken(connection, "close")
 }
 
 //HttpHandlerDefault is a basic implementation of the HttpHandler that knows about channels.
-//You can use the ReadLoop() and WriteLoop() to launch goroutines that interact correctly
-//with the channels, although it never closes them.
+//You can use the ReadLoop() and WriteLoop(), or better RunReadLoop() and RunWriteLoop(),
+//to launch goroutines that interact correctly with the channels, although it never
+//closes them.  UploadDir is the directory, as the handler sees it, where mongrel2
+//writes the temporary files for large uploads; it must be set for the bodies of
+//uploads to be read, since only files in that directory are trusted.  MaxServing
+//limits how many requests Serve runs at once.
 type HttpHandlerDefault struct {
 	*RawHandlerDefault
+	UploadDir  string
+	MaxServing int
 }
 
 // ReadLoop is a loop that reads mongrel2 message until it gets an error.  This useful if
 // you want to launch a goroutine that reads forever from mongrel2 and makes the read
-// messages available on the supplied channel.
+// messages available on the supplied channel.  Messages that can't be decoded are
+// skipped; any other error is written to stderr and ends the loop.  Use RunReadLoop
+// to get the error back instead.
 func (self *HttpHandlerDefault) ReadLoop(in chan *HttpRequest) {
 	for {
 		r, err := self.ReadMessage()
 		if err != nil {
-			//e := err.(gozmq.ZmqErrno)
-			if err == gozmq.ETERM {
+			if terminated(err) {
 				//fmt.Printf("HTTP socket ignoring ETERM in read, signaling higher level and assuming shutdown...%p\n",self)
-				self.InSocket.Close()
+				self.Transport.CloseRecv()
 				//concurrency claim: we DONT want to close the in channel because the ETERM will happen only
 				//at the end of shutdown processing and thus the in channel is already closed...
 				return
 			}
-			panic(err)
+			if _, ok := err.(*ProtocolError); ok {
+				//one bad message from the server shouldn't take the handler down
+				fmt.Fprintf(os.Stderr, "HTTP socket skipping bad message: %s\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "HTTP socket stopping read loop: %s\n", err)
+			return
 		}
 		select {
 		case x, ok := <-in:
@@ -92,56 +189,167 @@ func (self *HttpHandlerDefault) ReadLoop(in chan *HttpRequest) {
 // WriteLoop is a loop that sends mongrel two message until it gets an error
 // or a message to close.  This is useful when you want to launch a goroutine
 //that runs forever just taking messages from the out channel supplied and pushing them
-//to mongrel2.
+//to mongrel2.  An error sending is written to stderr and ends the loop; RunWriteLoop
+//returns it instead.
 func (self *HttpHandlerDefault) WriteLoop(out chan *HttpResponse) {
 	for {
 		//coming from higher layer to us
 		m := <-out
 		if m == nil {
 			//fmt.Printf("HTTP socket read nil in write loop, assuming shutdown...%p\n",self)
-			self.OutSocket.Close()
+			self.Transport.CloseSend()
 			return //end of goroutine b/c of shutdown
 		}
 
 		err := self.WriteMessage(m)
 		if err != nil {
-			//e := err.(gozmq.ZmqErrno)
-			if err == gozmq.ETERM {
+			if terminated(err) {
 				//fmt.Printf("HTTP socket ignoring ETERM in write loop, assuming shutdown of %p...\n",self)
-				self.OutSocket.Close()
+				self.Transport.CloseSend()
 				return
 			}
-			panic(err)
+			fmt.Fprintf(os.Stderr, "HTTP socket stopping write loop: %s\n", err)
+			return
 		}
 	}
 
 }
 
+//RunReadLoop reads requests from mongrel2 and sends them on in until ctx is cancelled
+//or Shutdown is called, when it closes the receiving side of the transport and returns
+//nil.  Messages that can't be decoded are logged and skipped; any other error
+//reading ends the loop and is returned.  Unlike ReadLoop it doesn't need the ZMQ context to be closed to stop.
+func (self *HttpHandlerDefault) RunReadLoop(ctx context.Context, in chan<- *HttpRequest) error {
+	return self.runReadLoop(ctx, "HTTP", func() (interface{}, error) {
+		return self.ReadMessage()
+	}, httpRequests(in))
+}
+
+//RunWriteLoop sends the responses from out to mongrel2 until out is closed, ctx is
+//cancelled or Shutdown is called.  Once ctx is cancelled it goes on sending the
+//responses already queued on out for up to the handler's Linger; under Shutdown it
+//has until Shutdown's deadline.  Unless it was stopped by Shutdown, which does it
+//itself, it then closes the sending side of the transport.  The result is nil, an
+//*UndeliveredError if responses were left on out, or the error from sending one.
+func (self *HttpHandlerDefault) RunWriteLoop(ctx context.Context, out <-chan *HttpResponse) error {
+	return self.runWriteLoop(ctx, self.writeQueued, httpResponses(out))
+}
+
+//writeQueued sends a response taken from the channel of a write loop.
+func (self *HttpHandlerDefault) writeQueued(msg interface{}) error {
+	return self.WriteMessage(msg.(*HttpResponse))
+}
+
+//Run runs RunReadLoop and RunWriteLoop together, stopping the write loop, after it has
+//sent what is queued, once reading stops, and returns when they have both finished
+//with the first error either of them had.
+func (self *HttpHandlerDefault) Run(ctx context.Context, in chan<- *HttpRequest, out <-chan *HttpResponse) error {
+	return runLoops(ctx, func(ctx context.Context) error {
+		return self.RunReadLoop(ctx, in)
+	}, func(ctx context.Context) error {
+		return self.RunWriteLoop(ctx, out)
+	})
+}
+
+//httpRequests is the requestQueue of an HTTP read loop.
+type httpRequests chan<- *HttpRequest
+
+func (self httpRequests) put(ctx context.Context, stop <-chan struct{}, msg interface{}) bool {
+	select {
+	case self <- msg.(*HttpRequest):
+		return true
+	case <-ctx.Done():
+	case <-stop:
+	}
+	return false
+}
+
+//httpResponses is the responseQueue of an HTTP write loop.
+type httpResponses <-chan *HttpResponse
+
+func (self httpResponses) take(ctx context.Context, stop <-chan struct{}) (interface{}, bool) {
+	select {
+	case m, ok := <-self:
+		return m, ok
+	case <-ctx.Done():
+	case <-stop:
+	}
+	return nil, true
+}
+
+func (self httpResponses) poll() (interface{}, bool) {
+	select {
+	case m, ok := <-self:
+		return m, ok
+	default:
+	}
+	return nil, true
+}
+
+func (self httpResponses) queued() int {
+	return len(self)
+}
+
 //ReadMessage creates a new Request struct based on the values sent from a Mongrel2
 //instance. This call blocks until it receives a Request.  Note that you can have
 //several different goroutines all waiting on messages from the same server and they
 // will be delivered in a round-robin fashion.  This call tries to be efficient and look
 //at each byte only when necessary.  The body of the request is not examined by
-//this method.
+//this method.  A message that can't be decoded is reported as a *ProtocolError.
+//Mongrel2's notices that clients have gone away are not returned; they are passed
+//to OnDisconnect and the call goes on waiting for a request.
 func (self *HttpHandlerDefault) ReadMessage() (*HttpRequest, error) {
+	var result *HttpRequest
+	for {
+		req, err := self.Transport.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = decodeHttpRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		if !isDisconnect(result.Method, result.Body) {
+			break
+		}
+		self.disconnected(result.ServerId, result.ClientId)
+	}
+	if result.Upload != nil {
+		result.Upload.dir = self.UploadDir
+	}
+	result.ctx = self.ClientContext(result.ServerId, result.ClientId)
+	return result, nil
+}
 
-	req, err := self.InSocket.Recv(0)
+//decodeHttpRequest builds an HttpRequest from a message received from mongrel2.
+func decodeHttpRequest(req []byte) (*HttpRequest, error) {
+	payload, err := DecodePayload(req)
 	if err != nil {
 		return nil, err
 	}
 
-	serverId, clientId, path, jsonMap, bodyStart, bodySize, err := DecodePayloadStart(req)
-
 	result := new(HttpRequest)
 	result.RawRequest = req
-	result.Path = path
-	result.BodySize = bodySize
-	result.ServerId = serverId
-	result.ClientId = clientId
-	result.Header = jsonMap
+	result.Path = payload.Path
+	result.BodySize = payload.BodySize
+	result.ServerId = payload.ServerId
+	result.ClientId = payload.ClientId
+	result.Header = payload.Header
+	result.Meta = payload.Meta
+	result.Method = payload.Meta["METHOD"]
+	result.URI = payload.Meta["URI"]
+	result.Query = payload.Meta["QUERY"]
+	result.Version = payload.Meta["VERSION"]
+	result.Pattern = payload.Meta["PATTERN"]
 
-	if bodySize > 0 {
-		result.Body = req[bodyStart : bodyStart+bodySize]
+	if payload.BodySize > 0 {
+		result.Body = req[payload.BodyStart : payload.BodyStart+payload.BodySize]
+	}
+
+	result.Upload, err = decodeUpload(result.Header)
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
@@ -152,36 +360,67 @@ func (self *HttpHandlerDefault) ReadMessage() (*HttpRequest, error) {
 //(ServerId) and one or more clients (ClientID).  The HttpResponse struct may be received
 //by many Mongrel2 server instances, but only the server addressed in the serverId
 //will transmit process the response --sending the result on to the client or clients.
+//If the Stream field is set the body is not buffered; it is sent with StartStream
+//as a sequence of messages as it is read from Body.  Otherwise a ContentLength of
+//zero is taken to be the length of Body.
 func (self *HttpHandlerDefault) WriteMessage(response *HttpResponse) error {
+	if response.Stream {
+		return self.writeStream(response)
+	}
+
+	//read the body, if it exists, so that its length is known
+	var body []byte
+	if response.Body != nil {
+		data, e := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if e != nil {
+			return e
+		}
+		body = data
+	}
+	length := response.ContentLength
+	if length == 0 {
+		length = int64(len(body))
+	}
 
 	//create the properly mangled body in HTTP format
 	buffer := new(bytes.Buffer)
-	if response.StatusMsg == "" {
-		buffer.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", 200, "OK"))
-	} else {
-		buffer.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", response.StatusCode, response.StatusMsg))
+	writeResponseHead(buffer, response, fmt.Sprintf("Content-Length: %d\r\n", length))
+	buffer.Write(body)
+
+	_, err := self.Write(response.ServerId, response.ClientId, buffer.Bytes())
+	if err == nil && response.CloseAfter {
+		err = self.Close(response.ServerId, response.ClientId...)
 	}
 
-	if !response.Stream && response.ContentLength == 0 && response.Body != nil {
-		panic("content length set to zero but body is not nil!")
+	return err
+}
+
+//writeResponseHead writes the status line and headers of response, including the
+//framing header supplied, followed by the blank line that separates them from the
+//body.  A zero StatusCode means 200 and the reason phrase defaults to the standard
+//one for the code.
+func writeResponseHead(buffer *bytes.Buffer, response *HttpResponse, framing string) {
+	code := response.StatusCode
+	if code == 0 {
+		code = http.StatusOK
 	}
-	buffer.WriteString(fmt.Sprintf("Content-Length: %d\r\n", response.ContentLength))
+	msg := response.StatusMsg
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	buffer.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, msg))
+	buffer.WriteString(framing)
 
+	hasConnection := false
 	for k, v := range response.Header {
 		buffer.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+		hasConnection = hasConnection || strings.EqualFold(k, "Connection")
+	}
+	if response.CloseAfter && !hasConnection {
+		buffer.WriteString("Connection: close\r\n")
 	}
 
 	//critical, separating extra newline
 	buffer.WriteString("\r\n")
-	//then the body, if it exists
-	if response.Body != nil {
-		_, e := buffer.ReadFrom(response.Body)
-		if e != nil {
-			return e
-		}
-	}
-
-	_, err := self.Write(response.ServerId, response.ClientId, buffer.Bytes())
-
-	return err
 }
@@ -1,11 +1,10 @@
 package mongrel2
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/alecthomas/gozmq"
-	"strconv"
-	"strings"
+	"os"
 )
 
 type JsonRequest struct {
@@ -14,6 +13,17 @@ type JsonRequest struct {
 	ServicePath string
 	MongrelInfo map[string]string
 	Json        map[string]interface{}
+
+	ctx context.Context
+}
+
+//Context returns the context of the client connection the request arrived on.  It
+//is cancelled when the client disconnects.
+func (self *JsonRequest) Context() context.Context {
+	if self.ctx == nil {
+		return context.Background()
+	}
+	return self.ctx
 }
 
 type JsonResponse struct {
@@ -31,66 +41,84 @@ type JsonHandlerDefault struct {
 	*RawHandlerDefault
 }
 
+//ReadJson blocks until mongrel2 sends a message and decodes its body as JSON.
+//Mongrel2's notices that clients have disconnected are passed to OnDisconnect
+//rather than returned, and ReadJson goes on waiting for a message.
 func (self *JsonHandlerDefault) ReadJson() (*JsonRequest, error) {
+	for {
+		payload, err := self.Transport.Recv()
+		if err != nil {
+			return nil, err
+		}
+		result, err := self.decodeJson(payload)
+		if result != nil || err != nil {
+			return result, err
+		}
+	}
+}
 
-	payload, err := self.InSocket.Recv(0)
+//decodeJson builds a JsonRequest from a message, or returns nil if the message was
+//a disconnect.
+func (self *JsonHandlerDefault) decodeJson(payload []byte) (*JsonRequest, error) {
+	serverId, clientId, path, info, bodyStart, bodySize, err := DecodePayloadStart(payload)
 	if err != nil {
 		return nil, err
 	}
-	serverId, clientId, path, info, bodyStart, bodySize, error := DecodePayloadStart(payload)
-
-	if error != nil {
-		return nil, error
-	}
 
 	var content map[string]interface{}
 
 	if bodySize > 0 {
 		err = json.Unmarshal(payload[bodyStart:bodyStart+bodySize], &content)
 		if err != nil {
-			return nil, err
+			return nil, &ProtocolError{bodyStart, "body", err.Error()}
 		}
 	}
 
+	if info["METHOD"] == "JSON" && content["type"] == "disconnect" {
+		self.disconnected(serverId, clientId)
+		return nil, nil
+	}
+
 	result := new(JsonRequest)
 	result.ServerId = serverId
 	result.ClientId = clientId
 	result.MongrelInfo = info
 	result.ServicePath = path
 	result.Json = content
+	result.ctx = self.ClientContext(serverId, clientId)
 
 	return result, nil
 }
 
+//WriteJson encodes resp.Json and sends it to the clients listed.  It goes through
+//Write, so it can be called alongside the handler's other writers.
 func (self *JsonHandlerDefault) WriteJson(resp *JsonResponse) error {
-	c := make([]string, len(resp.ClientId), len(resp.ClientId))
-	for i, x := range resp.ClientId {
-		c[i] = strconv.Itoa(x)
-	}
-	clientList := strings.Join(c, " ")
 	b, err := json.Marshal(resp.Json)
 	if err != nil {
 		return err
 	}
-
-	body := string(b)
-	payload := fmt.Sprintf("%s %d:%s, %s", resp.ServerId, len(clientList), clientList, body)
-	return self.OutSocket.Send([]byte(payload), 0)
-
+	_, err = self.Write(resp.ServerId, resp.ClientId, b)
+	return err
 }
 
 // ReadLoop is a loop that reads mongrel2 messages until it gets an error.  This useful if
 // you want to launch a goroutine that reads forever from mongrel2 and makes the read 
-// messages available on the supplied channel.
+// messages available on the supplied channel.  As with HttpHandlerDefault's ReadLoop,
+// an error other than a bad message is written to stderr and ends the loop.
 func (self *JsonHandlerDefault) ReadLoop(in chan *JsonRequest) {
 	for {
 		r, err := self.ReadJson()
 		if err != nil {
-			if err == gozmq.ETERM {
+			if terminated(err) {
 				fmt.Printf("JSON socket ignoring ETERM on read, assuming shutdown...\n")
 				return
 			}
-			panic(err)
+			if _, ok := err.(*ProtocolError); ok {
+				fmt.Fprintf(os.Stderr, "JSON socket skipping bad message: %s\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "JSON socket stopping read loop: %s\n", err)
+			return
 		}
 		in <- r
 	}
@@ -99,7 +127,7 @@ func (self *JsonHandlerDefault) ReadLoop(in chan *JsonRequest) {
 // WriteLoop is a loop that sends mongrel two message until it gets an error
 // or a message to close.  This is useful when you want to launch a goroutine
 //that runs forever just taking messages from the out channel supplied and pushing them
-//to mongrel2.
+//to mongrel2.  An error sending is written to stderr and ends the loop.
 func (self *JsonHandlerDefault) WriteLoop(out chan *JsonResponse) {
 	for {
 		m := <-out
@@ -109,12 +137,82 @@ func (self *JsonHandlerDefault) WriteLoop(out chan *JsonResponse) {
 
 		err := self.WriteJson(m)
 		if err != nil {
-			if err == gozmq.ETERM {
+			if terminated(err) {
 				fmt.Printf("JSON socket ignoring ETERM on write, assuming shutdown...\n")
 				return
 			}
-			panic(err)
+			fmt.Fprintf(os.Stderr, "JSON socket stopping write loop: %s\n", err)
+			return
 		}
 	}
 
 }
+
+//RunReadLoop reads messages from mongrel2 and sends them on in until ctx is cancelled
+//or Shutdown is called, in the same way as HttpHandlerDefault's RunReadLoop.
+func (self *JsonHandlerDefault) RunReadLoop(ctx context.Context, in chan<- *JsonRequest) error {
+	return self.runReadLoop(ctx, "JSON", func() (interface{}, error) {
+		return self.ReadJson()
+	}, jsonRequests(in))
+}
+
+//RunWriteLoop sends the messages from out to mongrel2 until out is closed, ctx is
+//cancelled or Shutdown is called, in the same way as HttpHandlerDefault's
+//RunWriteLoop.
+func (self *JsonHandlerDefault) RunWriteLoop(ctx context.Context, out <-chan *JsonResponse) error {
+	return self.runWriteLoop(ctx, self.writeQueued, jsonResponses(out))
+}
+
+//writeQueued sends a message taken from the channel of a write loop.
+func (self *JsonHandlerDefault) writeQueued(msg interface{}) error {
+	return self.WriteJson(msg.(*JsonResponse))
+}
+
+//Run runs RunReadLoop and RunWriteLoop together, in the same way as
+//HttpHandlerDefault's Run.
+func (self *JsonHandlerDefault) Run(ctx context.Context, in chan<- *JsonRequest, out <-chan *JsonResponse) error {
+	return runLoops(ctx, func(ctx context.Context) error {
+		return self.RunReadLoop(ctx, in)
+	}, func(ctx context.Context) error {
+		return self.RunWriteLoop(ctx, out)
+	})
+}
+
+//jsonRequests is the requestQueue of a JSON read loop.
+type jsonRequests chan<- *JsonRequest
+
+func (self jsonRequests) put(ctx context.Context, stop <-chan struct{}, msg interface{}) bool {
+	select {
+	case self <- msg.(*JsonRequest):
+		return true
+	case <-ctx.Done():
+	case <-stop:
+	}
+	return false
+}
+
+//jsonResponses is the responseQueue of a JSON write loop.
+type jsonResponses <-chan *JsonResponse
+
+func (self jsonResponses) take(ctx context.Context, stop <-chan struct{}) (interface{}, bool) {
+	select {
+	case m, ok := <-self:
+		return m, ok
+	case <-ctx.Done():
+	case <-stop:
+	}
+	return nil, true
+}
+
+func (self jsonResponses) poll() (interface{}, bool) {
+	select {
+	case m, ok := <-self:
+		return m, ok
+	default:
+	}
+	return nil, true
+}
+
+func (self jsonResponses) queued() int {
+	return len(self)
+}
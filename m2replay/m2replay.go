@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mongrel2"
+	"mongrel2/mongreltest"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//m2replay plays back a recording made with mongrel2's Recorder against a handler,
+//taking the place of mongrel2, and reports where the handler's responses differ from
+//the recorded ones.  It binds the handler's sockets, so mongrel2 must not be running
+//with the same handler configured.  Start it first, then the handler:
+//
+//	m2replay -registry specs.json -name chat -speed 10 traffic.jsonl
+//
+//where specs.json is the FileRegistry the handler uses.  The exit status is 1 if the
+//responses differ and 2 for any other problem.
+
+func main() {
+	os.Exit(run())
+}
+
+//run does the work of main and returns the exit status, so that the deferred
+//cleanup happens before the program exits.
+func run() int {
+	registry := flag.String("registry", "", "file of the FileRegistry the handler gets its spec from")
+	name := flag.String("name", "", "name of the handler, to find its spec in -registry")
+	pull := flag.String("pull", "", "address the handler pulls requests from (overrides -name)")
+	pub := flag.String("pub", "", "address the handler publishes responses to (overrides -name)")
+	speed := flag.Float64("speed", 1, "how many times faster than recorded to send the requests; 0 sends them all at once")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for the handler to connect and for each response")
+	ignore := flag.String("ignore", `(?m)^Date: .*\r$`, "regular expression for the parts of the responses that aren't compared")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: m2replay [flags] recording.jsonl\n")
+		flag.PrintDefaults()
+		return 2
+	}
+
+	spec := &mongrel2.HandlerSpec{Name: *name, PullSpec: *pull, PubSpec: *pub}
+	if *name != "" {
+		//the in-memory registry of this process knows nothing of the handler's spec
+		if *registry == "" {
+			return fail(fmt.Errorf("-name needs -registry"))
+		}
+		//Get would allocate a spec for a name that isn't there, so look it up instead
+		specs, err := mongrel2.NewFileRegistry(*registry).Specs()
+		if err != nil {
+			return fail(err)
+		}
+		var s *mongrel2.HandlerSpec
+		for _, candidate := range specs {
+			if candidate.Name == *name {
+				s = candidate
+			}
+		}
+		if s == nil {
+			return fail(fmt.Errorf("no handler named %q in %s", *name, *registry))
+		}
+		if spec.PullSpec == "" {
+			spec.PullSpec = s.PullSpec
+		}
+		if spec.PubSpec == "" {
+			spec.PubSpec = s.PubSpec
+		}
+	}
+	if spec.PullSpec == "" || spec.PubSpec == "" {
+		return fail(fmt.Errorf("need -name or both -pull and -pub"))
+	}
+	var skip *regexp.Regexp
+	if *ignore != "" {
+		var err error
+		if skip, err = regexp.Compile(*ignore); err != nil {
+			return fail(err)
+		}
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	entries, err := mongrel2.ReadRecording(f)
+	f.Close()
+	if err != nil {
+		return fail(err)
+	}
+
+	server, err := mongreltest.NewServer(spec)
+	if err != nil {
+		return fail(err)
+	}
+	defer server.Close()
+	server.Timeout = *timeout
+	fmt.Printf("waiting for the handler on %s and %s...\n", spec.PullSpec, spec.PubSpec)
+	if err = server.WaitForHandler(); err != nil {
+		return fail(err)
+	}
+
+	diffs, err := server.Replay(entries, *speed)
+	if err != nil {
+		return fail(err)
+	}
+	count := 0
+	for _, d := range diffs {
+		if skip != nil && d.Expected != nil && d.Actual != nil &&
+			skip.ReplaceAllString(string(d.Expected), "") == skip.ReplaceAllString(string(d.Actual), "") {
+			continue
+		}
+		count++
+		printDiff(d)
+	}
+	fmt.Printf("%d recorded messages, %d differences\n", len(entries), count)
+	if count > 0 {
+		return 1
+	}
+	return 0
+}
+
+//printDiff shows the lines of a message that differ, line by line.
+func printDiff(d mongreltest.ReplayDiff) {
+	fmt.Printf("server %s, client %d, message %d:\n", d.ServerId, d.ClientId, d.Index)
+	switch {
+	case d.Actual == nil:
+		fmt.Printf("  not sent by the handler\n")
+	case d.Expected == nil:
+		fmt.Printf("  not in the recording\n")
+	}
+	expected := splitLines(d.Expected)
+	actual := splitLines(d.Actual)
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			fmt.Printf("- %q\n", expected[i])
+		case i >= len(expected):
+			fmt.Printf("+ %q\n", actual[i])
+		case expected[i] != actual[i]:
+			fmt.Printf("- %q\n+ %q\n", expected[i], actual[i])
+		}
+	}
+}
+
+func splitLines(data []byte) []string {
+	if data == nil {
+		return nil
+	}
+	return strings.SplitAfter(string(data), "\n")
+}
+
+//fail reports err and returns the exit status for it.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "m2replay: %s\n", err)
+	return 2
+}
@@ -0,0 +1,83 @@
+package mongrel2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+)
+
+//Middleware wraps a HandlerFunc in another one that does something extra, such as
+//logging, checking credentials or compressing the response, before or after it
+//calls the handler it wraps (or instead of calling it at all).
+type Middleware func(HandlerFunc) HandlerFunc
+
+//Chain wraps h in the middleware given, the first outermost: for a request, the
+//first one starts first and finishes last.  So
+//
+//	h := mongrel2.Chain(router.ServeRequest, mongrel2.Recover, logRequests, checkLogin)
+//
+//recovers from panics in everything after it, logs the requests that are refused by
+//checkLogin as well as the ones that reach the router.
+func Chain(h HandlerFunc, middleware ...Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+//Before returns middleware that calls hook with the request before the handler.  If
+//hook returns a response it is sent instead and the handler is not called.
+func Before(hook func(*HttpRequest) *HttpResponse) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *HttpRequest) *HttpResponse {
+			if response := hook(req); response != nil {
+				return response
+			}
+			return next(req)
+		}
+	}
+}
+
+//After returns middleware that calls hook with the request and the handler's response
+//(which is nil if the handler sent its own), and sends the response hook returns.
+func After(hook func(*HttpRequest, *HttpResponse) *HttpResponse) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *HttpRequest) *HttpResponse {
+			return hook(req, next(req))
+		}
+	}
+}
+
+//Recover is middleware that stops a panic in the handlers it wraps from taking the
+//process down.  Like net/http it logs the panic, with the stack, and the client gets
+//a 500 response instead.
+func Recover(next HandlerFunc) HandlerFunc {
+	return func(req *HttpRequest) (result *HttpResponse) {
+		defer func() {
+			if err := recover(); err != nil {
+				buf := make([]byte, 4096)
+				buf = buf[:runtime.Stack(buf, false)]
+				fmt.Fprintf(os.Stderr, "HTTP handler panic serving %s: %v\n%s", req.Path, err, buf)
+				result = plainResponse(req, http.StatusInternalServerError, "")
+			}
+		}()
+		return next(req)
+	}
+}
+
+//SetValue keeps value under key for as long as the request is being handled, which
+//is how middleware passes things like the logged in user on to the handlers after
+//it.  The value is put in the request's Context, so it can be found with Value or
+//with Context().Value.  Keys should be of a type of their own, as for
+//context.WithValue.  The values of a request must not be set from two goroutines at
+//once.
+func (self *HttpRequest) SetValue(key, value interface{}) {
+	self.ctx = context.WithValue(self.Context(), key, value)
+}
+
+//Value returns the value kept under key by SetValue, or nil.
+func (self *HttpRequest) Value(key interface{}) interface{} {
+	return self.Context().Value(key)
+}
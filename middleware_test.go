@@ -0,0 +1,90 @@
+package mongrel2
+
+import (
+	"context"
+	"launchpad.net/gocheck"
+	"net/http"
+)
+
+type MiddlewareSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&MiddlewareSuite{})
+
+type userKey struct{}
+
+//tracing returns middleware that adds name to trace on the way in and on the way out.
+func tracing(trace *[]string, name string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *HttpRequest) *HttpResponse {
+			*trace = append(*trace, name+" in")
+			result := next(req)
+			*trace = append(*trace, name+" out")
+			return result
+		}
+	}
+}
+
+func (s *MiddlewareSuite) TestChainOrder(c *gocheck.C) {
+	var trace []string
+	h := Chain(func(req *HttpRequest) *HttpResponse {
+		trace = append(trace, "handler")
+		return NewHttpResponse(req)
+	}, tracing(&trace, "a"), tracing(&trace, "b"))
+	h(routerRequest("GET", "/", "/"))
+	c.Check(trace, gocheck.DeepEquals, []string{"a in", "b in", "handler", "b out", "a out"})
+}
+
+func (s *MiddlewareSuite) TestHooksAndValues(c *gocheck.C) {
+	login := Before(func(req *HttpRequest) *HttpResponse {
+		if req.Path == "/private" {
+			return plainResponse(req, http.StatusForbidden, "")
+		}
+		req.SetValue(userKey{}, "fred")
+		return nil
+	})
+	stamp := After(func(req *HttpRequest, resp *HttpResponse) *HttpResponse {
+		resp.Header["X-Handled"] = "yes"
+		return resp
+	})
+	h := Chain(func(req *HttpRequest) *HttpResponse {
+		result := NewHttpResponse(req)
+		result.StatusMsg = req.Value(userKey{}).(string)
+		c.Check(req.Context().Value(userKey{}), gocheck.Equals, "fred")
+		return result
+	}, stamp, login)
+
+	resp := h(routerRequest("GET", "/", "/public"))
+	c.Check(resp.StatusMsg, gocheck.Equals, "fred")
+	c.Check(resp.Header["X-Handled"], gocheck.Equals, "yes")
+	resp = h(routerRequest("GET", "/", "/private"))
+	c.Check(resp.StatusCode, gocheck.Equals, 403)
+	c.Check(resp.Header["X-Handled"], gocheck.Equals, "yes")
+
+	//a value is kept alongside the client's context, which still gets cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	req := routerRequest("GET", "/", "/")
+	req.ctx = ctx
+	req.SetValue(userKey{}, "jim")
+	cancel()
+	c.Check(req.Context().Err(), gocheck.NotNil)
+	c.Check(req.Value(userKey{}), gocheck.Equals, "jim")
+}
+
+func (s *MiddlewareSuite) TestRecover(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	dispatcher := NewDispatcher(handler, Chain(func(req *HttpRequest) *HttpResponse {
+		panic("oops")
+	}, Recover))
+	result := make(chan error)
+	go func() { result <- dispatcher.Run(context.Background()) }()
+
+	transport.in <- getRequest(4, "/boom")
+	id, resp := sentResponse(c, transport)
+	c.Check(id, gocheck.Equals, 4)
+	c.Check(resp.StatusCode, gocheck.Equals, 500)
+	c.Check(handler.Shutdown(context.Background()), gocheck.IsNil)
+	c.Check(<-result, gocheck.IsNil)
+}
@@ -0,0 +1,378 @@
+//The mongreltest package plays the part of a mongrel2 server so that handlers can be
+//tested without running one.  A Server binds the two sockets mongrel2 would bind for
+//a handler: it pushes the requests the test injects to the handler and collects the
+//responses the handler publishes, sorted by server and client id.  It talks the 0mq
+//wire protocol with mongrel2.ZMTPSocket, so the handler under test must use a
+//transport made by mongrel2.DialZMTP (Server.Connect does that) or, for the tcp and
+//ipc specs, libzmq.
+package mongreltest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mongrel2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultTimeout is how long a Server waits for a response or a connection unless its
+//Timeout says otherwise.
+const DefaultTimeout = 5 * time.Second
+
+//ErrTimeout is returned when the handler doesn't answer within the Server's Timeout.
+var ErrTimeout = errors.New("mongreltest: timed out waiting for the handler")
+
+//Server is a fake mongrel2 server for one handler.
+type Server struct {
+	//ServerId is the uuid of the server, which is the ServerId of the requests it
+	//sends.  Responses addressed to other servers are ignored.
+	ServerId string
+	Spec     *mongrel2.HandlerSpec
+	Timeout  time.Duration
+
+	push, sub *mongrel2.ZMTPSocket
+
+	lock    sync.Mutex
+	clients map[clientKey]*client
+}
+
+//clientKey identifies a client: client ids are only unique within a server.
+type clientKey struct {
+	serverId string
+	clientId int
+}
+
+//client holds the messages sent to one client, in order.
+type client struct {
+	messages chan []byte
+	pending  []byte
+	closed   bool
+}
+
+var (
+	inprocLock sync.Mutex
+	inprocNext int
+)
+
+//NewServer binds the sockets for spec: a push socket at its PullSpec and a sub socket
+//at its PubSpec.
+func NewServer(spec *mongrel2.HandlerSpec) (*Server, error) {
+	result := &Server{
+		ServerId: mongrel2.Checksum("mongreltest " + spec.Name),
+		Spec:     spec,
+		Timeout:  DefaultTimeout,
+		push:     mongrel2.NewZMTPSocket(mongrel2.ZMTPPush),
+		sub:      mongrel2.NewZMTPSocket(mongrel2.ZMTPSub),
+		clients:  make(map[clientKey]*client),
+	}
+	if err := result.push.Bind(spec.PullSpec); err != nil {
+		result.Close()
+		return nil, err
+	}
+	result.sub.Subscribe(result.ServerId + " ")
+	if err := result.sub.Bind(spec.PubSpec); err != nil {
+		result.Close()
+		return nil, err
+	}
+	go result.collect()
+	return result, nil
+}
+
+//NewInprocServer creates a Server with a spec of its own made of inproc addresses, for
+//handlers that connect with Connect.
+func NewInprocServer() (*Server, error) {
+	inprocLock.Lock()
+	inprocNext++
+	name := fmt.Sprintf("mongreltest-%d", inprocNext)
+	inprocLock.Unlock()
+	spec, err := new(mongrel2.InprocAllocator).Allocate(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(spec)
+}
+
+//Connect binds handler to the server with a ZMTP transport and waits until the
+//handler's sockets are connected, so that no responses are lost.
+func (self *Server) Connect(handler *mongrel2.RawHandlerDefault) error {
+	t, err := mongrel2.DialZMTP(self.Spec)
+	if err != nil {
+		return err
+	}
+	if err = handler.BindTransport(self.Spec, t); err != nil {
+		return err
+	}
+	return self.WaitForHandler()
+}
+
+//WaitForHandler waits until a handler has connected to both the server's sockets,
+//for handlers that connect by themselves, in another process for example.
+func (self *Server) WaitForHandler() error {
+	deadline := time.Now().Add(self.Timeout)
+	for self.push.Peers() == 0 || self.sub.Peers() == 0 {
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+//Close unbinds the server's sockets.
+func (self *Server) Close() error {
+	self.push.Close()
+	return self.sub.Close()
+}
+
+//Send pushes a raw message to the handler, exactly as it is.
+func (self *Server) Send(msg []byte) error {
+	return self.push.Send(msg)
+}
+
+//SendRequest sends a request from clientId for path with the headers and body
+//supplied, in mongrel2's format with JSON headers.  Headers with more than one value
+//are sent as a list.
+func (self *Server) SendRequest(clientId int, path string, headers map[string][]string, body []byte) error {
+	encoded := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		if len(v) == 1 {
+			encoded[k] = v[0]
+		} else {
+			encoded[k] = v
+		}
+	}
+	h, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "%s %d %s %d:%s,%d:", self.ServerId, clientId, path, len(h), h, len(body))
+	msg.Write(body)
+	msg.WriteString(",")
+	return self.Send(msg.Bytes())
+}
+
+//SendHttp sends r as a request from clientId, with the headers mongrel2 adds.  The
+//request can be made with http.NewRequest; only the path and query of its URL are
+//used.  The PATTERN is the handler's name, as if it was routed to with that path.
+func (self *Server) SendHttp(clientId int, r *http.Request) error {
+	var body []byte
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+	headers := map[string][]string{
+		"METHOD":  {r.Method},
+		"VERSION": {fmt.Sprintf("HTTP/%d.%d", r.ProtoMajor, r.ProtoMinor)},
+		"URI":     {r.URL.RequestURI()},
+		"PATH":    {r.URL.Path},
+		"PATTERN": {self.Spec.Name},
+	}
+	if r.URL.RawQuery != "" {
+		headers["QUERY"] = []string{r.URL.RawQuery}
+	}
+	if r.Host != "" {
+		headers["host"] = []string{r.Host}
+	}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = v
+	}
+	if len(body) > 0 && r.Header.Get("Content-Length") == "" {
+		headers["content-length"] = []string{strconv.Itoa(len(body))}
+	}
+	return self.SendRequest(clientId, r.URL.Path, headers, body)
+}
+
+//SendJson sends v as a message from a JSON socket (flash or JavaScript) client.  Path
+//is the route the client is using, such as "@chat".
+func (self *Server) SendJson(clientId int, path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return self.SendRequest(clientId, path, map[string][]string{"METHOD": {"JSON"}, "PATH": {path}}, body)
+}
+
+//SendDisconnect sends mongrel2's notice that clientId has closed its connection.
+func (self *Server) SendDisconnect(clientId int) error {
+	return self.SendJson(clientId, "@*", map[string]string{"type": "disconnect"})
+}
+
+//SendWebSocketHandshake sends the request that opens a websocket with the key
+//supplied.
+func (self *Server) SendWebSocketHandshake(clientId int, path, key string) error {
+	return self.SendRequest(clientId, path, map[string][]string{
+		"METHOD":            {mongrel2.WebSocketHandshakeMethod},
+		"VERSION":           {"HTTP/1.1"},
+		"PATH":              {path},
+		"URI":               {path},
+		"PATTERN":           {self.Spec.Name},
+		"upgrade":           {"websocket"},
+		"connection":        {"Upgrade"},
+		"sec-websocket-key": {key},
+	}, nil)
+}
+
+//SendWebSocketFrame sends a frame from a websocket client, the way mongrel2 does:
+//the payload (already unmasked) as the body and the first byte of the frame in the
+//FLAGS header.
+func (self *Server) SendWebSocketFrame(clientId int, path string, opcode byte, fin bool, data []byte) error {
+	flags := opcode
+	if fin {
+		flags |= 0x80
+	}
+	return self.SendRequest(clientId, path, map[string][]string{
+		"METHOD": {mongrel2.WebSocketMethod},
+		"PATH":   {path},
+		"FLAGS":  {fmt.Sprintf("0x%x", flags)},
+	}, data)
+}
+
+//collect sorts the messages the handler publishes by client.
+func (self *Server) collect() {
+	for {
+		msg, err := self.sub.Recv()
+		if err != nil {
+			return
+		}
+		serverId, ids, data, err := mongrel2.DecodeResponse(msg)
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			self.client(clientKey{serverId, id}).messages <- data
+		}
+	}
+}
+
+func (self *Server) client(key clientKey) *client {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c := self.clients[key]
+	if c == nil {
+		c = &client{messages: make(chan []byte, 1000)}
+		self.clients[key] = c
+	}
+	return c
+}
+
+//Next returns the next message the handler sent to clientId, without the server and
+//client ids.  An empty message is the handler asking mongrel2 to close the
+//connection.
+func (self *Server) Next(clientId int) ([]byte, error) {
+	return self.next(clientKey{self.ServerId, clientId})
+}
+
+func (self *Server) next(key clientKey) ([]byte, error) {
+	select {
+	case msg := <-self.client(key).messages:
+		return msg, nil
+	case <-time.After(self.Timeout):
+		return nil, ErrTimeout
+	}
+}
+
+//Pending returns how many messages to clientId have arrived that haven't been read,
+//to check that a handler sent nothing more.
+func (self *Server) Pending(clientId int) int {
+	return len(self.client(clientKey{self.ServerId, clientId}).messages)
+}
+
+//ReadHttpResponse reads the next HTTP response sent to clientId, which may be spread
+//over several messages (when it is streamed, for example), and reads its whole body.
+//A response whose body ends when the connection closes ends with the close message.
+func (self *Server) ReadHttpResponse(clientId int) (*http.Response, error) {
+	key := clientKey{self.ServerId, clientId}
+	r := bufio.NewReader(&clientReader{self, self.client(key), key})
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+//ReadJson reads the next message sent to clientId and decodes it as JSON into v.
+func (self *Server) ReadJson(clientId int, v interface{}) error {
+	msg, err := self.Next(clientId)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg, v)
+}
+
+//ReadWebSocketFrame reads the next message sent to clientId and decodes it as an
+//unmasked websocket frame.
+func (self *Server) ReadWebSocketFrame(clientId int) (opcode byte, data []byte, err error) {
+	msg, err := self.Next(clientId)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(msg) < 2 {
+		return 0, nil, errors.New("mongreltest: websocket frame too short")
+	}
+	opcode = msg[0] & 0x0F
+	size, rest := uint64(msg[1]&0x7F), msg[2:]
+	switch size {
+	case 126:
+		if len(rest) < 2 {
+			return 0, nil, errors.New("mongreltest: websocket frame too short")
+		}
+		size, rest = uint64(binary.BigEndian.Uint16(rest)), rest[2:]
+	case 127:
+		if len(rest) < 8 {
+			return 0, nil, errors.New("mongreltest: websocket frame too short")
+		}
+		size, rest = binary.BigEndian.Uint64(rest), rest[8:]
+	}
+	if uint64(len(rest)) != size {
+		return 0, nil, fmt.Errorf("mongreltest: websocket frame says %d bytes but has %d", size, len(rest))
+	}
+	return opcode, rest, nil
+}
+
+//clientReader reads the messages to one client as a stream.  The close message is
+//the end of the stream.
+type clientReader struct {
+	server *Server
+	client *client
+	key    clientKey
+}
+
+func (self *clientReader) Read(p []byte) (int, error) {
+	c := self.client
+	for len(c.pending) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		msg, err := self.server.next(self.key)
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 {
+			c.closed = true
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
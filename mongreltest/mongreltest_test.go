@@ -0,0 +1,132 @@
+package mongreltest
+
+import (
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"mongrel2"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+type ServerSuite struct {
+	server *Server
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *gocheck.C) {
+	server, err := NewInprocServer()
+	c.Assert(err, gocheck.IsNil)
+	s.server = server
+}
+
+func (s *ServerSuite) TearDownTest(c *gocheck.C) {
+	s.server.Close()
+}
+
+func (s *ServerSuite) TestHttp(c *gocheck.C) {
+	handler := &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
+	c.Assert(s.server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+
+	r, _ := http.NewRequest("POST", "http://localhost/things?x=1", strings.NewReader("a body"))
+	r.Header.Set("Accept-Encoding", "gzip")
+	c.Assert(s.server.SendHttp(12, r), gocheck.IsNil)
+
+	req, err := handler.ReadMessage()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(req.ServerId, gocheck.Equals, s.server.ServerId)
+	c.Check(req.ClientId, gocheck.Equals, 12)
+	c.Check(req.Method, gocheck.Equals, "POST")
+	c.Check(req.Path, gocheck.Equals, "/things")
+	c.Check(req.Query, gocheck.Equals, "x=1")
+	c.Check(req.Header.Get("Accept-Encoding"), gocheck.Equals, "gzip")
+	c.Check(string(req.Body), gocheck.Equals, "a body")
+
+	response := mongrel2.NewHttpResponse(req)
+	response.Header = map[string]string{"Content-Type": "text/plain"}
+	response.Body = ioutil.NopCloser(strings.NewReader("thanks"))
+	response.ContentLength = 6
+	c.Assert(handler.WriteMessage(response), gocheck.IsNil)
+
+	resp, err := s.server.ReadHttpResponse(12)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(resp.Header.Get("Content-Type"), gocheck.Equals, "text/plain")
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(body), gocheck.Equals, "thanks")
+	c.Check(s.server.Pending(12), gocheck.Equals, 0)
+}
+
+func (s *ServerSuite) TestStreamedResponse(c *gocheck.C) {
+	handler := &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
+	c.Assert(s.server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+
+	stream, err := handler.StartStream(&mongrel2.HttpResponse{ServerId: s.server.ServerId, ClientId: []int{1, 2}})
+	c.Assert(err, gocheck.IsNil)
+	stream.Write([]byte("one "))
+	stream.Write([]byte("two"))
+	c.Assert(stream.Close(), gocheck.IsNil)
+
+	for _, id := range []int{1, 2} {
+		resp, err := s.server.ReadHttpResponse(id)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(resp.TransferEncoding, gocheck.DeepEquals, []string{"chunked"})
+		body, _ := ioutil.ReadAll(resp.Body)
+		c.Check(string(body), gocheck.Equals, "one two")
+	}
+}
+
+func (s *ServerSuite) TestJsonAndDisconnect(c *gocheck.C) {
+	handler := &mongrel2.JsonHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
+	disconnects := make(chan *mongrel2.DisconnectEvent, 1)
+	handler.OnDisconnect = func(event *mongrel2.DisconnectEvent) { disconnects <- event }
+	c.Assert(s.server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+
+	c.Assert(s.server.SendJson(3, "@chat", map[string]string{"msg": "hi"}), gocheck.IsNil)
+	req, err := handler.ReadJson()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(req.Json["msg"], gocheck.Equals, "hi")
+
+	err = handler.WriteJson(&mongrel2.JsonResponse{ServerId: req.ServerId, ClientId: []int{3}, Json: map[string]interface{}{"msg": "hello"}})
+	c.Assert(err, gocheck.IsNil)
+	var reply map[string]string
+	c.Assert(s.server.ReadJson(3, &reply), gocheck.IsNil)
+	c.Check(reply["msg"], gocheck.Equals, "hello")
+
+	//the disconnect is reported on the side and the read goes on to the next message
+	c.Assert(s.server.SendDisconnect(3), gocheck.IsNil)
+	c.Assert(s.server.SendJson(4, "@chat", map[string]string{"msg": "still here"}), gocheck.IsNil)
+	next, err := handler.ReadJson()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(next.ClientId, gocheck.Equals, 4)
+	c.Check((<-disconnects).ClientId, gocheck.Equals, 3)
+	c.Check(req.Context().Err(), gocheck.NotNil)
+}
+
+func (s *ServerSuite) TestWebSocket(c *gocheck.C) {
+	handler := mongrel2.NewWebSocketHandler(&mongrel2.RawHandlerDefault{})
+	c.Assert(s.server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+
+	c.Assert(s.server.SendWebSocketHandshake(5, "/ws", "dGhlIHNhbXBsZSBub25jZQ=="), gocheck.IsNil)
+	c.Assert(s.server.SendWebSocketFrame(5, "/ws", mongrel2.WebSocketText, false, []byte("hel")), gocheck.IsNil)
+	c.Assert(s.server.SendWebSocketFrame(5, "/ws", mongrel2.WebSocketContinuation, true, []byte("lo")), gocheck.IsNil)
+	msg, err := handler.ReadWebSocket()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(msg.Data), gocheck.Equals, "hello")
+
+	resp, err := s.server.ReadHttpResponse(5)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(resp.StatusCode, gocheck.Equals, 101)
+	c.Check(resp.Header.Get("Sec-WebSocket-Accept"), gocheck.Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+
+	c.Assert(handler.WriteWebSocket(msg), gocheck.IsNil)
+	opcode, data, err := s.server.ReadWebSocketFrame(5)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(opcode, gocheck.Equals, byte(mongrel2.WebSocketText))
+	c.Check(string(data), gocheck.Equals, "hello")
+}
@@ -0,0 +1,121 @@
+package mongreltest
+
+import (
+	"bytes"
+	"mongrel2"
+	"sort"
+	"time"
+)
+
+//ReplayDiff is a difference between the responses recorded for a client and the ones
+//the handler sent when the recording was replayed.  Index counts the messages to the
+//client from zero.  Expected is nil for a message that wasn't in the recording and
+//Actual is nil for one the handler didn't send.
+type ReplayDiff struct {
+	ServerId string
+	ClientId int
+	Index    int
+	Expected []byte
+	Actual   []byte
+}
+
+//Replay sends the inbound messages of a recording made by mongrel2.Recorder to the
+//handler and compares what the handler sends back with the outbound messages of the
+//recording, client by client.  Clients are told apart by their server as well as
+//their id, since a recording of a handler serving several mongrel2 servers can have
+//the same client id on each.  With a speed of 1 the messages are sent with the
+//delays between them in the recording, with a speed of 10 ten times faster and with
+//a speed of 0 (or less) as fast as possible.  The responses are collected once all
+//the messages have been sent, waiting for each for up to the Server's Timeout.  The
+//handler must already be connected.
+func (self *Server) Replay(entries []mongrel2.RecordEntry, speed float64) ([]ReplayDiff, error) {
+	expected := make(map[clientKey][][]byte)
+	subscribed := map[string]bool{self.ServerId: true}
+	var first time.Time
+	start := time.Now()
+	for _, entry := range entries {
+		if !subscribed[entry.ServerId] {
+			//listen for the responses to the server the recording was made with
+			self.sub.Subscribe(entry.ServerId + " ")
+			subscribed[entry.ServerId] = true
+		}
+		if entry.Direction == mongrel2.RecordOut {
+			serverId, ids, data, err := mongrel2.DecodeResponse(entry.Data)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				key := clientKey{serverId, id}
+				expected[key] = append(expected[key], data)
+			}
+			continue
+		}
+
+		if first.IsZero() {
+			first = entry.Time
+		}
+		if speed > 0 {
+			due := time.Duration(float64(entry.Time.Sub(first)) / speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if err := self.Send(entry.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []ReplayDiff
+	for _, key := range sortedClients(expected) {
+		for i, want := range expected[key] {
+			got, err := self.next(key)
+			if err != nil {
+				for ; i < len(expected[key]); i++ {
+					result = append(result, ReplayDiff{ServerId: key.serverId, ClientId: key.clientId, Index: i, Expected: expected[key][i]})
+				}
+				break
+			}
+			if !bytes.Equal(got, want) {
+				result = append(result, ReplayDiff{ServerId: key.serverId, ClientId: key.clientId, Index: i, Expected: want, Actual: got})
+			}
+		}
+	}
+
+	//anything else the handler sent was not in the recording
+	self.lock.Lock()
+	extra := make(map[clientKey][][]byte)
+	for key, c := range self.clients {
+		for len(c.messages) > 0 {
+			extra[key] = append(extra[key], <-c.messages)
+		}
+	}
+	self.lock.Unlock()
+	for _, key := range sortedClients(extra) {
+		for i, got := range extra[key] {
+			result = append(result, ReplayDiff{ServerId: key.serverId, ClientId: key.clientId, Index: len(expected[key]) + i, Actual: got})
+		}
+	}
+	return result, nil
+}
+
+//sortedClients returns the clients that messages has, by server and then client id.
+func sortedClients(messages map[clientKey][][]byte) []clientKey {
+	result := make([]clientKey, 0, len(messages))
+	for key := range messages {
+		result = append(result, key)
+	}
+	sort.Sort(byClient(result))
+	return result
+}
+
+//byClient sorts clients by server and then client id.
+type byClient []clientKey
+
+func (self byClient) Len() int      { return len(self) }
+func (self byClient) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self byClient) Less(i, j int) bool {
+	if self[i].serverId != self[j].serverId {
+		return self[i].serverId < self[j].serverId
+	}
+	return self[i].clientId < self[j].clientId
+}
@@ -0,0 +1,129 @@
+package mongreltest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"mongrel2"
+	"net/http"
+	"strings"
+)
+
+type ReplaySuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ReplaySuite{})
+
+//echo answers each request with its path, prefixed with greeting, until the
+//transport is closed.
+func echo(handler *mongrel2.HttpHandlerDefault, greeting string) {
+	for {
+		req, err := handler.ReadMessage()
+		if err != nil {
+			return
+		}
+		response := mongrel2.NewHttpResponse(req)
+		body := greeting + req.Path
+		response.Body = ioutil.NopCloser(strings.NewReader(body))
+		response.ContentLength = int64(len(body))
+		handler.WriteMessage(response)
+	}
+}
+
+//record runs two requests through an echo handler with a Recorder.
+func record(c *gocheck.C) []mongrel2.RecordEntry {
+	server, err := NewInprocServer()
+	c.Assert(err, gocheck.IsNil)
+	defer server.Close()
+	handler := &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
+	c.Assert(server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+	log := new(bytes.Buffer)
+	handler.Record(log)
+	done := make(chan bool)
+	go func() {
+		echo(handler, "hello ")
+		close(done)
+	}()
+
+	for i, path := range []string{"/a", "/b"} {
+		r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		c.Assert(server.SendHttp(i+1, r), gocheck.IsNil)
+		_, err := server.ReadHttpResponse(i + 1)
+		c.Assert(err, gocheck.IsNil)
+	}
+	//the handler is done with the log once it has stopped
+	handler.Transport.CloseRecv()
+	<-done
+	handler.Transport.CloseSend()
+	entries, err := mongrel2.ReadRecording(log)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(entries, gocheck.HasLen, 4)
+	return entries
+}
+
+func replay(c *gocheck.C, entries []mongrel2.RecordEntry, greeting string) []ReplayDiff {
+	server, err := NewInprocServer()
+	c.Assert(err, gocheck.IsNil)
+	defer server.Close()
+	server.Timeout = 100e6
+	handler := &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
+	c.Assert(server.Connect(handler.RawHandlerDefault), gocheck.IsNil)
+	defer handler.Transport.CloseSend()
+	defer handler.Transport.CloseRecv()
+	go echo(handler, greeting)
+
+	diffs, err := server.Replay(entries, 0)
+	c.Assert(err, gocheck.IsNil)
+	return diffs
+}
+
+func (s *ReplaySuite) TestReplaySame(c *gocheck.C) {
+	c.Check(replay(c, record(c), "hello "), gocheck.HasLen, 0)
+}
+
+func (s *ReplaySuite) TestReplayDifferent(c *gocheck.C) {
+	diffs := replay(c, record(c), "bye ")
+	c.Assert(diffs, gocheck.HasLen, 2)
+	c.Check(diffs[0].ClientId, gocheck.Equals, 1)
+	c.Check(string(diffs[0].Expected), gocheck.Matches, "(?s).*hello /a")
+	c.Check(string(diffs[0].Actual), gocheck.Matches, "(?s).*bye /a")
+}
+
+func (s *ReplaySuite) TestReplayMissing(c *gocheck.C) {
+	entries := record(c)
+	//drop the second request, so its response never comes
+	diffs := replay(c, append(entries[:2:2], entries[3]), "hello ")
+	c.Assert(diffs, gocheck.HasLen, 1)
+	c.Check(diffs[0].ClientId, gocheck.Equals, 2)
+	c.Check(diffs[0].Actual, gocheck.IsNil)
+}
+
+func (s *ReplaySuite) TestReplaySameClientOnTwoServers(c *gocheck.C) {
+	entries := record(c)
+	//move client 2 to another server as client 1, so both servers have a client 1
+	for i := range entries {
+		entry := &entries[i]
+		if entry.ClientId[0] != 2 {
+			continue
+		}
+		if entry.Direction == mongrel2.RecordIn {
+			fields := bytes.SplitN(entry.Data, []byte(" "), 3)
+			entry.Data = append([]byte("other-server 1 "), fields[2]...)
+		} else {
+			_, _, data, err := mongrel2.DecodeResponse(entry.Data)
+			c.Assert(err, gocheck.IsNil)
+			entry.Data = append([]byte("other-server 1:1, "), data...)
+		}
+		entry.ServerId = "other-server"
+		entry.ClientId = []int{1}
+	}
+	c.Check(replay(c, entries, "hello "), gocheck.HasLen, 0)
+
+	diffs := replay(c, entries, "bye ")
+	c.Assert(diffs, gocheck.HasLen, 2)
+	c.Check(diffs[1].ServerId, gocheck.Equals, "other-server")
+	c.Check(diffs[1].ClientId, gocheck.Equals, 1)
+	c.Check(string(diffs[1].Expected), gocheck.Matches, "(?s).*hello /b")
+	c.Check(string(diffs[1].Actual), gocheck.Matches, "(?s).*bye /b")
+}
@@ -0,0 +1,233 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+//DefaultMaxServing is the MaxServing of a handler that doesn't set one.
+const DefaultMaxServing = 100
+
+//Serve reads requests from mongrel2 and calls h for each of them in a goroutine of
+//its own, running at most the handler's MaxServing (DefaultMaxServing if it is zero)
+//at once; while that many are running it stops reading, and the requests wait in
+//mongrel2.  The requests are converted with NetHttpRequest and h is given an
+//http.ResponseWriter that sends the reply back to the right server and client when
+//h returns.  The context of each request is cancelled if the client disconnects.
+//Requests are read with RunReadLoop, so Serve stops when ctx is cancelled, Shutdown
+//is called or reading fails, and returns the read error, if any, once the requests
+//being served have been answered.  The handler is only called for a large upload
+//once mongrel2 has received all of it, and the upload's temporary file is removed
+//afterwards.
+func (self *HttpHandlerDefault) Serve(ctx context.Context, h http.Handler) error {
+	in := make(chan *HttpRequest)
+	read := make(chan error, 1)
+	go func() {
+		read <- self.RunReadLoop(ctx, in)
+		close(in)
+	}()
+
+	slots := make(chan struct{}, self.maxServing())
+	var serving sync.WaitGroup
+	for req := range in {
+		if req.Upload != nil && !req.Upload.Done {
+			//wait for the rest of a large upload
+			continue
+		}
+		slots <- struct{}{}
+		serving.Add(1)
+		go func(req *HttpRequest) {
+			defer serving.Done()
+			defer func() { <-slots }()
+			self.serveNetHttp(h, req)
+		}(req)
+	}
+	serving.Wait()
+	return <-read
+}
+
+func (self *HttpHandlerDefault) maxServing() int {
+	if self.MaxServing <= 0 {
+		return DefaultMaxServing
+	}
+	return self.MaxServing
+}
+
+//serveNetHttp runs a single request through h.  Like net/http, a panic in the handler
+//is logged and does not take down the process; the client gets a 500 if nothing
+//has been written yet.  The connection is closed after the response if the client
+//asked for that or the handler set Connection: close.
+func (self *HttpHandlerDefault) serveNetHttp(h http.Handler, req *HttpRequest) {
+	w := &responseWriter{header: make(http.Header)}
+	if req.Upload != nil {
+		defer req.Upload.Remove()
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			fmt.Fprintf(os.Stderr, "HTTP handler panic serving %s: %v\n%s", req.Path, err, buf)
+			w = &responseWriter{header: make(http.Header)}
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		closeAfter := !req.KeepAlive() || headerHasToken(w.header.Get("Connection"), "close")
+		if closeAfter {
+			w.header.Set("Connection", "close")
+		} else if req.Version == "HTTP/1.0" {
+			w.header.Set("Connection", "keep-alive")
+		}
+		_, err := self.Write(req.ServerId, []int{req.ClientId}, w.encode(req.Method))
+		if err == nil && closeAfter {
+			err = self.Close(req.ServerId, req.ClientId)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "HTTP handler unable to send response to %s %d: %s\n", req.ServerId, req.ClientId, err)
+		}
+	}()
+
+	r, err := NetHttpRequest(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	h.ServeHTTP(w, r.WithContext(req.Context()))
+}
+
+//NetHttpRequest converts a request from mongrel2 into the equivalent net/http request,
+//as it would be seen by an http.Handler in a net/http server.  The method, URL,
+//protocol version and headers come from the mongrel2 headers, the body reads from
+//req.Body (or the upload file, see BodyReader) and RemoteAddr is the client address
+//mongrel2 put in x-forwarded-for.
+func NetHttpRequest(req *HttpRequest) (*http.Request, error) {
+	uri := req.URI
+	if uri == "" {
+		uri = req.Path
+		if req.Query != "" {
+			uri += "?" + req.Query
+		}
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	version := req.Version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("malformed HTTP version %q", version)
+	}
+
+	header := http.Header(req.Header.Clone())
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	body, err := req.BodyReader()
+	if err != nil {
+		return nil, err
+	}
+	length := int64(len(req.Body))
+	if req.Upload != nil {
+		if size, err := req.Upload.Size(); err == nil {
+			length = size
+		}
+	}
+
+	result := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Host:          header.Get("Host"),
+		RemoteAddr:    header.Get("X-Forwarded-For"),
+		RequestURI:    uri,
+	}
+	result.Close = !req.KeepAlive()
+	return result, nil
+}
+
+//responseWriter is the http.ResponseWriter given to handlers by Serve.  The body is
+//collected in memory and sent, with the status line and headers, as one message to
+//mongrel2 when the handler returns.
+type responseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (self *responseWriter) Header() http.Header {
+	return self.header
+}
+
+func (self *responseWriter) WriteHeader(code int) {
+	if self.wroteHeader {
+		return
+	}
+	self.wroteHeader = true
+	self.status = code
+}
+
+func (self *responseWriter) Write(data []byte) (int, error) {
+	if !self.wroteHeader {
+		self.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowed(self.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	return self.body.Write(data)
+}
+
+//encode produces the HTTP response in the form mongrel2 passes on to the client.
+//Content-Length is always set, since the whole body is known, and Content-Type is
+//sniffed from the body if the handler didn't set it, as net/http does.
+func (self *responseWriter) encode(method string) []byte {
+	if !self.wroteHeader {
+		self.WriteHeader(http.StatusOK)
+	}
+	if bodyAllowed(self.status) {
+		if self.header.Get("Content-Type") == "" && self.body.Len() > 0 {
+			self.header.Set("Content-Type", http.DetectContentType(self.body.Bytes()))
+		}
+		self.header.Set("Content-Length", strconv.Itoa(self.body.Len()))
+	}
+
+	result := new(bytes.Buffer)
+	out := bufio.NewWriter(result)
+	fmt.Fprintf(out, "HTTP/1.1 %d %s\r\n", self.status, http.StatusText(self.status))
+	self.header.Write(out)
+	out.WriteString("\r\n")
+	if method != "HEAD" {
+		out.Write(self.body.Bytes())
+	}
+	out.Flush()
+	return result.Bytes()
+}
+
+//bodyAllowed reports whether a response with the given status may have a body.
+func bodyAllowed(status int) bool {
+	if status >= 100 && status <= 199 {
+		return false
+	}
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
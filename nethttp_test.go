@@ -0,0 +1,110 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"time"
+)
+
+type NetHttpSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&NetHttpSuite{})
+
+var (
+	POST_SAMPLE = `0de9b17e-e958-4502-8de9-b17ee958d502 7 /app/form 222:{"PATH":"/app/form","METHOD":"POST","VERSION":"HTTP/1.0","URI":"/app/form?x=1&y=2","QUERY":"x=1&y=2","PATTERN":"/app","host":"localhost:6767","content-type":"text/plain","cookie":["a=1","b=2"],"x-forwarded-for":"10.0.0.1"},5:hello,`
+)
+
+func (s *NetHttpSuite) TestConvertRequest(c *gocheck.C) {
+	req, err := decodeHttpRequest([]byte(POST_SAMPLE))
+	c.Assert(err, gocheck.IsNil)
+	r, err := NetHttpRequest(req)
+	c.Assert(err, gocheck.IsNil)
+
+	c.Check(r.Method, gocheck.Equals, "POST")
+	c.Check(r.URL.Path, gocheck.Equals, "/app/form")
+	c.Check(r.URL.Query().Get("y"), gocheck.Equals, "2")
+	c.Check(r.RequestURI, gocheck.Equals, "/app/form?x=1&y=2")
+	c.Check(r.ProtoMinor, gocheck.Equals, 0)
+	c.Check(r.Close, gocheck.Equals, true)
+	c.Check(r.Host, gocheck.Equals, "localhost:6767")
+	c.Check(r.RemoteAddr, gocheck.Equals, "10.0.0.1")
+	c.Check(r.Header["Cookie"], gocheck.DeepEquals, []string{"a=1", "b=2"})
+	c.Check(r.ContentLength, gocheck.Equals, int64(5))
+	body, err := ioutil.ReadAll(r.Body)
+	c.Check(err, gocheck.IsNil)
+	c.Check(string(body), gocheck.Equals, "hello")
+}
+
+func (s *NetHttpSuite) TestEncodeResponse(c *gocheck.C) {
+	w := &responseWriter{header: make(http.Header)}
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.Write([]byte("<html>hi</html>"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(w.encode("GET"))), nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(resp.StatusCode, gocheck.Equals, 200)
+	c.Check(resp.Header["Set-Cookie"], gocheck.DeepEquals, []string{"a=1", "b=2"})
+	c.Check(resp.Header.Get("Content-Type"), gocheck.Equals, "text/html; charset=utf-8")
+	c.Check(resp.ContentLength, gocheck.Equals, int64(15))
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Check(string(body), gocheck.Equals, "<html>hi</html>")
+}
+
+func (s *NetHttpSuite) TestEncodeNoBody(c *gocheck.C) {
+	w := &responseWriter{header: make(http.Header)}
+	w.WriteHeader(http.StatusNotModified)
+	_, err := w.Write([]byte("x"))
+	c.Check(err, gocheck.Equals, http.ErrBodyNotAllowed)
+	c.Check(string(w.encode("GET")), gocheck.Equals, "HTTP/1.1 304 Not Modified\r\n\r\n")
+}
+
+func (s *NetHttpSuite) TestServe(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	handler.MaxServing = 1
+	started := make(chan string, 2)
+	release := make(chan bool)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		<-release
+		w.Write([]byte(r.URL.Path))
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- handler.Serve(ctx, h) }()
+
+	transport.in <- getRequest(1, "/1")
+	transport.in <- getRequest(2, "/2")
+	c.Check(<-started, gocheck.Equals, "/1")
+	select {
+	case path := <-started:
+		c.Fatalf("%s served while /1 was using the only slot", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	c.Check(<-started, gocheck.Equals, "/2")
+
+	//Serve stops reading when ctx is cancelled but answers what it has started
+	cancel()
+	select {
+	case <-result:
+		c.Fatal("Serve returned before the request it was serving was answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	c.Check(<-result, gocheck.IsNil)
+	for _, want := range []int{1, 2} {
+		id, resp := sentResponse(c, transport)
+		c.Check(id, gocheck.Equals, want)
+		body, _ := ioutil.ReadAll(resp.Body)
+		c.Check(string(body), gocheck.Equals, fmt.Sprintf("/%d", want))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build nozmq
+// +build nozmq
+
+package mongrel2
+
+//zmqSocket stands in for gozmq.Socket in the InSocket and OutSocket fields of
+//RawHandlerDefault, which stay nil without libzmq.
+type zmqSocket struct{}
+
+//terminated reports whether err means that the transport has been shut down, in
+//which case the read and write loops stop quietly.
+func terminated(err error) bool {
+	return err == ErrTransportClosed
+}
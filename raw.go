@@ -3,168 +3,175 @@ package mongrel2
 
 import (
 	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/alecthomas/gozmq"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-//RawHandler is the basic type for an object that communicate with mongrel2.  This interface
-//just knows about sockets, nothing about what to do with communication on those sockets.
-//Developers should not need this type.
-type RawHandler interface {
-	Bind(name string, ctx *gozmq.Context) error
-}
-
 //Handler is a low-level an implementation of the interface RawHandler
 //for connecting, via 0MQ, to a mongrel2 server. Developers should not need
 //this type, it is part of the implementation of this package.
 type RawHandlerDefault struct {
-	InSocket, OutSocket         *gozmq.Socket
+	Transport                   Transport
 	PullSpec, PubSpec, Identity string
-}
 
-//initZMQ creates the necessary ZMQ machinery and sets the fields of the
-//Mongrel2 struct.  This is normally called via the Init() method.
-func (self *RawHandlerDefault) InitZMQ(ctx *gozmq.Context) error {
-	s, err := ctx.NewSocket(gozmq.PULL)
-	if err != nil {
-		return err
-	}
-	self.InSocket = s
+	//InSocket and OutSocket are the libzmq sockets under Transport when the handler
+	//was bound with a zmq context, for code that sets options on them.  They are nil
+	//with any other transport and are never set when building with the nozmq tag.
+	InSocket, OutSocket *zmqSocket
 
-	err = self.InSocket.Connect(self.PullSpec)
-	if err != nil {
-		return err
-	}
+	//Linger is how long a write loop whose context has been cancelled goes on sending
+	//the responses already queued for it, and how long the transport is then given
+	//to deliver them.  Zero means DefaultLinger and less than zero means not at all.
+	Linger time.Duration
 
-	err = self.InSocket.SetSockOptInt(gozmq.LINGER, 0)
-	if err != nil {
-		return err
-	}
+	//OnDisconnect, if it is set, is called with each disconnect mongrel2 reports, by
+	//the goroutine that read it, before the read goes on to the next message.
+	OnDisconnect func(*DisconnectEvent)
 
-	s, err = ctx.NewSocket(gozmq.PUB)
-	if err != nil {
-		return err
-	}
-	self.OutSocket = s
+	//MaxClients is how many client connections the handler keeps a context for
+	//(see ClientContext); zero means DefaultMaxClients.
+	MaxClients int
 
-	err = self.OutSocket.SetSockOptString(gozmq.IDENTITY, self.Identity)
-	if err != nil {
-		return err
-	}
+	//0mq sockets must not be used from two goroutines at once
+	writeLock sync.Mutex
 
-	err = self.OutSocket.SetSockOptInt(gozmq.LINGER, 0)
-	if err != nil {
-		return err
-	}
+	clients clientTracker
+	loops   loopState
+}
 
-	err = self.OutSocket.Connect(self.PubSpec)
-	if err != nil {
-		return err
-	}
+//ProtocolError is returned when a message from mongrel2 does not have the expected
+//shape.  Offset is the position in the raw message where the problem was found and
+//Field names the part of the message that was being decoded.  A ProtocolError
+//only means that one message was bad, so readers may log it and carry on.
+type ProtocolError struct {
+	Offset int
+	Field  string
+	Reason string
+}
 
-	return nil
+func (self *ProtocolError) Error() string {
+	return fmt.Sprintf("mongrel2 protocol error at byte %d (%s): %s", self.Offset, self.Field, self.Reason)
 }
 
-//Bind is a method that allocates the zmq resources needed for a connection
-//to mongrel2.  It uses the supplied context to allocate the resources and allocates
-//an address based on the name and uses that for the send and receive sockets.  If
-//called multiple times, it has no effect.
-func (self *RawHandlerDefault) Bind(name string, ctx *gozmq.Context) error {
-	//this only needs to be done once for a particular name, even if you call
-	//Shutdown() and Bind() again.
-	if self.Identity == "" {
-		address, err := GetHandlerSpec(name)
-		if err != nil {
-			return err
-		}
+//Payload is the decoded front of a message from mongrel2.  The header block sent
+//by mongrel2 mixes its own upper case keys (METHOD, PATH, URI, QUERY, VERSION,
+//PATTERN and friends) with the headers the client sent, which mongrel2 always
+//lower cases.  These are separated into Meta and Header respectively.  The body
+//is the BodySize bytes starting at BodyStart in the original message.
+type Payload struct {
+	ServerId  string
+	ClientId  int
+	Path      string
+	Meta      map[string]string
+	Header    Header
+	BodyStart int
+	BodySize  int
+
+	//raw keeps the header block exactly as it was sent, for DecodePayloadStart
+	raw map[string][]string
+}
 
-		self.PullSpec = address.PullSpec
-		self.PubSpec = address.PubSpec
-		self.Identity = address.Identity
+//DecodePayload decodes the front of a packet from the mongrel2 server destined for
+//a backend.  The actual bytes of the body are not decoded because they differ between
+//different types of handlers.  The headers may be encoded either as JSON or as a
+//tnetstring dict, depending on the protocol mongrel2 has been configured to use
+//for the handler; the encoding is detected from the header block's type tag.  A
+//header that was repeated by the client arrives as a list and keeps all its values.
+//Every length and terminator is checked against the size of req, so a truncated or
+//garbled message results in a *ProtocolError rather than a panic.
+func DecodePayload(req []byte) (*Payload, error) {
+	result := new(Payload)
+
+	endOfServerId, err := readSome(' ', req, 0, "server id")
+	if err != nil {
+		return nil, err
 	}
-
-	if self.InSocket == nil {
-		err := self.InitZMQ(ctx)
-		if err != nil {
-			return errors.New("0mq init:" + err.Error())
-		}
+	if endOfServerId == 0 {
+		return nil, &ProtocolError{0, "server id", "empty server id"}
 	}
-	return nil
-}
+	result.ServerId = string(req[0:endOfServerId])
 
-//MustCreateContext is a function that creates a ZMQ context or panics trying to do so.
-//Useful if you can't do any work without a ZMQ context.
-func MustCreateContext() *gozmq.Context {
-	// do a version check
-	x, y, z := gozmq.Version()
-	if x != 2 && y != 1 {
-		fmt.Fprintf(os.Stderr, "version of zmq is %d.%d.%d and this code was tested primarily on 2.1.10\n", x, y, z)
+	endOfClientId, err := readSome(' ', req, endOfServerId+1, "client id")
+	if err != nil {
+		return nil, err
+	}
+	result.ClientId, err = strconv.Atoi(string(req[endOfServerId+1 : endOfClientId]))
+	if err != nil || result.ClientId < 0 {
+		return nil, &ProtocolError{endOfServerId + 1, "client id", fmt.Sprintf("bad client id %q", req[endOfServerId+1:endOfClientId])}
 	}
 
-	//initialize zmq... only once per address space
-	ctx, err := gozmq.NewContext()
+	endOfPath, err := readSome(' ', req, endOfClientId+1, "path")
 	if err != nil {
-		panic(fmt.Sprintf("unable to initialize zmq context:%s\n", err))
+		return nil, err
 	}
-	return ctx
-}
+	result.Path = string(req[endOfClientId+1 : endOfPath])
 
-//DecodePayloadStart decodes the front of a packet from the mongrel2 server destined for
-//a backend.  The actual bytes of the body are not decoded because they differet between
-//different types of handlers.
-func DecodePayloadStart(req []byte) (serverId string, clientId int, path string, jsonmap map[string]string, bodyStart int, bodySize int, err error) {
-
-	endOfServerId := readSome(' ', req, 0)
-	serverId = string(req[0:endOfServerId])
-
-	endOfClientId := readSome(' ', req, endOfServerId+1)
-	clientId, err = strconv.Atoi(string(req[endOfServerId+1 : endOfClientId]))
+	jsonStart, jsonSize, err := readNetstring(req, endOfPath+1, "header")
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	endOfPath := readSome(' ', req, endOfClientId+1)
-	path = string(req[endOfClientId+1 : endOfPath])
-
-	var jsonSize int
-	endOfJsonSize := readSome(':', req, endOfPath+1)
-
-	jsonSize, err = strconv.Atoi(string(req[endOfPath+1 : endOfJsonSize]))
+	//the type tag after the header block tells us whether mongrel2 is talking
+	//the JSON protocol (a tnetstring string holding JSON) or tnetstrings
+	switch req[jsonStart+jsonSize] {
+	case TnetDict:
+		result.raw, err = decodeTnetHeader(req[jsonStart : jsonStart+jsonSize])
+	case TnetString:
+		result.raw, err = decodeJsonHeader(req[jsonStart : jsonStart+jsonSize])
+	default:
+		err = fmt.Errorf("unexpected terminator %q", req[jsonStart+jsonSize])
+	}
 	if err != nil {
-		return
+		return nil, &ProtocolError{jsonStart, "header", err.Error()}
 	}
 
-	jsonmap = make(map[string]string)
-	jsonStart := endOfJsonSize + 1
-
-	if jsonSize > 0 {
-		err = json.Unmarshal(req[jsonStart:jsonStart+jsonSize], &jsonmap)
-		if err != nil {
-			return
+	result.Meta = make(map[string]string)
+	result.Header = make(Header)
+	for k, values := range result.raw {
+		if isMetaKey(k) {
+			if len(values) > 0 {
+				result.Meta[k] = values[0]
+			}
+			continue
+		}
+		for _, v := range values {
+			result.Header.Add(k, v)
 		}
 	}
 
-	bodySizeStart := (jsonSize + 1) + jsonStart
-	bodySizeEnd := readSome(':', req, bodySizeStart)
-	bodyStart = bodySizeEnd + 1
-
-	bodySize, err = strconv.Atoi(string(req[bodySizeStart:bodySizeEnd]))
+	result.BodyStart, result.BodySize, err = readNetstring(req, jsonStart+jsonSize+1, "body")
+	if err != nil {
+		return nil, err
+	}
+	if end := result.BodyStart + result.BodySize; req[end] != TnetString {
+		return nil, &ProtocolError{end, "body", fmt.Sprintf("expected ',' terminator but found %q", req[end])}
+	}
+	return result, nil
+}
 
+//DecodePayloadStart is the original form of DecodePayload, which returns the header
+//block as a single map with the keys exactly as mongrel2 sent them.  Headers with
+//several values are joined with commas, as HTTP allows.
+func DecodePayloadStart(req []byte) (serverId string, clientId int, path string, jsonmap map[string]string, bodyStart int, bodySize int, err error) {
+	p, err := DecodePayload(req)
 	if err != nil {
 		return
 	}
-
-	if bodySize > 0 {
-		//bodySize -= 1
+	jsonmap = make(map[string]string, len(p.raw))
+	for k, values := range p.raw {
+		jsonmap[k] = strings.Join(values, ", ")
 	}
-	return
+	return p.ServerId, p.ClientId, p.Path, jsonmap, p.BodyStart, p.BodySize, nil
 }
 
+//Write sends data to the clients listed in clientId, all of which must be connected
+//to the mongrel2 server serverId.  The data is passed on to the clients exactly as
+//it is, except that mongrel2 treats a message with no data as an instruction to close
+//the connections (see Close).  It is safe to call Write from several goroutines at
+//once.
 func (self *RawHandlerDefault) Write(serverId string, clientId []int, data []byte) (int, error) {
 	c := make([]string, len(clientId))
 	for i, id := range clientId {
@@ -177,22 +184,59 @@ func (self *RawHandlerDefault) Write(serverId string, clientId []int, data []byt
 	msg.Write(header)
 	msg.Write(data)
 
-	fmt.Printf("Sending\n%s\n", msg.Bytes())
-
-	if err := self.OutSocket.Send(msg.Bytes(), 0); err != nil {
-		panic(err)
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if err := self.Transport.Send(msg.Bytes()); err != nil {
 		return 0, err
 	}
 	return msg.Len(), nil
 }
 
-func readSome(terminationChar byte, req []byte, start int) int {
-	result := start
-	for {
-		if req[result] == terminationChar {
-			break
+//Close tells the mongrel2 server serverId to close the connections to the clients
+//listed, once anything already sent to them has been delivered.  This is done by
+//sending mongrel2 a message with no data.  The clients' contexts are cancelled and
+//forgotten, as they would be if mongrel2 reported that they had disconnected.
+func (self *RawHandlerDefault) Close(serverId string, clientId ...int) error {
+	self.forget(serverId, clientId...)
+	return inClientGroups(clientId, func(ids []int) error {
+		_, err := self.Write(serverId, ids, nil)
+		return err
+	})
+}
+
+//readSome returns the index of the first terminationChar at or after start.  It is
+//a *ProtocolError for the character to be missing.
+func readSome(terminationChar byte, req []byte, start int, field string) (int, error) {
+	if start < len(req) {
+		if i := bytes.IndexByte(req[start:], terminationChar); i >= 0 {
+			return start + i, nil
 		}
-		result++
 	}
-	return result
+	return 0, &ProtocolError{start, field, fmt.Sprintf("missing %q terminator", terminationChar)}
+}
+
+//readNetstring parses the SIZE: prefix of the netstring starting at start and checks
+//that the data and the terminating character it implies are inside req.  It returns
+//the index of the first byte of data and the size; the terminator is at
+//dataStart+size.
+func readNetstring(req []byte, start int, field string) (dataStart int, size int, err error) {
+	endOfSize, err := readSome(':', req, start, field+" size")
+	if err != nil {
+		return
+	}
+	if endOfSize == start || endOfSize-start > maxTnetSizeDigits {
+		err = &ProtocolError{start, field + " size", "missing or overlong length prefix"}
+		return
+	}
+	size, err = strconv.Atoi(string(req[start:endOfSize]))
+	if err != nil || size < 0 {
+		err = &ProtocolError{start, field + " size", fmt.Sprintf("bad length %q", req[start:endOfSize])}
+		return
+	}
+	dataStart = endOfSize + 1
+	if dataStart+size >= len(req) {
+		err = &ProtocolError{dataStart, field, fmt.Sprintf("length %d runs past the end of the %d byte message", size, len(req))}
+		return
+	}
+	return
 }
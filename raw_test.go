@@ -58,3 +58,99 @@ func (s *MongrelSuite) TestPayloadDecodingGet(c *gocheck.C) {
 	c.Check(jsonmap["METHOD"], gocheck.Equals, "GET")
 	c.Check(0, gocheck.Equals, bodySize)
 }
+
+func (s *MongrelSuite) TestPayloadDecodingMalformed(c *gocheck.C) {
+	for _, text := range []string{
+		``,
+		`1ccef67e`,
+		` 164 @chat 2:{},0:,`,
+		`1ccef67e 164`,
+		`1ccef67e x64 @chat 2:{},0:,`,
+		`1ccef67e -4 @chat 2:{},0:,`,
+		`1ccef67e 164 @chat`,
+		`1ccef67e 164 @chat 2:{}`,
+		`1ccef67e 164 @chat 2:{},`,
+		`1ccef67e 164 @chat 200:{},0:,`,
+		`1ccef67e 164 @chat 2:{}X0:,`,
+		`1ccef67e 164 @chat 4:{"a},0:,`,
+		`1ccef67e 164 @chat :{},0:,`,
+		`1ccef67e 164 @chat 2:{},5:abc,`,
+		`1ccef67e 164 @chat 2:{},3:abc`,
+		`1ccef67e 164 @chat 2:{},3:abc}`,
+		`1ccef67e 164 @chat 2:{},1234567890:abc,`,
+	} {
+		_, _, _, _, _, _, err := DecodePayloadStart([]byte(text))
+		_, ok := err.(*ProtocolError)
+		c.Check(ok, gocheck.Equals, true, gocheck.Commentf("%q gave %v", text, err))
+	}
+}
+
+func (s *MongrelSuite) TestPayloadDecodingErrorOffset(c *gocheck.C) {
+	_, _, _, _, _, _, err := DecodePayloadStart([]byte(`1ccef67e 164 @chat 2:{},9:abc,`))
+	perr, ok := err.(*ProtocolError)
+	c.Assert(ok, gocheck.Equals, true)
+	c.Check(perr.Field, gocheck.Equals, "body")
+	c.Check(perr.Offset, gocheck.Equals, 26)
+}
+
+func (s *MongrelSuite) TestClientContextCancelledOnDisconnect(c *gocheck.C) {
+	raw := &RawHandlerDefault{}
+	ctx := raw.ClientContext("1ccef67e", 164)
+	c.Check(raw.ClientContext("1ccef67e", 164), gocheck.Equals, ctx)
+	other := raw.ClientContext("1ccef67e", 165)
+
+	event := raw.disconnected("1ccef67e", 164)
+	c.Check(*event, gocheck.Equals, DisconnectEvent{"1ccef67e", 164})
+	c.Check(ctx.Err(), gocheck.NotNil)
+	c.Check(other.Err(), gocheck.IsNil)
+	c.Check(raw.ClientContext("1ccef67e", 164).Err(), gocheck.IsNil)
+}
+
+func (s *MongrelSuite) TestClientContextCancelledOnClose(c *gocheck.C) {
+	transport := newChanTransport()
+	raw := &RawHandlerDefault{Transport: transport}
+	ctx := raw.ClientContext("1ccef67e", 164)
+	other := raw.ClientContext("1ccef67e", 165)
+	c.Assert(raw.Close("1ccef67e", 164), gocheck.IsNil)
+	c.Check(ctx.Err(), gocheck.NotNil)
+	c.Check(other.Err(), gocheck.IsNil)
+	c.Check(raw.clients.conns, gocheck.HasLen, 1)
+	c.Check(transport.sent, gocheck.HasLen, 1)
+}
+
+func (s *MongrelSuite) TestClientContextBounded(c *gocheck.C) {
+	raw := &RawHandlerDefault{MaxClients: 2}
+	var forgotten []int
+	raw.watchDisconnects(func(key clientKey) { forgotten = append(forgotten, key.clientId) })
+	first := raw.ClientContext("1ccef67e", 1)
+	second := raw.ClientContext("1ccef67e", 2)
+	third := raw.ClientContext("1ccef67e", 3)
+	c.Check(first.Err(), gocheck.NotNil)
+	c.Check(second.Err(), gocheck.IsNil)
+	c.Check(third.Err(), gocheck.IsNil)
+	c.Check(raw.clients.conns, gocheck.HasLen, 2)
+	c.Check(forgotten, gocheck.DeepEquals, []int{1})
+}
+
+func (s *MongrelSuite) TestReadMessageSkipsDisconnects(c *gocheck.C) {
+	transport := newChanTransport()
+	var events []DisconnectEvent
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	handler.OnDisconnect = func(event *DisconnectEvent) { events = append(events, *event) }
+	ctx := handler.ClientContext("0de9b17e-e958-4502-8de9-b17ee958d502", 235)
+
+	transport.in <- []byte(`0de9b17e-e958-4502-8de9-b17ee958d502 235 @* 17:{"METHOD":"JSON"},21:{"type":"disconnect"},`)
+	transport.in <- []byte(GET_SAMPLE)
+	req, err := handler.ReadMessage()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(req.Method, gocheck.Equals, "GET")
+	c.Check(events, gocheck.DeepEquals, []DisconnectEvent{{"0de9b17e-e958-4502-8de9-b17ee958d502", 235}})
+	c.Check(ctx.Err(), gocheck.NotNil)
+	c.Check(req.Context().Err(), gocheck.IsNil)
+}
+
+func (s *MongrelSuite) TestIsDisconnect(c *gocheck.C) {
+	c.Check(isDisconnect("JSON", []byte(`{"type":"disconnect"}`)), gocheck.Equals, true)
+	c.Check(isDisconnect("JSON", []byte(`{"type":"msg"}`)), gocheck.Equals, false)
+	c.Check(isDisconnect("POST", []byte(`{"type":"disconnect"}`)), gocheck.Equals, false)
+}
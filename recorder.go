@@ -0,0 +1,159 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Directions of a RecordEntry.
+const (
+	RecordIn  = "in"
+	RecordOut = "out"
+)
+
+//RecordEntry is one message between mongrel2 and a handler, as written by a Recorder.
+//Data is the whole raw message; ServerId and ClientId are decoded from it for the
+//convenience of whoever reads the recording.  Inbound messages have a single client.
+type RecordEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	ServerId  string    `json:"server_id"`
+	ClientId  []int     `json:"client_id"`
+	Data      []byte    `json:"data"`
+}
+
+//Recorder is a Transport that passes everything through to another Transport and
+//writes every message that goes either way to a log, one JSON RecordEntry per line.
+//Recordings can be fed back into a handler with mongreltest's Replay or the m2replay
+//command, to reproduce a problem away from production.
+type Recorder struct {
+	Transport Transport
+
+	lock sync.Mutex
+	out  io.Writer
+	err  error
+}
+
+//Record makes the handler log all its traffic to w.  The handler must already be
+//bound, and Record must be called before anything reads or writes with it (Run, the
+//loops, a Dispatcher and so on are started), because it replaces the handler's
+//Transport without any locking.  Errors writing to w don't interfere with the handler; the first
+//one is kept and returned by the Recorder's Err.
+func (self *RawHandlerDefault) Record(w io.Writer) *Recorder {
+	result := &Recorder{Transport: self.Transport, out: w}
+	self.Transport = result
+	return result
+}
+
+func (self *Recorder) Recv() ([]byte, error) {
+	msg, err := self.Transport.Recv()
+	if err == nil {
+		entry := &RecordEntry{Direction: RecordIn, Data: msg}
+		fields := bytes.SplitN(msg, []byte(" "), 3)
+		if len(fields) == 3 {
+			entry.ServerId = string(fields[0])
+			if id, err := strconv.Atoi(string(fields[1])); err == nil {
+				entry.ClientId = []int{id}
+			}
+		}
+		self.write(entry)
+	}
+	return msg, err
+}
+
+func (self *Recorder) Send(data []byte) error {
+	err := self.Transport.Send(data)
+	if err == nil {
+		entry := &RecordEntry{Direction: RecordOut, Data: data}
+		entry.ServerId, entry.ClientId, _, _ = DecodeResponse(data)
+		self.write(entry)
+	}
+	return err
+}
+
+func (self *Recorder) CloseRecv() error {
+	return self.Transport.CloseRecv()
+}
+
+func (self *Recorder) CloseSend() error {
+	return self.Transport.CloseSend()
+}
+
+//SetLinger passes the linger time on to the recorded transport, if it has one.
+func (self *Recorder) SetLinger(d time.Duration) error {
+	if l, ok := self.Transport.(lingerer); ok {
+		return l.SetLinger(d)
+	}
+	return nil
+}
+
+//Err returns the first error the Recorder had writing the log.
+func (self *Recorder) Err() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.err
+}
+
+func (self *Recorder) write(entry *RecordEntry) {
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err == nil {
+		_, err = self.out.Write(append(line, '\n'))
+	}
+	if err != nil && self.err == nil {
+		self.err = err
+	}
+}
+
+//ReadRecording reads the entries written by a Recorder.
+func ReadRecording(r io.Reader) ([]RecordEntry, error) {
+	var result []RecordEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry RecordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, scanner.Err()
+}
+
+//DecodeResponse splits a message from a handler to mongrel2 (as made by
+//RawHandlerDefault.Write) into the server id, the client ids and the data for the
+//clients.
+func DecodeResponse(msg []byte) (serverId string, clientId []int, data []byte, err error) {
+	space := bytes.IndexByte(msg, ' ')
+	if space < 0 {
+		return "", nil, nil, errors.New("mongrel2: response without a server id")
+	}
+	start, size, err := readNetstring(msg, space+1, "client id")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	end := start + size + 1
+	if msg[start+size] != ',' || end >= len(msg) || msg[end] != ' ' {
+		return "", nil, nil, &ProtocolError{start + size, "client id", "missing \", \" after the client ids"}
+	}
+	for _, field := range strings.Fields(string(msg[start : start+size])) {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return "", nil, nil, &ProtocolError{start, "client id", err.Error()}
+		}
+		clientId = append(clientId, id)
+	}
+	return string(msg[:space]), clientId, msg[end+1:], nil
+}
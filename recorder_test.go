@@ -0,0 +1,81 @@
+package mongrel2
+
+import (
+	"bytes"
+	"launchpad.net/gocheck"
+)
+
+type RecorderSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&RecorderSuite{})
+
+//fakeTransport hands out canned messages and keeps the ones sent.
+type fakeTransport struct {
+	in   [][]byte
+	sent [][]byte
+}
+
+func (self *fakeTransport) Recv() ([]byte, error) {
+	if len(self.in) == 0 {
+		return nil, ErrTransportClosed
+	}
+	msg := self.in[0]
+	self.in = self.in[1:]
+	return msg, nil
+}
+
+func (self *fakeTransport) Send(data []byte) error {
+	self.sent = append(self.sent, data)
+	return nil
+}
+
+func (self *fakeTransport) CloseRecv() error { return nil }
+func (self *fakeTransport) CloseSend() error { return nil }
+
+func (s *RecorderSuite) TestRecordAndRead(c *gocheck.C) {
+	transport := &fakeTransport{in: [][]byte{[]byte(`server-1 12 /x 21:{"METHOD":"GET"},0:,`)}}
+	handler := &RawHandlerDefault{Transport: transport}
+	log := new(bytes.Buffer)
+	recorder := handler.Record(log)
+
+	msg, err := handler.Transport.Recv()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(msg), gocheck.Equals, `server-1 12 /x 21:{"METHOD":"GET"},0:,`)
+	_, err = handler.Write("server-1", []int{12, 13}, []byte("reply"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(transport.sent, gocheck.HasLen, 1)
+	_, err = handler.Transport.Recv()
+	c.Check(err, gocheck.Equals, ErrTransportClosed)
+	c.Check(recorder.Err(), gocheck.IsNil)
+
+	entries, err := ReadRecording(log)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(entries, gocheck.HasLen, 2)
+	c.Check(entries[0].Direction, gocheck.Equals, RecordIn)
+	c.Check(entries[0].ServerId, gocheck.Equals, "server-1")
+	c.Check(entries[0].ClientId, gocheck.DeepEquals, []int{12})
+	c.Check(entries[1].Direction, gocheck.Equals, RecordOut)
+	c.Check(entries[1].ClientId, gocheck.DeepEquals, []int{12, 13})
+	c.Check(string(entries[1].Data), gocheck.Equals, "server-1 5:12 13, reply")
+	c.Check(entries[1].Time.Before(entries[0].Time), gocheck.Equals, false)
+}
+
+func (s *RecorderSuite) TestDecodeResponse(c *gocheck.C) {
+	serverId, ids, data, err := DecodeResponse([]byte("uuid 5:1 2 3, data"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(serverId, gocheck.Equals, "uuid")
+	c.Check(ids, gocheck.DeepEquals, []int{1, 2, 3})
+	c.Check(string(data), gocheck.Equals, "data")
+
+	_, ids, data, err = DecodeResponse([]byte("uuid 1:7, "))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(ids, gocheck.DeepEquals, []int{7})
+	c.Check(data, gocheck.HasLen, 0)
+
+	for _, bad := range []string{"uuid", "uuid 9:1, data", "uuid 1:1 data", "uuid 1:x, data"} {
+		_, _, _, err = DecodeResponse([]byte(bad))
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(bad))
+	}
+}
@@ -0,0 +1,183 @@
+package mongrel2
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+//Router sends each request to the HandlerFunc registered for its method and path, so
+//that one handler process can serve a whole tree of paths under a mongrel2 route.
+//Paths are matched relative to the route's PATTERN: with a route of /api/ in
+//mongrel2's configuration, the pattern /users/:id matches a request for
+///api/users/7.  A segment of a pattern that starts with ':' matches any single
+//segment of the path and one that starts with '*' matches the rest of the path,
+//however many segments that is; either way the value, unescaped, is put in the
+//request's Params under the name that follows.  A trailing slash on the path or the
+//pattern makes no difference.  The routes are tried in the order they were added and
+//the first match wins.  When no route matches the request is answered with a 404
+//(or NotFound's response, if it is set) and when only routes for other methods do,
+//with a 405 and an Allow header.
+type Router struct {
+	NotFound HandlerFunc
+
+	routes []*route
+}
+
+//route is a pattern, split into segments, with either the handler for it or, for a
+//mounted router, the router that deals with the rest of the path.
+type route struct {
+	method   string
+	segments []string
+	handler  HandlerFunc
+	sub      *Router
+}
+
+//NewRouter returns a Router with no routes.
+func NewRouter() *Router {
+	return new(Router)
+}
+
+//Handle adds a route for requests with the method given (any method if it is empty)
+//and a path that matches pattern.
+func (self *Router) Handle(method, pattern string, h HandlerFunc) {
+	self.routes = append(self.routes, &route{method: method, segments: splitPath(pattern), handler: h})
+}
+
+//Mount passes requests whose path starts with the segments of prefix to sub, which
+//matches the rest of the path against its own routes.  The prefix may have named
+//segments, which are added to the request's Params.
+func (self *Router) Mount(prefix string, sub *Router) {
+	self.routes = append(self.routes, &route{segments: splitPath(prefix), sub: sub})
+}
+
+//ServeRequest finds the route for req and returns the response of its handler, or
+//the 404 or 405 if there is no route for it.  It is a HandlerFunc, so it can be
+//given to a Dispatcher.
+func (self *Router) ServeRequest(req *HttpRequest) *HttpResponse {
+	return self.serve(req, splitPath(relativePath(req)))
+}
+
+//Route answers req with ServeRequest and sends the response, if there is one, with
+//handler's WriteMessage.
+func (self *Router) Route(handler *HttpHandlerDefault, req *HttpRequest) error {
+	response := self.ServeRequest(req)
+	if response == nil {
+		return nil
+	}
+	return handler.WriteMessage(response)
+}
+
+func (self *Router) serve(req *HttpRequest, path []string) *HttpResponse {
+	var allowed []string
+	for _, r := range self.routes {
+		params, rest, ok := r.match(path)
+		if !ok {
+			continue
+		}
+		if r.sub != nil {
+			addParams(req, params)
+			return r.sub.serve(req, rest)
+		}
+		if r.method != "" && r.method != req.Method {
+			allowed = append(allowed, r.method)
+			continue
+		}
+		addParams(req, params)
+		return r.handler(req)
+	}
+
+	if len(allowed) > 0 {
+		result := plainResponse(req, http.StatusMethodNotAllowed, "")
+		result.Header["Allow"] = strings.Join(uniqueSorted(allowed), ", ")
+		return result
+	}
+	if self.NotFound != nil {
+		return self.NotFound(req)
+	}
+	return plainResponse(req, http.StatusNotFound, "")
+}
+
+//match checks path against the route's pattern, returning the values of its named
+//segments and, for a mounted router, the part of the path left over.
+func (self *route) match(path []string) (params map[string]string, rest []string, ok bool) {
+	params = make(map[string]string)
+	for i, seg := range self.segments {
+		if strings.HasPrefix(seg, "*") {
+			if name := seg[1:]; name != "" {
+				params[name] = unescapePath(strings.Join(path[i:], "/"))
+			}
+			return params, nil, true
+		}
+		if i >= len(path) {
+			return nil, nil, false
+		}
+		if strings.HasPrefix(seg, ":") {
+			params[seg[1:]] = unescapePath(path[i])
+		} else if seg != path[i] {
+			return nil, nil, false
+		}
+	}
+	if self.sub != nil {
+		return params, path[len(self.segments):], true
+	}
+	if len(path) != len(self.segments) {
+		return nil, nil, false
+	}
+	return params, nil, true
+}
+
+//relativePath is the part of the request's path after the literal start of the
+//mongrel2 route pattern that it matched, which is the whole path if the pattern
+//doesn't match it literally.
+func relativePath(req *HttpRequest) string {
+	prefix := req.Pattern
+	if i := strings.IndexAny(prefix, `()[]*+?$\`); i >= 0 {
+		prefix = prefix[:i]
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix != "" && (req.Path == prefix || strings.HasPrefix(req.Path, prefix+"/")) {
+		return req.Path[len(prefix):]
+	}
+	return req.Path
+}
+
+//splitPath returns the segments of a path, ignoring slashes at either end.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func unescapePath(s string) string {
+	if result, err := url.PathUnescape(s); err == nil {
+		return result
+	}
+	return s
+}
+
+func addParams(req *HttpRequest, params map[string]string) {
+	if len(params) == 0 {
+		return
+	}
+	if req.Params == nil {
+		req.Params = make(map[string]string)
+	}
+	for k, v := range params {
+		req.Params[k] = v
+	}
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	result := values[:0]
+	for _, v := range values {
+		if len(result) == 0 || v != result[len(result)-1] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package mongrel2
+
+import (
+	"context"
+	"launchpad.net/gocheck"
+)
+
+type RouterSuite struct {
+	router *Router
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&RouterSuite{})
+
+//named returns a handler that answers with its name in the StatusMsg, so the tests
+//can tell which route was taken.
+func named(name string) HandlerFunc {
+	return func(req *HttpRequest) *HttpResponse {
+		result := NewHttpResponse(req)
+		result.StatusMsg = name
+		return result
+	}
+}
+
+func routerRequest(method, pattern, path string) *HttpRequest {
+	return &HttpRequest{ServerId: "server-1", ClientId: 7, Method: method, Pattern: pattern, Path: path}
+}
+
+func (s *RouterSuite) SetUpTest(c *gocheck.C) {
+	s.router = NewRouter()
+	s.router.Handle("GET", "/", named("root"))
+	s.router.Handle("GET", "/users/new", named("new user"))
+	s.router.Handle("GET", "/users/:id", named("user"))
+	s.router.Handle("PUT", "/users/:id", named("update user"))
+	s.router.Handle("", "/files/*path", named("file"))
+}
+
+func (s *RouterSuite) TestParams(c *gocheck.C) {
+	req := routerRequest("GET", "/api/", "/api/users/a%20b")
+	resp := s.router.ServeRequest(req)
+	c.Check(resp.StatusMsg, gocheck.Equals, "user")
+	c.Check(req.Params, gocheck.DeepEquals, map[string]string{"id": "a b"})
+
+	req = routerRequest("GET", "/api/", "/api/users/new")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "new user")
+	c.Check(req.Params, gocheck.IsNil)
+
+	req = routerRequest("PUT", "/api/", "/api/users/9/")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "update user")
+	c.Check(req.Params["id"], gocheck.Equals, "9")
+}
+
+func (s *RouterSuite) TestRoot(c *gocheck.C) {
+	for _, path := range []string{"/api", "/api/"} {
+		c.Check(s.router.ServeRequest(routerRequest("GET", "/api/", path)).StatusMsg, gocheck.Equals, "root")
+	}
+	//a pattern that is a regular expression only counts up to where that starts
+	req := routerRequest("GET", "/api/(.*)", "/api/users/3")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "user")
+}
+
+func (s *RouterSuite) TestWildcard(c *gocheck.C) {
+	req := routerRequest("DELETE", "/", "/files/a/b/c.txt")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "file")
+	c.Check(req.Params["path"], gocheck.Equals, "a/b/c.txt")
+
+	req = routerRequest("GET", "/", "/files")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "file")
+	c.Check(req.Params["path"], gocheck.Equals, "")
+}
+
+func (s *RouterSuite) TestNotFoundAndNotAllowed(c *gocheck.C) {
+	resp := s.router.ServeRequest(routerRequest("GET", "/", "/nothing/here"))
+	c.Check(resp.StatusCode, gocheck.Equals, 404)
+
+	resp = s.router.ServeRequest(routerRequest("POST", "/", "/users/3"))
+	c.Check(resp.StatusCode, gocheck.Equals, 405)
+	c.Check(resp.Header["Allow"], gocheck.Equals, "GET, PUT")
+
+	s.router.NotFound = named("missing")
+	c.Check(s.router.ServeRequest(routerRequest("GET", "/", "/nothing")).StatusMsg, gocheck.Equals, "missing")
+}
+
+func (s *RouterSuite) TestMount(c *gocheck.C) {
+	posts := NewRouter()
+	posts.Handle("GET", "/", named("posts"))
+	posts.Handle("GET", "/:post", named("post"))
+	s.router.Mount("/users/:id/posts", posts)
+
+	req := routerRequest("GET", "/", "/users/3/posts/12")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "post")
+	c.Check(req.Params, gocheck.DeepEquals, map[string]string{"id": "3", "post": "12"})
+
+	req = routerRequest("GET", "/", "/users/3/posts/")
+	c.Check(s.router.ServeRequest(req).StatusMsg, gocheck.Equals, "posts")
+	req = routerRequest("GET", "/", "/users/3/posts/12/x")
+	c.Check(s.router.ServeRequest(req).StatusCode, gocheck.Equals, 404)
+}
+
+func (s *RouterSuite) TestRoute(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	c.Assert(s.router.Route(handler, routerRequest("GET", "/", "/nothing")), gocheck.IsNil)
+	id, resp := sentResponse(c, transport)
+	c.Check(id, gocheck.Equals, 7)
+	c.Check(resp.StatusCode, gocheck.Equals, 404)
+	handler.Shutdown(context.Background())
+}
@@ -0,0 +1,299 @@
+package mongrel2
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//DefaultLinger is used for a handler whose Linger is zero.
+const DefaultLinger = time.Second
+
+//UndeliveredError is returned by Shutdown and the write loops when they stopped
+//before they had sent all the responses queued for them.  Count is how many were
+//left.
+type UndeliveredError struct {
+	Count int
+}
+
+func (self *UndeliveredError) Error() string {
+	return fmt.Sprintf("mongrel2: %d queued responses were not delivered", self.Count)
+}
+
+//loopState is how Shutdown finds out about the loops started with RunReadLoop and
+//RunWriteLoop.  stop is closed by Shutdown, and idle once no write loop is running
+//after that.
+type loopState struct {
+	lock        sync.Mutex
+	stop        chan struct{}
+	stopped     bool
+	stopCtx     context.Context
+	writers     int
+	idle        chan struct{}
+	undelivered int
+}
+
+//stopping returns the channel that Shutdown closes.
+func (self *loopState) stopping() chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop == nil {
+		self.stop = make(chan struct{})
+	}
+	return self.stop
+}
+
+//startWriter registers a write loop and returns the channel that Shutdown closes.
+func (self *loopState) startWriter() chan struct{} {
+	stop := self.stopping()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writers++
+	return stop
+}
+
+//endWriter is called by a write loop that has finished, with the number of queued
+//responses it didn't send.
+func (self *loopState) endWriter(undelivered int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.writers--
+	self.undelivered += undelivered
+	if self.writers == 0 && self.idle != nil {
+		close(self.idle)
+		self.idle = nil
+	}
+}
+
+//shutdown tells the loops to stop, giving the write loops until ctx ends to send
+//what is queued.  The channel returned is closed when they have all finished.
+func (self *loopState) shutdown(ctx context.Context) chan struct{} {
+	stop := self.stopping()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopCtx = ctx
+	if !self.stopped {
+		self.stopped = true
+		close(stop)
+	}
+	idle := make(chan struct{})
+	if self.writers == 0 {
+		close(idle)
+	} else {
+		self.idle = idle
+	}
+	return idle
+}
+
+//stopContext is the context given to Shutdown.
+func (self *loopState) stopContext() context.Context {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stopCtx
+}
+
+//takeUndelivered returns, and forgets, the number of responses the write loops
+//didn't send.
+func (self *loopState) takeUndelivered() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result := self.undelivered
+	self.undelivered = 0
+	return result
+}
+
+//Shutdown stops the handler gracefully.  The read loops started with RunReadLoop stop
+//at once and the receiving side of the transport is closed.  The write loops started
+//with RunWriteLoop send the responses that are already queued on their channels
+//and stop, after which the sending side of the transport is closed, giving it until
+//ctx's deadline (or the handler's Linger) to deliver what it still holds.  The result
+//is nil if all the queued responses were sent, an *UndeliveredError saying how many
+//weren't if the write loops had to give up, or ctx.Err() if ctx ended before the
+//write loops had finished.  A handler that has been shut down is finished with: its
+//transport is closed and any loop started on it afterwards returns nil at once.
+func (self *RawHandlerDefault) Shutdown(ctx context.Context) error {
+	if self.Transport == nil {
+		return nil
+	}
+	idle := self.loops.shutdown(ctx)
+	self.Transport.CloseRecv()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		self.Transport.CloseSend()
+		return ctx.Err()
+	}
+
+	linger := self.linger()
+	if deadline, ok := ctx.Deadline(); ok {
+		linger = time.Until(deadline)
+	}
+	self.closeSend(linger)
+	return undelivered(self.loops.takeUndelivered())
+}
+
+//linger returns how long to go on sending after a write loop has been cancelled.
+func (self *RawHandlerDefault) linger() time.Duration {
+	switch {
+	case self.Linger == 0:
+		return DefaultLinger
+	case self.Linger < 0:
+		return 0
+	}
+	return self.Linger
+}
+
+//closeSend closes the sending side of the transport, giving it up to linger to
+//deliver the messages it has queued if it is able to.
+func (self *RawHandlerDefault) closeSend(linger time.Duration) error {
+	if l, ok := self.Transport.(lingerer); ok {
+		if linger < 0 {
+			linger = 0
+		}
+		l.SetLinger(linger)
+	}
+	return self.Transport.CloseSend()
+}
+
+//watchRecv closes the receiving side of the transport if ctx is cancelled before the
+//function it returns is called, which is how a read loop blocked in Recv is stopped.
+func (self *RawHandlerDefault) watchRecv(ctx context.Context) func() {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			self.Transport.CloseRecv()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+//requestQueue is the channel a read loop passes requests on to, seen without the type
+//of its elements, so that the loops below serve both kinds of handler.
+type requestQueue interface {
+	//put sends msg on the channel, unless ctx ends or stop is closed first, when it
+	//returns false.
+	put(ctx context.Context, stop <-chan struct{}, msg interface{}) bool
+}
+
+//responseQueue is the channel a write loop takes responses from, seen without the
+//type of its elements.
+type responseQueue interface {
+	//take waits for the next response until ctx ends or stop is closed, and returns
+	//nil if they do first.  ok is false once the channel has been closed.
+	take(ctx context.Context, stop <-chan struct{}) (msg interface{}, ok bool)
+	//poll returns the next response if one is already queued, and nil if none is.  ok
+	//is false once the channel has been closed.
+	poll() (msg interface{}, ok bool)
+	//queued returns how many responses are waiting.
+	queued() int
+}
+
+//runReadLoop is the loop behind RunReadLoop.  decode waits for the next message and
+//decodes it, and kind names the handler in the messages about the ones skipped.
+func (self *RawHandlerDefault) runReadLoop(ctx context.Context, kind string, decode func() (interface{}, error), in requestQueue) error {
+	stop := self.loops.stopping()
+	defer self.watchRecv(ctx)()
+	for {
+		r, err := decode()
+		if err != nil {
+			if terminated(err) || ctx.Err() != nil {
+				return nil
+			}
+			if _, ok := err.(*ProtocolError); ok {
+				fmt.Fprintf(os.Stderr, "%s socket skipping bad message: %s\n", kind, err)
+				continue
+			}
+			return err
+		}
+		if !in.put(ctx, stop, r) {
+			return nil
+		}
+	}
+}
+
+//runWriteLoop is the loop behind RunWriteLoop.  encode sends one response from out
+//to mongrel2.
+func (self *RawHandlerDefault) runWriteLoop(ctx context.Context, encode func(interface{}) error, out responseQueue) error {
+	stop := self.loops.startWriter()
+	left := 0
+	defer func() { self.loops.endWriter(left) }()
+	for {
+		m, ok := out.take(ctx, stop)
+		switch {
+		case !ok:
+			self.closeSend(self.linger())
+			return nil
+		case m != nil:
+			if err := encode(m); err != nil {
+				if terminated(err) {
+					return nil
+				}
+				return err
+			}
+		case stopped(stop):
+			left = self.drain(self.loops.stopContext(), encode, out)
+			return undelivered(left)
+		default:
+			lingerCtx, cancel := context.WithTimeout(context.Background(), self.linger())
+			left = self.drain(lingerCtx, encode, out)
+			cancel()
+			self.closeSend(self.linger())
+			return undelivered(left)
+		}
+	}
+}
+
+//drain sends the responses queued on out until there are none left or ctx ends.  It
+//returns how many it didn't send.
+func (self *RawHandlerDefault) drain(ctx context.Context, encode func(interface{}) error, out responseQueue) int {
+	failed := 0
+	for ctx.Err() == nil {
+		m, ok := out.poll()
+		if !ok || m == nil {
+			return failed
+		}
+		if err := encode(m); err != nil {
+			failed++
+		}
+	}
+	return failed + out.queued()
+}
+
+//runLoops runs a read loop and a write loop together, stopping the write loop as
+//soon as the read loop finishes for whatever reason, and returns once they have both
+//finished with the first error either of them had.  This is Run for both kinds of
+//handler.
+func runLoops(ctx context.Context, read, write func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	written := make(chan error, 1)
+	go func() { written <- write(ctx) }()
+	err := read(ctx)
+	cancel()
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	return err
+}
+
+//stopped reports whether stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//undelivered turns a count of lost responses into the error for it, if there were any.
+func undelivered(count int) error {
+	if count > 0 {
+		return &UndeliveredError{count}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package mongrel2
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RunSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&RunSuite{})
+
+//chanTransport is a Transport made of channels.  Recv returns recvErr, if it is set,
+//once in is empty, and Send waits while gate is closed off.
+type chanTransport struct {
+	in      chan []byte
+	sent    chan []byte
+	recvErr error
+	sendErr error
+	gate    chan bool
+
+	lock                   sync.Mutex
+	recvClosed, sendClosed chan bool
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{in: make(chan []byte, 10), sent: make(chan []byte, 10),
+		recvClosed: make(chan bool), sendClosed: make(chan bool)}
+}
+
+func (self *chanTransport) Recv() ([]byte, error) {
+	select {
+	case msg := <-self.in:
+		return msg, nil
+	default:
+	}
+	if self.recvErr != nil {
+		return nil, self.recvErr
+	}
+	select {
+	case msg := <-self.in:
+		return msg, nil
+	case <-self.recvClosed:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (self *chanTransport) Send(data []byte) error {
+	if self.sendErr != nil {
+		return self.sendErr
+	}
+	if self.gate != nil {
+		select {
+		case <-self.gate:
+		case <-self.sendClosed:
+			return ErrTransportClosed
+		}
+	}
+	self.sent <- data
+	return nil
+}
+
+func (self *chanTransport) CloseRecv() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	select {
+	case <-self.recvClosed:
+	default:
+		close(self.recvClosed)
+	}
+	return nil
+}
+
+func (self *chanTransport) CloseSend() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	select {
+	case <-self.sendClosed:
+	default:
+		close(self.sendClosed)
+	}
+	return nil
+}
+
+func closed(c chan bool) bool {
+	select {
+	case <-c:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func textResponse(clientId int, body string) *HttpResponse {
+	return &HttpResponse{ServerId: "server-1", ClientId: []int{clientId},
+		Body: ioutil.NopCloser(strings.NewReader(body)), ContentLength: int64(len(body))}
+}
+
+//waitForWriter waits until the handler's write loop has started, so that Shutdown
+//has something to wait for.
+func waitForWriter(c *gocheck.C, handler *RawHandlerDefault) {
+	for i := 0; i < 100; i++ {
+		handler.loops.lock.Lock()
+		writers := handler.loops.writers
+		handler.loops.lock.Unlock()
+		if writers > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("write loop didn't start")
+}
+
+func (s *RunSuite) TestReadLoopStopsOnCancel(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.in <- []byte(`server-1 12 /x 16:{"METHOD":"GET"},0:,`)
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan *HttpRequest)
+	result := make(chan error)
+	go func() { result <- handler.RunReadLoop(ctx, in) }()
+
+	req := <-in
+	c.Check(req.ClientId, gocheck.Equals, 12)
+	cancel()
+	c.Check(<-result, gocheck.IsNil)
+	c.Check(closed(transport.recvClosed), gocheck.Equals, true)
+}
+
+func (s *RunSuite) TestReadLoopReturnsErrors(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.in <- []byte("garbage")
+	transport.recvErr = errors.New("broken")
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	err := handler.RunReadLoop(context.Background(), make(chan *HttpRequest))
+	c.Check(err, gocheck.Equals, transport.recvErr)
+}
+
+func (s *RunSuite) TestShutdownDeliversQueued(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	out := make(chan *HttpResponse, 3)
+	in := make(chan *HttpRequest)
+	result := make(chan error)
+	go func() { result <- handler.Run(context.Background(), in, out) }()
+	for i := 1; i <= 3; i++ {
+		out <- textResponse(i, "bye")
+	}
+	waitForWriter(c, handler.RawHandlerDefault)
+
+	c.Check(handler.Shutdown(context.Background()), gocheck.IsNil)
+	c.Check(<-result, gocheck.IsNil)
+	c.Check(transport.sent, gocheck.HasLen, 3)
+	c.Check(closed(transport.recvClosed), gocheck.Equals, true)
+	c.Check(closed(transport.sendClosed), gocheck.Equals, true)
+}
+
+func (s *RunSuite) TestShutdownDeadline(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.gate = make(chan bool)
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	out := make(chan *HttpResponse, 3)
+	out <- textResponse(1, "stuck")
+	out <- textResponse(2, "queued")
+	result := make(chan error)
+	go func() { result <- handler.RunWriteLoop(context.Background(), out) }()
+	waitForWriter(c, handler.RawHandlerDefault)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Check(handler.Shutdown(ctx), gocheck.Equals, context.DeadlineExceeded)
+	<-result
+	c.Check(transport.sent, gocheck.HasLen, 0)
+}
+
+func (s *RunSuite) TestWriteLoopLingers(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport, Linger: time.Second}}
+	out := make(chan *HttpResponse, 3)
+	out <- textResponse(1, "one")
+	out <- textResponse(2, "two")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	c.Check(handler.RunWriteLoop(ctx, out), gocheck.IsNil)
+	c.Check(transport.sent, gocheck.HasLen, 2)
+	c.Check(closed(transport.sendClosed), gocheck.Equals, true)
+}
+
+func (s *RunSuite) TestDrainCountsUndelivered(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.sendErr = errors.New("full")
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	out := make(chan *HttpResponse, 3)
+	out <- textResponse(1, "one")
+	out <- textResponse(2, "two")
+	c.Check(handler.drain(context.Background(), handler.writeQueued, httpResponses(out)), gocheck.Equals, 2)
+
+	out <- textResponse(3, "three")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Check(handler.drain(ctx, handler.writeQueued, httpResponses(out)), gocheck.Equals, 1)
+	c.Check(undelivered(1), gocheck.FitsTypeOf, &UndeliveredError{})
+	c.Check(undelivered(0), gocheck.IsNil)
+}
+
+func (s *RunSuite) TestLegacyLoopsReturnOnError(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.recvErr = errors.New("broken")
+	transport.sendErr = errors.New("full")
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	handler.ReadLoop(make(chan *HttpRequest))
+	out := make(chan *HttpResponse, 1)
+	out <- textResponse(1, "lost")
+	handler.WriteLoop(out)
+
+	json := &JsonHandlerDefault{RawHandlerDefault: handler.RawHandlerDefault}
+	json.ReadLoop(make(chan *JsonRequest))
+	jsonOut := make(chan *JsonResponse, 1)
+	jsonOut <- &JsonResponse{ServerId: "server-1", ClientId: []int{1}}
+	json.WriteLoop(jsonOut)
+}
+
+func (s *RunSuite) TestWriteLoopMeasuresBody(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	out := make(chan *HttpResponse, 1)
+	response := textResponse(1, "hello")
+	response.ContentLength = 0
+	out <- response
+	close(out)
+
+	c.Check(handler.RunWriteLoop(context.Background(), out), gocheck.IsNil)
+	c.Assert(transport.sent, gocheck.HasLen, 1)
+	_, _, data, err := DecodeResponse(<-transport.sent)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(data), gocheck.Equals, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+}
+
+func (s *RunSuite) TestRunStopsWhenReadingEnds(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.recvErr = ErrTransportClosed
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	out := make(chan *HttpResponse, 1)
+	out <- textResponse(1, "last")
+	result := make(chan error)
+	go func() { result <- handler.Run(context.Background(), make(chan *HttpRequest), out) }()
+	select {
+	case err := <-result:
+		c.Check(err, gocheck.IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("Run didn't return when reading ended")
+	}
+	c.Check(transport.sent, gocheck.HasLen, 1)
+}
+
+func (s *RunSuite) TestLoopsAfterShutdown(c *gocheck.C) {
+	transport := newChanTransport()
+	transport.in <- []byte(`server-1 12 /x 16:{"METHOD":"GET"},0:,`)
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	c.Check(handler.Shutdown(context.Background()), gocheck.IsNil)
+	c.Check(handler.RunReadLoop(context.Background(), make(chan *HttpRequest)), gocheck.IsNil)
+	c.Check(handler.Run(context.Background(), make(chan *HttpRequest), make(chan *HttpResponse)), gocheck.IsNil)
+}
+
+func (s *RunSuite) TestWriteJsonTakesWriteLock(c *gocheck.C) {
+	transport := newChanTransport()
+	handler := &JsonHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	handler.writeLock.Lock()
+	result := make(chan error)
+	go func() {
+		result <- handler.WriteJson(&JsonResponse{ServerId: "server-1", ClientId: []int{1, 2}, Json: map[string]interface{}{"a": 1}})
+	}()
+	select {
+	case <-transport.sent:
+		c.Fatal("WriteJson sent while another write held the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	handler.writeLock.Unlock()
+	c.Check(<-result, gocheck.IsNil)
+	c.Check(string(<-transport.sent), gocheck.Equals, `server-1 3:1 2, {"a":1}`)
+}
@@ -1,6 +1,10 @@
+//go:build !nozmq
+// +build !nozmq
+
 package main
 
 import (
+	"context"
 	"fmt"
 	"mongrel2"
 	"os"
@@ -49,7 +53,7 @@ func main() {
 	var socketInterface mongrel2.RawHandler
 	var err error
 
-	implementation = &mongrel2.HttpHandlerDefault{&mongrel2.RawHandlerDefault{}}
+	implementation = &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
 	httpInterface = implementation    // to illustrate the types
 	socketInterface = implementation  // to illustrate the types
 
@@ -87,11 +91,15 @@ func main() {
 	//send to the mongrel2 server (via the http interface) and it eventually ends up at the browser. 
 	//This does NOT block waiting to send!
 	err = httpInterface.WriteMessage(response)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing to mongrel connection:%s\n", err)
+	}
 
 	//this is what we have to do to make sure the sent message gets delivered
-	//before we shut down. this waits 1.5 secs.  if you want to get fancy you
-	//can access the ZMQ out socket and set the linger time to -1.  then, when
-	//you close the context (due to the defer above) it will wait until the message
-	//is delivered
-	time.Sleep(1500000)
+	//before we shut down.  Shutdown closes the sockets with the linger time set
+	//to what is left of the 2 secs, so when the context is closed (due to the
+	//defer above) it waits until the message is delivered, or the time is up.
+	stop, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	implementation.Shutdown(stop)
 }
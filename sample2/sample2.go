@@ -1,6 +1,10 @@
+//go:build !nozmq
+// +build !nozmq
+
 package main
 
 import (
+	"context"
 	"fmt"
 	"mongrel2"
 	"os"
@@ -42,17 +46,17 @@ func main() {
 
 	// this allocates the "raw" abstraction for talking to a mongrel server	
 	// mongrel doc refers to this as a "handler"
-	handler := &mongrel2.HttpHandlerDefault{&mongrel2.RawHandlerDefault{}}
+	handler := &mongrel2.HttpHandlerDefault{RawHandlerDefault: &mongrel2.RawHandlerDefault{}}
 	err := handler.Bind("sample2",ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error initializing mongrel connection (Bind):%s\n", err)
 		return
 	}
 
-	//loop forever taking anything mongrel2 sends to us and putting on a channel
-	go handler.ReadLoop(in)
-	//loop forever taking anything we put on the out channel and sending to mongrel
-	go handler.WriteLoop(out)
+	//loop until Shutdown taking anything mongrel2 sends to us and putting on a channel
+	go handler.RunReadLoop(context.Background(), in)
+	//loop until Shutdown taking anything we put on the out channel and sending to mongrel
+	go handler.RunWriteLoop(context.Background(), out)
 	
 
 	//lets read 3 messages
@@ -77,10 +81,12 @@ func main() {
 		out <- response
 	}
 
-	//this is what we have to do to make sure the sent message gets delivered
-	//before we shut down. this waits 1.5 secs.  if you want to get fancy you
-	//can access the ZMQ out socket and set the linger time to -1.  then, when
-	//you close the context (due to the defer above) it will wait until the message
-	//is delivered
-	time.Sleep(1500000)
+	//stop the loops once everything on the out channel has been sent, giving
+	//zmq up to 2 secs to deliver it when the context is closed (due to the
+	//defer above)
+	stop, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = handler.Shutdown(stop); err != nil {
+		fmt.Fprintf(os.Stderr, "error shutting down:%s\n", err)
+	}
 }
@@ -3,52 +3,129 @@ package mongrel2
 import (
 	"fmt"
 	"hash/fnv"
+	"sort"
+	"sync"
 )
 
 // HandlerSpec is returned in response a request for the location (in 
 // 0mq terms) of a particular named handler.  It contains the mongrel2
 // necessary specifications of the Pull and Pub sockets, plus the unique
 // id of the handler.  The Pull socket is assigned the lower of the two
-// port numbers.
+// port numbers.  Protocol is the one mongrel2 is configured to talk to the
+// handler, "json" (the default when it is empty) or "tnetstring".
 type HandlerSpec struct {
 	Name     string
 	PubSpec  string
 	PullSpec string
 	Identity string
+	Protocol string
 }
 
-var (
-	//handler is the private mapping that keps the binding between names and
-	//the handler addresses.
-	handler = make(map[string]*HandlerSpec)
+//protocol returns the spec's Protocol, checking that it is one mongrel2 knows.
+func (self *HandlerSpec) protocol() (string, error) {
+	switch self.Protocol {
+	case "":
+		return "json", nil
+	case "json", "tnetstring":
+		return self.Protocol, nil
+	}
+	return "", fmt.Errorf("mongrel2 config: handler %s has unknown protocol %q", self.Name, self.Protocol)
+}
 
-	//currentPort is the next port number to be assigned by the GetAssignment
-	//function.  It never decreases.
-	currentPort = 10070
+//SpecRegistry hands out the HandlerSpec for each handler name.  A registry must give
+//the same spec for a name every time it is asked and must never give two names
+//specs that share an address.  Implementations must be safe to use from several
+//goroutines.
+type SpecRegistry interface {
+	//Get returns the spec for name, allocating one if the name has none yet.
+	Get(name string) (*HandlerSpec, error)
+	//Specs returns every spec the registry has handed out, sorted by name.
+	Specs() ([]*HandlerSpec, error)
+}
 
-	//fnv hash is reused
-	hasher = fnv.New64()
-)
+//Registry is the SpecRegistry used by GetHandlerSpec, and so by Bind.  It is an
+//in-memory registry unless it is replaced, which should be done before any handler
+//is bound.  Use a FileRegistry to share assignments between processes.
+var Registry SpecRegistry = NewMemoryRegistry()
+
+//firstPort is the first port number handed out by a TCPAllocator.
+const firstPort = 10070
+
+//MemoryRegistry is a SpecRegistry that keeps the specs in memory, so they last as
+//long as the process.  New specs come from Allocator, or a TCPAllocator if it is nil.
+type MemoryRegistry struct {
+	Allocator Allocator
+
+	lock  sync.Mutex
+	specs map[string]*HandlerSpec
+}
+
+//NewMemoryRegistry returns an empty MemoryRegistry.
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{specs: make(map[string]*HandlerSpec)}
+}
+
+//Get returns the spec for name, allocating one if it doesn't have one yet.
+func (self *MemoryRegistry) Get(name string) (*HandlerSpec, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if spec := self.specs[name]; spec != nil {
+		return spec, nil
+	}
+	if self.specs == nil {
+		self.specs = make(map[string]*HandlerSpec)
+	}
+	spec, err := allocatorOrDefault(self.Allocator).Allocate(name, self.specs)
+	if err != nil {
+		return nil, err
+	}
+	self.specs[name] = spec
+	return spec, nil
+}
+
+//Specs returns all the specs, sorted by name.
+func (self *MemoryRegistry) Specs() ([]*HandlerSpec, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return sortedSpecs(self.specs), nil
+}
+
+func allocatorOrDefault(a Allocator) Allocator {
+	if a == nil {
+		return new(TCPAllocator)
+	}
+	return a
+}
+
+func sortedSpecs(specs map[string]*HandlerSpec) []*HandlerSpec {
+	result := make([]*HandlerSpec, 0, len(specs))
+	for _, spec := range specs {
+		result = append(result, spec)
+	}
+	sort.Sort(specsByName(result))
+	return result
+}
 
 //GetAssignment is used to find a spec for a handler of a given name.  If
 //name has been previously assigned a HandlerAddr the previously allocated
 //address is returned, otherwise a new HandlerAddr is created and returned.
+//The specs come from Registry.
 func GetHandlerSpec(name string) (*HandlerSpec, error) {
-	a := handler[name]
-	if a != nil {
-		return a, nil
-	}
-	result := new(HandlerSpec)
-	result.Name = name
-	result.PullSpec = fmt.Sprintf("tcp://127.0.0.1:%d", currentPort)
-	currentPort++
-	result.PubSpec = fmt.Sprintf("tcp://127.0.0.1:%d", currentPort)
-	currentPort++
-	result.Identity = Checksum(name)
-	handler[name] = result
-	return result, nil
+	return Registry.Get(name)
 }
 
+//HandlerSpecs returns all the specs that have been handed out by GetHandlerSpec,
+//sorted by name, or the error reading them from Registry.
+func HandlerSpecs() ([]*HandlerSpec, error) {
+	return Registry.Specs()
+}
+
+type specsByName []*HandlerSpec
+
+func (self specsByName) Len() int           { return len(self) }
+func (self specsByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self specsByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
 //This is a cheap and cheerful way to generate something that looks like a
 //unique ID but is always the same for a given string.  It computes a 
 //fnv64 has and then uses that as both bytes 0-7 and 8-15.  It outputs a 
@@ -59,7 +136,7 @@ func GetHandlerSpec(name string) (*HandlerSpec, error) {
 func Checksum(s string) string {
 	b := make([]byte, 16)
 
-	hasher.Reset()
+	hasher := fnv.New64()
 	hasher.Write([]byte(s))
 
 	for i, v := range hasher.Sum(nil) {
@@ -0,0 +1,156 @@
+package mongrel2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type SpecSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&SpecSuite{})
+
+func (s *SpecSuite) TestMemoryRegistry(c *gocheck.C) {
+	r := NewMemoryRegistry()
+	a, err := r.Get("a")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(a.PullSpec, gocheck.Equals, "tcp://127.0.0.1:10070")
+	c.Check(a.PubSpec, gocheck.Equals, "tcp://127.0.0.1:10071")
+	c.Check(a.Identity, gocheck.Equals, Checksum("a"))
+	again, _ := r.Get("a")
+	c.Check(again, gocheck.Equals, a)
+	b, _ := r.Get("b")
+	c.Check(b.PullSpec, gocheck.Equals, "tcp://127.0.0.1:10072")
+}
+
+func (s *SpecSuite) TestConcurrentGet(c *gocheck.C) {
+	r := NewMemoryRegistry()
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			r.Get(fmt.Sprint("handler", i%10))
+		}(i)
+	}
+	wait.Wait()
+	checkDistinct(c, r)
+}
+
+func (s *SpecSuite) TestHandlerSpecs(c *gocheck.C) {
+	saved := Registry
+	defer func() { Registry = saved }()
+	Registry = NewMemoryRegistry()
+	b, _ := GetHandlerSpec("b")
+	a, _ := GetHandlerSpec("a")
+	specs, err := HandlerSpecs()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(specs, gocheck.DeepEquals, []*HandlerSpec{a, b})
+
+	//a registry file that doesn't exist yet has no specs, and isn't created
+	path := filepath.Join(c.MkDir(), "specs.json")
+	Registry = NewFileRegistry(path)
+	specs, err = HandlerSpecs()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(specs, gocheck.HasLen, 0)
+	_, err = os.Stat(path)
+	c.Check(os.IsNotExist(err), gocheck.Equals, true)
+
+	//one that can't be read is an error
+	c.Assert(ioutil.WriteFile(path, []byte("not json"), 0644), gocheck.IsNil)
+	specs, err = HandlerSpecs()
+	c.Check(err, gocheck.NotNil)
+	c.Check(specs, gocheck.IsNil)
+}
+
+func (s *SpecSuite) TestFileRegistry(c *gocheck.C) {
+	dir, err := ioutil.TempDir("", "mongrel2")
+	c.Assert(err, gocheck.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "specs.json")
+
+	first := NewFileRegistry(path)
+	a, err := first.Get("a")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(a.PullSpec, gocheck.Equals, "tcp://127.0.0.1:10070")
+
+	//a second process sees the first one's assignment and doesn't reuse its ports
+	second := NewFileRegistry(path)
+	again, err := second.Get("a")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(again, gocheck.DeepEquals, a)
+	b, err := second.Get("b")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(b.PullSpec, gocheck.Equals, "tcp://127.0.0.1:10072")
+	checkDistinct(c, first)
+}
+
+func checkDistinct(c *gocheck.C, r SpecRegistry) {
+	specs, err := r.Specs()
+	c.Assert(err, gocheck.IsNil)
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		for _, addr := range []string{spec.PullSpec, spec.PubSpec} {
+			c.Check(seen[addr], gocheck.Equals, false)
+			seen[addr] = true
+		}
+	}
+}
+
+func (s *SpecSuite) TestTCPAllocatorRange(c *gocheck.C) {
+	r := &MemoryRegistry{Allocator: &TCPAllocator{Host: "10.0.0.1", MinPort: 9000, MaxPort: 9003}}
+	a, err := r.Get("a")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(a.PullSpec, gocheck.Equals, "tcp://10.0.0.1:9000")
+	c.Check(a.PubSpec, gocheck.Equals, "tcp://10.0.0.1:9001")
+	b, _ := r.Get("b")
+	c.Check(b.PullSpec, gocheck.Equals, "tcp://10.0.0.1:9002")
+	_, err = r.Get("c")
+	c.Check(err, gocheck.ErrorMatches, "mongrel2: no free ports for c .*")
+}
+
+func (s *SpecSuite) TestCheckListening(c *gocheck.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gocheck.IsNil)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	spec, err := (&TCPAllocator{MinPort: port, CheckListening: true}).Allocate("a", nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Not(gocheck.Equals), fmt.Sprintf("tcp://127.0.0.1:%d", port))
+}
+
+func (s *SpecSuite) TestIPCAndInproc(c *gocheck.C) {
+	spec, err := (&IPCAllocator{Dir: "run"}).Allocate("my handler", nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Equals, "ipc://run/my_handler-pull")
+	c.Check(spec.PubSpec, gocheck.Equals, "ipc://run/my_handler-pub")
+	_, err = (&IPCAllocator{Dir: "run"}).Allocate("my/handler", map[string]*HandlerSpec{"my handler": spec})
+	c.Check(err, gocheck.ErrorMatches, ".*already used by my handler")
+
+	spec, err = new(InprocAllocator).Allocate("test", nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(spec.PullSpec, gocheck.Equals, "inproc://test/pull")
+}
+
+func (s *SpecSuite) TestStaticAllocator(c *gocheck.C) {
+	r := &MemoryRegistry{Allocator: &StaticAllocator{Specs: map[string]*HandlerSpec{
+		"fixed": {PullSpec: "tcp://127.0.0.1:10070", PubSpec: "tcp://127.0.0.1:10071"},
+		"clash": {PullSpec: "tcp://127.0.0.1:10072", PubSpec: "tcp://127.0.0.1:10071"},
+	}}}
+	other, err := r.Get("other")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(other.PullSpec, gocheck.Equals, "tcp://127.0.0.1:10073")
+	fixed, err := r.Get("fixed")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(fixed.Name, gocheck.Equals, "fixed")
+	c.Check(fixed.Identity, gocheck.Equals, Checksum("fixed"))
+	_, err = r.Get("clash")
+	c.Check(err, gocheck.ErrorMatches, ".*tcp://127.0.0.1:10071 for clash is already used by fixed")
+}
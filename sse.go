@@ -0,0 +1,269 @@
+package mongrel2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//maxClientsPerMessage is the largest number of client ids mongrel2 accepts in a
+//single message.
+const maxClientsPerMessage = 128
+
+//ErrNotSSEClient is returned when adding a request from a different server to an
+//SSEStream.
+var ErrNotSSEClient = errors.New("mongrel2: request is not from the SSE stream's server")
+
+//SSEStream pushes a text/event-stream (Server-Sent Events) to any number of browsers
+//connected to one mongrel2 server.  Each client is added with Add, which sends the
+//response headers, after which events sent with Send go to every client and events
+//sent with Broadcast go to the clients listed.  An event is written once and mongrel2
+//copies it to each client.  Clients are removed automatically when mongrel2 reports
+//that they have disconnected.  HTTP/1.0 clients, and clients that won't keep the
+//connection open, get a stream that ends when the connection is closed rather than
+//a chunked one.  It is safe to use an SSEStream from several goroutines.
+type SSEStream struct {
+	ServerId string
+	//Retry, if not zero, is sent to each client as it is added to tell it how long to
+	//wait before reconnecting.
+	Retry time.Duration
+
+	handler *HttpHandlerDefault
+	lock    sync.Mutex
+	//clients says, for each client, whether its stream is chunked
+	clients map[int]bool
+	done    chan bool
+	closed  bool
+}
+
+//NewSSEStream creates an SSEStream that will send events to clients of the mongrel2
+//server serverId through handler.
+func NewSSEStream(handler *HttpHandlerDefault, serverId string) *SSEStream {
+	return &SSEStream{
+		ServerId: serverId,
+		handler:  handler,
+		clients:  make(map[int]bool),
+		done:     make(chan bool),
+	}
+}
+
+//Add makes the client that sent req a member of the stream.  The response headers,
+//and the retry hint if there is one, are sent to the client straight away.  The
+//client is removed when its connection context is cancelled.  Nothing is sent if
+//the stream has been closed.
+func (self *SSEStream) Add(req *HttpRequest) error {
+	if req.ServerId != self.ServerId {
+		return ErrNotSSEClient
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return ErrStreamClosed
+	}
+	response := NewHttpResponse(req)
+	response.Header["Content-Type"] = "text/event-stream"
+	response.Header["Cache-Control"] = "no-cache"
+	stream, err := self.handler.StartStream(response)
+	if err != nil {
+		return err
+	}
+	if self.Retry > 0 {
+		msg := fmt.Sprintf("retry: %d\n\n", self.Retry/time.Millisecond)
+		if _, err := stream.Write([]byte(msg)); err != nil {
+			return err
+		}
+	}
+	self.clients[req.ClientId] = stream.chunked
+
+	go func(clientId int) {
+		select {
+		case <-req.Context().Done():
+			self.Remove(clientId)
+		case <-self.done:
+		}
+	}(req.ClientId)
+	return nil
+}
+
+//Remove stops sending events to clientId.  It does not close the client's connection.
+func (self *SSEStream) Remove(clientId int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.clients, clientId)
+}
+
+//Clients returns the ids of the clients currently receiving events, in order.
+func (self *SSEStream) Clients() []int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.clientList()
+}
+
+//clientList returns the sorted ids of the clients; the caller must hold the lock.
+func (self *SSEStream) clientList() []int {
+	result := make([]int, 0, len(self.clients))
+	for id := range self.clients {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	return result
+}
+
+//Send sends an event to every client of the stream.  The event name and id are
+//optional and are left out when empty; data may contain newlines.
+func (self *SSEStream) Send(event, id, data string) error {
+	return self.Broadcast(self.Clients(), event, id, data)
+}
+
+//Broadcast sends an event to the clients listed, which need not all be members of
+//the stream (so a client may be sent an event before it is added, for example).
+func (self *SSEStream) Broadcast(clients []int, event, id, data string) error {
+	return self.write(clients, FormatSSEEvent(event, id, data))
+}
+
+//StartHeartbeat sends an SSE comment to every client each interval until the stream
+//is closed.  This keeps proxies from timing out idle connections.  Clients that the
+//comment can't be sent to are removed from the stream.
+func (self *SSEStream) StartHeartbeat(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, stream := range self.streams(self.Clients()) {
+					if _, err := stream.Write([]byte(":\n\n")); err != nil {
+						for _, id := range stream.ClientId {
+							self.Remove(id)
+						}
+					}
+				}
+			case <-self.done:
+				return
+			}
+		}
+	}()
+}
+
+//Close ends the event stream for every client, stops the heartbeat and forgets all
+//the clients.  The stream can't be used after it is closed.
+func (self *SSEStream) Close() error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return ErrStreamClosed
+	}
+	self.closed = true
+	close(self.done)
+	streams := self.clientStreams(self.clientList())
+	self.clients = make(map[int]bool)
+	self.lock.Unlock()
+
+	var result error
+	for _, stream := range streams {
+		if err := stream.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+//write sends data as the next piece of the event stream to the clients listed.
+func (self *SSEStream) write(clients []int, data []byte) error {
+	for _, stream := range self.streams(clients) {
+		if _, err := stream.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//streams is clientStreams for a caller that doesn't hold the lock.
+func (self *SSEStream) streams(clients []int) []*ResponseStream {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.clientStreams(clients)
+}
+
+//clientStreams returns ResponseStreams for the clients listed, which have already
+//been sent the response headers.  The clients are split up by how their streams are
+//framed, clients that aren't members of the stream counting as chunked, and into
+//groups no larger than mongrel2 accepts in one message.  The caller must hold the
+//lock.
+func (self *SSEStream) clientStreams(clients []int) []*ResponseStream {
+	var chunked, closing []int
+	for _, id := range clients {
+		if isChunked, ok := self.clients[id]; ok && !isChunked {
+			closing = append(closing, id)
+		} else {
+			chunked = append(chunked, id)
+		}
+	}
+	var result []*ResponseStream
+	for len(chunked) > 0 || len(closing) > 0 {
+		stream := &ResponseStream{ServerId: self.ServerId, raw: self.handler.RawHandlerDefault}
+		if len(chunked) > 0 {
+			stream.chunked = true
+			stream.ClientId, chunked = clientGroup(chunked)
+		} else {
+			stream.closeAfter = true
+			stream.remaining = -1
+			stream.ClientId, closing = clientGroup(closing)
+		}
+		result = append(result, stream)
+	}
+	return result
+}
+
+//inClientGroups calls fn with successive groups of the clients listed, each no larger
+//than mongrel2 accepts in one message, stopping at the first error.
+func inClientGroups(clients []int, fn func([]int) error) error {
+	for len(clients) > 0 {
+		var group []int
+		group, clients = clientGroup(clients)
+		if err := fn(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//clientGroup splits off as many of the clients as mongrel2 accepts in one message.
+func clientGroup(clients []int) (group, rest []int) {
+	n := len(clients)
+	if n > maxClientsPerMessage {
+		n = maxClientsPerMessage
+	}
+	return clients[:n], clients[n:]
+}
+
+//sseLineBreaks turns the line breaks of the text/event-stream format, CRLF, CR
+//and LF, into LF.
+var sseLineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+//sseFieldBreaks removes line breaks, which would start a new field, from a field.
+var sseFieldBreaks = strings.NewReplacer("\r", "", "\n", "")
+
+//FormatSSEEvent encodes an event in the text/event-stream format.  Each line of data
+//becomes a separate data field, as the format requires; CRLF, CR and LF all end a
+//line.  Line breaks are removed from event and id, so that they can't add fields of
+//their own.
+func FormatSSEEvent(event, id, data string) []byte {
+	buffer := new(bytes.Buffer)
+	if event = sseFieldBreaks.Replace(event); event != "" {
+		fmt.Fprintf(buffer, "event: %s\n", event)
+	}
+	if id = sseFieldBreaks.Replace(id); id != "" {
+		fmt.Fprintf(buffer, "id: %s\n", id)
+	}
+	for _, line := range strings.Split(sseLineBreaks.Replace(data), "\n") {
+		fmt.Fprintf(buffer, "data: %s\n", line)
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes()
+}
@@ -0,0 +1,173 @@
+package mongrel2
+
+import (
+	"errors"
+	"launchpad.net/gocheck"
+	"time"
+)
+
+type SSESuite struct {
+	transport *chanTransport
+	handler   *HttpHandlerDefault
+	stream    *SSEStream
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&SSESuite{})
+
+func (s *SSESuite) SetUpTest(c *gocheck.C) {
+	s.transport = newChanTransport()
+	s.handler = &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: s.transport}}
+	s.stream = NewSSEStream(s.handler, "1ccef67e")
+}
+
+func (s *SSESuite) add(c *gocheck.C, clientId int) {
+	c.Assert(s.stream.Add(s.request(clientId, "HTTP/1.1")), gocheck.IsNil)
+}
+
+func (s *SSESuite) request(clientId int, version string) *HttpRequest {
+	req := &HttpRequest{ServerId: "1ccef67e", ClientId: clientId, Version: version, Header: make(Header)}
+	req.ctx = s.handler.ClientContext(req.ServerId, clientId)
+	return req
+}
+
+//next returns the clients and data of the next message sent.
+func (s *SSESuite) next(c *gocheck.C) ([]int, string) {
+	select {
+	case msg := <-s.transport.sent:
+		_, clientId, data, err := DecodeResponse(msg)
+		c.Assert(err, gocheck.IsNil)
+		return clientId, string(data)
+	case <-time.After(time.Second):
+		c.Fatal("nothing was sent")
+	}
+	return nil, ""
+}
+
+func (s *SSESuite) TestFormatEvent(c *gocheck.C) {
+	c.Check(string(FormatSSEEvent("", "", "hi")), gocheck.Equals, "data: hi\n\n")
+	c.Check(string(FormatSSEEvent("", "", "")), gocheck.Equals, "data: \n\n")
+	c.Check(string(FormatSSEEvent("update", "42", "one\ntwo\r\nthree")), gocheck.Equals,
+		"event: update\nid: 42\ndata: one\ndata: two\ndata: three\n\n")
+	c.Check(string(FormatSSEEvent("", "", "a\rb\n\rc")), gocheck.Equals, "data: a\ndata: b\ndata: \ndata: c\n\n")
+	//line breaks can't be used to add fields
+	c.Check(string(FormatSSEEvent("a\ndata: evil", "1\r\nretry: 1", "x")), gocheck.Equals,
+		"event: adata: evil\nid: 1retry: 1\ndata: x\n\n")
+}
+
+func (s *SSESuite) TestBroadcast(c *gocheck.C) {
+	s.stream.Retry = 1500 * time.Millisecond
+	for _, id := range []int{3, 1, 2} {
+		s.add(c, id)
+		clients, head := s.next(c)
+		c.Check(clients, gocheck.DeepEquals, []int{id})
+		c.Check(head, gocheck.Matches, "(?s)HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n.*")
+		c.Check(head, gocheck.Matches, "(?s).*\r\nContent-Type: text/event-stream\r\n.*")
+		_, retry := s.next(c)
+		c.Check(retry, gocheck.Equals, "d\r\nretry: 1500\n\n\r\n")
+	}
+	c.Check(s.stream.Clients(), gocheck.DeepEquals, []int{1, 2, 3})
+
+	//one message carries the event to all the clients
+	c.Assert(s.stream.Send("", "", "hi"), gocheck.IsNil)
+	clients, data := s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{1, 2, 3})
+	c.Check(data, gocheck.Equals, "a\r\ndata: hi\n\n\r\n")
+
+	c.Assert(s.stream.Broadcast([]int{2}, "ping", "", "x"), gocheck.IsNil)
+	clients, data = s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{2})
+	c.Check(data, gocheck.Equals, "15\r\nevent: ping\ndata: x\n\n\r\n")
+
+	other := &HttpRequest{ServerId: "other", ClientId: 9}
+	c.Check(s.stream.Add(other), gocheck.Equals, ErrNotSSEClient)
+}
+
+func (s *SSESuite) TestRemoveAndClose(c *gocheck.C) {
+	for _, id := range []int{1, 2, 3} {
+		s.add(c, id)
+		s.next(c)
+	}
+	s.stream.Remove(2)
+	c.Check(s.stream.Clients(), gocheck.DeepEquals, []int{1, 3})
+
+	//a client that disconnects is removed by itself
+	s.handler.disconnected("1ccef67e", 3)
+	for i := 0; i < 100 && len(s.stream.Clients()) > 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(s.stream.Clients(), gocheck.DeepEquals, []int{1})
+
+	c.Assert(s.stream.Close(), gocheck.IsNil)
+	clients, data := s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{1})
+	c.Check(data, gocheck.Equals, "0\r\n\r\n")
+	c.Check(s.stream.Clients(), gocheck.HasLen, 0)
+	c.Check(s.stream.Close(), gocheck.Equals, ErrStreamClosed)
+}
+
+func (s *SSESuite) TestHeartbeat(c *gocheck.C) {
+	s.add(c, 1)
+	s.next(c)
+	s.stream.StartHeartbeat(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		clients, data := s.next(c)
+		c.Check(clients, gocheck.DeepEquals, []int{1})
+		c.Check(data, gocheck.Equals, "3\r\n:\n\n\r\n")
+	}
+
+	c.Assert(s.stream.Close(), gocheck.IsNil)
+	for {
+		if _, data := s.next(c); data == "0\r\n\r\n" {
+			break
+		}
+	}
+	//the heartbeat stops with the stream, apart from one that may have been under way
+	time.Sleep(50 * time.Millisecond)
+	c.Check(len(s.transport.sent) <= 1, gocheck.Equals, true)
+}
+
+func (s *SSESuite) TestHTTP10Client(c *gocheck.C) {
+	s.add(c, 1)
+	s.next(c)
+	c.Assert(s.stream.Add(s.request(2, "HTTP/1.0")), gocheck.IsNil)
+	_, head := s.next(c)
+	c.Check(head, gocheck.Matches, "(?s)HTTP/1.1 200 OK\r\n.*\r\nConnection: close\r\n\r\n")
+	c.Check(head, gocheck.Not(gocheck.Matches), "(?s).*Transfer-Encoding.*")
+
+	//the HTTP/1.0 client gets the events without chunk framing
+	c.Assert(s.stream.Send("", "", "hi"), gocheck.IsNil)
+	clients, data := s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{1})
+	c.Check(data, gocheck.Equals, "a\r\ndata: hi\n\n\r\n")
+	clients, data = s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{2})
+	c.Check(data, gocheck.Equals, "data: hi\n\n")
+
+	//and its stream ends by closing the connection
+	c.Assert(s.stream.Close(), gocheck.IsNil)
+	clients, data = s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{1})
+	c.Check(data, gocheck.Equals, "0\r\n\r\n")
+	clients, data = s.next(c)
+	c.Check(clients, gocheck.DeepEquals, []int{2})
+	c.Check(data, gocheck.Equals, "")
+}
+
+func (s *SSESuite) TestAddAfterClose(c *gocheck.C) {
+	c.Assert(s.stream.Close(), gocheck.IsNil)
+	c.Check(s.stream.Add(s.request(1, "HTTP/1.1")), gocheck.Equals, ErrStreamClosed)
+	c.Check(s.transport.sent, gocheck.HasLen, 0)
+}
+
+func (s *SSESuite) TestHeartbeatDropsFailedClients(c *gocheck.C) {
+	s.add(c, 1)
+	s.next(c)
+	s.transport.sendErr = errors.New("gone")
+	s.stream.StartHeartbeat(10 * time.Millisecond)
+	for i := 0; i < 100 && len(s.stream.Clients()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Check(s.stream.Clients(), gocheck.HasLen, 0)
+	s.stream.Close()
+}
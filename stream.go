@@ -0,0 +1,163 @@
+package mongrel2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//streamChunkSize is how much of a streamed HttpResponse's Body is read and sent to
+//mongrel2 in each message.
+const streamChunkSize = 32 * 1024
+
+var (
+	//ErrStreamClosed is returned when writing to a ResponseStream after Close.
+	ErrStreamClosed = errors.New("mongrel2: write to closed response stream")
+	//ErrStreamLength is returned when a ResponseStream with a declared ContentLength
+	//is sent more, or closed with fewer, bytes than were declared.
+	ErrStreamLength = errors.New("mongrel2: response stream body does not match its Content-Length")
+)
+
+//ResponseStream is an HTTP response whose body is sent to mongrel2 as it is produced,
+//as a series of separate messages, instead of being buffered in memory.  Create one
+//with StartStream, call Write as many times as needed and then Close.  When the
+//length of the body is not known up front it is framed with chunked transfer
+//encoding, so the client can tell where it ends without the connection closing,
+//unless the connection is going to be closed at the end anyway or the client only
+//speaks HTTP/1.0.
+type ResponseStream struct {
+	ServerId string
+	ClientId []int
+
+	raw        *RawHandlerDefault
+	chunked    bool
+	remaining  int64
+	closeAfter bool
+	closed     bool
+}
+
+//StartStream sends the status line and headers of response to its clients and returns
+//a stream for the body.  The Body and Stream fields of response are ignored.  If
+//response.ContentLength is greater than zero that many bytes must be written to the
+//stream before it is closed.  Otherwise the stream uses chunked transfer encoding,
+//or if response.CloseAfter is set or response.Version is HTTP/1.0 the end of the
+//body is marked by closing the connection.
+func (self *HttpHandlerDefault) StartStream(response *HttpResponse) (*ResponseStream, error) {
+	result := &ResponseStream{
+		ServerId:   response.ServerId,
+		ClientId:   response.ClientId,
+		raw:        self.RawHandlerDefault,
+		remaining:  response.ContentLength,
+		closeAfter: response.CloseAfter,
+	}
+
+	buffer := new(bytes.Buffer)
+	switch {
+	case response.ContentLength > 0:
+		writeResponseHead(buffer, response, fmt.Sprintf("Content-Length: %d\r\n", response.ContentLength))
+	case response.CloseAfter || response.Version == "HTTP/1.0":
+		//HTTP/1.0 clients don't know chunked encoding, so even one that asked for
+		//keep-alive has to be told that the connection will close
+		head := *response
+		head.CloseAfter = true
+		head.Header = make(map[string]string, len(response.Header))
+		for k, v := range response.Header {
+			head.Header[k] = v
+		}
+		deleteHeader(head.Header, "Connection")
+		result.closeAfter = true
+		result.remaining = -1
+		writeResponseHead(buffer, &head, "")
+	default:
+		result.chunked = true
+		writeResponseHead(buffer, response, "Transfer-Encoding: chunked\r\n")
+	}
+	if _, err := self.Write(result.ServerId, result.ClientId, buffer.Bytes()); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Write sends data to the clients as the next piece of the body, in a message of its
+//own.  Writing an empty slice does nothing (an empty message would tell mongrel2 to
+//close the connection).
+func (self *ResponseStream) Write(data []byte) (int, error) {
+	if self.closed {
+		return 0, ErrStreamClosed
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if !self.chunked {
+		if self.remaining >= 0 && int64(len(data)) > self.remaining {
+			return 0, ErrStreamLength
+		}
+		if _, err := self.raw.Write(self.ServerId, self.ClientId, data); err != nil {
+			return 0, err
+		}
+		if self.remaining >= 0 {
+			self.remaining -= int64(len(data))
+		}
+		return len(data), nil
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)+16))
+	fmt.Fprintf(buffer, "%x\r\n", len(data))
+	buffer.Write(data)
+	buffer.WriteString("\r\n")
+	if _, err := self.raw.Write(self.ServerId, self.ClientId, buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//Close finishes the response.  For a chunked stream this sends the final zero length
+//chunk.  For a stream with a declared length it is ErrStreamLength if fewer bytes
+//were written than were promised.  The client connections are closed if the
+//response had CloseAfter set and are otherwise left open.
+func (self *ResponseStream) Close() error {
+	if self.closed {
+		return ErrStreamClosed
+	}
+	self.closed = true
+	if self.chunked {
+		if _, err := self.raw.Write(self.ServerId, self.ClientId, []byte("0\r\n\r\n")); err != nil {
+			return err
+		}
+	} else if self.remaining > 0 {
+		return ErrStreamLength
+	}
+	if self.closeAfter {
+		return self.raw.Close(self.ServerId, self.ClientId...)
+	}
+	return nil
+}
+
+//writeStream sends a response with the Stream flag set, reading the body a piece at
+//a time.
+func (self *HttpHandlerDefault) writeStream(response *HttpResponse) error {
+	stream, err := self.StartStream(response)
+	if err != nil {
+		return err
+	}
+	if response.Body != nil {
+		defer response.Body.Close()
+		buf := make([]byte, streamChunkSize)
+		for {
+			n, err := response.Body.Read(buf)
+			if n > 0 {
+				if _, werr := stream.Write(buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return stream.Close()
+}
@@ -0,0 +1,100 @@
+package mongrel2
+
+import (
+	"launchpad.net/gocheck"
+)
+
+type StreamSuite struct {
+	transport *chanTransport
+	handler   *HttpHandlerDefault
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&StreamSuite{})
+
+func (s *StreamSuite) SetUpTest(c *gocheck.C) {
+	s.transport = newChanTransport()
+	s.handler = &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: s.transport}}
+}
+
+//sent returns the data of each message sent so far, checking that they all went to
+//client 7.
+func (s *StreamSuite) sent(c *gocheck.C) []string {
+	var result []string
+	for len(s.transport.sent) > 0 {
+		serverId, clientId, data, err := DecodeResponse(<-s.transport.sent)
+		c.Assert(err, gocheck.IsNil)
+		c.Check(serverId, gocheck.Equals, "1ccef67e")
+		c.Check(clientId, gocheck.DeepEquals, []int{7})
+		result = append(result, string(data))
+	}
+	return result
+}
+
+func streamRequest(version, connection string) *HttpRequest {
+	req := &HttpRequest{ServerId: "1ccef67e", ClientId: 7, Version: version, Header: make(Header)}
+	if connection != "" {
+		req.Header.Set("Connection", connection)
+	}
+	return req
+}
+
+func (s *StreamSuite) TestContentLength(c *gocheck.C) {
+	response := NewHttpResponse(streamRequest("HTTP/1.1", ""))
+	response.ContentLength = 5
+	stream, err := s.handler.StartStream(response)
+	c.Assert(err, gocheck.IsNil)
+	stream.Write([]byte("hel"))
+	_, err = stream.Write([]byte("lo!"))
+	c.Check(err, gocheck.Equals, ErrStreamLength)
+	stream.Write([]byte("lo"))
+	c.Check(stream.Close(), gocheck.IsNil)
+	c.Check(s.sent(c), gocheck.DeepEquals, []string{
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+		"hel",
+		"lo",
+	})
+
+	stream, err = s.handler.StartStream(response)
+	c.Assert(err, gocheck.IsNil)
+	stream.Write([]byte("hel"))
+	c.Check(stream.Close(), gocheck.Equals, ErrStreamLength)
+	_, err = stream.Write([]byte("lo"))
+	c.Check(err, gocheck.Equals, ErrStreamClosed)
+}
+
+func (s *StreamSuite) TestChunked(c *gocheck.C) {
+	stream, err := s.handler.StartStream(NewHttpResponse(streamRequest("HTTP/1.1", "")))
+	c.Assert(err, gocheck.IsNil)
+	stream.Write([]byte("hello"))
+	stream.Write(nil)
+	stream.Write([]byte("0123456789abcdefg"))
+	c.Check(stream.Close(), gocheck.IsNil)
+	c.Check(s.sent(c), gocheck.DeepEquals, []string{
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n",
+		"5\r\nhello\r\n",
+		"11\r\n0123456789abcdefg\r\n",
+		"0\r\n\r\n",
+	})
+}
+
+func (s *StreamSuite) TestCloseDelimited(c *gocheck.C) {
+	//an HTTP/1.0 client can't read chunks, even if it asked to keep the connection
+	for _, connection := range []string{"", "keep-alive"} {
+		stream, err := s.handler.StartStream(NewHttpResponse(streamRequest("HTTP/1.0", connection)))
+		c.Assert(err, gocheck.IsNil)
+		stream.Write([]byte("hello"))
+		c.Check(stream.Close(), gocheck.IsNil)
+		c.Check(s.sent(c), gocheck.DeepEquals, []string{
+			"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n",
+			"hello",
+			"",
+		}, gocheck.Commentf(connection))
+	}
+
+	//the same goes for an HTTP/1.1 client that is going to be disconnected anyway
+	stream, err := s.handler.StartStream(NewHttpResponse(streamRequest("HTTP/1.1", "close")))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(stream.Close(), gocheck.IsNil)
+	c.Check(s.sent(c), gocheck.DeepEquals, []string{"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n", ""})
+}
@@ -0,0 +1,217 @@
+package mongrel2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+//Type tags used by the tnetstring format.  Every tnetstring is encoded as
+//SIZE:DATA followed by one of these characters, which says how DATA should be
+//interpreted.  See http://tnetstrings.org for the details.
+const (
+	TnetString = ','
+	TnetInt    = '#'
+	TnetFloat  = '^'
+	TnetBool   = '!'
+	TnetNull   = '~'
+	TnetDict   = '}'
+	TnetList   = ']'
+)
+
+//maxTnetSizeDigits is the longest size prefix the spec permits (999999999 bytes).
+const maxTnetSizeDigits = 9
+
+//DecodeTnetstring parses one tnetstring from the front of data and returns the
+//decoded value plus whatever bytes follow it.  Dicts decode to
+//map[string]interface{}, lists to []interface{}, strings to string, ints to int64,
+//floats to float64, bools to bool and null to nil.  The strings are copied out of
+//data so the caller is free to reuse the buffer.
+func DecodeTnetstring(data []byte) (interface{}, []byte, error) {
+	payload, tag, rest, err := splitTnetstring(data)
+	if err != nil {
+		return nil, data, err
+	}
+	v, err := decodeTnetPayload(payload, tag)
+	if err != nil {
+		return nil, data, err
+	}
+	return v, rest, nil
+}
+
+//splitTnetstring separates the first tnetstring in data into its payload and
+//type tag without interpreting the payload.
+func splitTnetstring(data []byte) (payload []byte, tag byte, rest []byte, err error) {
+	colon := bytes.IndexByte(data, ':')
+	if colon <= 0 || colon > maxTnetSizeDigits {
+		return nil, 0, data, errors.New("tnetstring: missing or bad size prefix")
+	}
+	size, err := strconv.Atoi(string(data[:colon]))
+	if err != nil || size < 0 {
+		return nil, 0, data, fmt.Errorf("tnetstring: bad size %q", data[:colon])
+	}
+	end := colon + 1 + size
+	if end >= len(data) {
+		return nil, 0, data, fmt.Errorf("tnetstring: size %d overruns %d bytes of data", size, len(data)-colon-1)
+	}
+	return data[colon+1 : end], data[end], data[end+1:], nil
+}
+
+func decodeTnetPayload(payload []byte, tag byte) (interface{}, error) {
+	switch tag {
+	case TnetString:
+		return string(payload), nil
+	case TnetInt:
+		return strconv.ParseInt(string(payload), 10, 64)
+	case TnetFloat:
+		return strconv.ParseFloat(string(payload), 64)
+	case TnetBool:
+		switch string(payload) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return nil, fmt.Errorf("tnetstring: bad bool %q", payload)
+	case TnetNull:
+		if len(payload) != 0 {
+			return nil, errors.New("tnetstring: null must be empty")
+		}
+		return nil, nil
+	case TnetDict:
+		return decodeTnetDict(payload)
+	case TnetList:
+		return decodeTnetList(payload)
+	}
+	return nil, fmt.Errorf("tnetstring: unknown type tag %q", tag)
+}
+
+func decodeTnetDict(payload []byte) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	for len(payload) > 0 {
+		k, tag, rest, err := splitTnetstring(payload)
+		if err != nil {
+			return nil, err
+		}
+		if tag != TnetString {
+			return nil, fmt.Errorf("tnetstring: dict key has type %q, not a string", tag)
+		}
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("tnetstring: dict key %q has no value", k)
+		}
+		v, rest, err := DecodeTnetstring(rest)
+		if err != nil {
+			return nil, err
+		}
+		result[string(k)] = v
+		payload = rest
+	}
+	return result, nil
+}
+
+func decodeTnetList(payload []byte) ([]interface{}, error) {
+	result := []interface{}{}
+	for len(payload) > 0 {
+		v, rest, err := DecodeTnetstring(payload)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+		payload = rest
+	}
+	return result, nil
+}
+
+//EncodeTnetstring converts v into its tnetstring form.  Strings and byte slices
+//become tnetstring strings, all the integer and float kinds become numbers,
+//maps with string keys become dicts (with the keys sorted so the output is
+//stable) and slices or arrays become lists.  Any other type is an error.
+func EncodeTnetstring(v interface{}) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := encodeTnet(buffer, v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func encodeTnet(buffer *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buffer.WriteString("0:~")
+		return nil
+	case string:
+		writeTnet(buffer, []byte(x), TnetString)
+		return nil
+	case []byte:
+		writeTnet(buffer, x, TnetString)
+		return nil
+	case bool:
+		writeTnet(buffer, []byte(strconv.FormatBool(x)), TnetBool)
+		return nil
+	case int:
+		writeTnet(buffer, []byte(strconv.Itoa(x)), TnetInt)
+		return nil
+	case int64:
+		writeTnet(buffer, []byte(strconv.FormatInt(x, 10)), TnetInt)
+		return nil
+	case float64:
+		writeTnet(buffer, []byte(strconv.FormatFloat(x, 'g', -1, 64)), TnetFloat)
+		return nil
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return encodeTnet(buffer, nil)
+		}
+		return encodeTnet(buffer, value.Elem().Interface())
+	case reflect.String:
+		return encodeTnet(buffer, value.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeTnet(buffer, value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		writeTnet(buffer, []byte(strconv.FormatUint(value.Uint(), 10)), TnetInt)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		return encodeTnet(buffer, value.Float())
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("tnetstring: can't encode map with %s keys", value.Type().Key())
+		}
+		keys := make([]string, 0, value.Len())
+		for _, k := range value.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		inner := new(bytes.Buffer)
+		for _, k := range keys {
+			writeTnet(inner, []byte(k), TnetString)
+			if err := encodeTnet(inner, value.MapIndex(reflect.ValueOf(k).Convert(value.Type().Key())).Interface()); err != nil {
+				return err
+			}
+		}
+		writeTnet(buffer, inner.Bytes(), TnetDict)
+		return nil
+	case reflect.Slice, reflect.Array:
+		inner := new(bytes.Buffer)
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeTnet(inner, value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		writeTnet(buffer, inner.Bytes(), TnetList)
+		return nil
+	}
+	return fmt.Errorf("tnetstring: can't encode value of type %T", v)
+}
+
+func writeTnet(buffer *bytes.Buffer, payload []byte, tag byte) {
+	buffer.WriteString(strconv.Itoa(len(payload)))
+	buffer.WriteByte(':')
+	buffer.Write(payload)
+	buffer.WriteByte(tag)
+}
@@ -0,0 +1,103 @@
+package mongrel2
+
+import (
+	"launchpad.net/gocheck"
+)
+
+type TnetstringSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&TnetstringSuite{})
+
+var (
+	TNET_GET_SAMPLE  = `0de9b17e-e958-4502-8de9-b17ee958d502 235 /echo 100:4:PATH,5:/echo,15:x-forwarded-for,9:127.0.0.1,6:METHOD,3:GET,7:VERSION,8:HTTP/1.1,7:PATTERN,5:/echo,}0:,`
+	TNET_POST_SAMPLE = `0de9b17e-e958-4502-8de9-b17ee958d502 17 /echo 43:4:PATH,5:/echo,6:METHOD,4:POST,4:size,2:11#}11:hello there,`
+)
+
+func (s *TnetstringSuite) TestDecodeValues(c *gocheck.C) {
+	for text, expected := range map[string]interface{}{
+		"5:hello,":     "hello",
+		"0:,":          "",
+		"3:-42#":       int64(-42),
+		"4:3.25^":      3.25,
+		"4:true!":      true,
+		"5:false!":     false,
+		"0:~":          nil,
+		"0:]":          []interface{}{},
+		"0:}":          map[string]interface{}{},
+		"9:2:hi,1:1#]": []interface{}{"hi", int64(1)},
+	} {
+		v, rest, err := DecodeTnetstring([]byte(text))
+		c.Check(err, gocheck.IsNil)
+		c.Check(v, gocheck.DeepEquals, expected, gocheck.Commentf(text))
+		c.Check(len(rest), gocheck.Equals, 0)
+	}
+}
+
+func (s *TnetstringSuite) TestRestIsReturned(c *gocheck.C) {
+	v, rest, err := DecodeTnetstring([]byte("2:hi,3:abc,"))
+	c.Check(err, gocheck.IsNil)
+	c.Check(v, gocheck.Equals, "hi")
+	c.Check(string(rest), gocheck.Equals, "3:abc,")
+}
+
+func (s *TnetstringSuite) TestRoundTrip(c *gocheck.C) {
+	value := map[string]interface{}{
+		"name":   "mongrel2",
+		"port":   int64(6767),
+		"load":   0.5,
+		"up":     true,
+		"chroot": nil,
+		"tasks":  []interface{}{"a", int64(1), []interface{}{}, map[string]interface{}{"x": "y"}},
+	}
+	b, err := EncodeTnetstring(value)
+	c.Assert(err, gocheck.IsNil)
+	v, rest, err := DecodeTnetstring(b)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(len(rest), gocheck.Equals, 0)
+	c.Check(v, gocheck.DeepEquals, value)
+}
+
+func (s *TnetstringSuite) TestEncodeIsStable(c *gocheck.C) {
+	b, err := EncodeTnetstring(map[string]string{"b": "2", "a": "1"})
+	c.Check(err, gocheck.IsNil)
+	c.Check(string(b), gocheck.Equals, "16:1:a,1:1,1:b,1:2,}")
+
+	b, err = EncodeTnetstring([]interface{}{"status", map[string]string{"what": "net"}})
+	c.Check(err, gocheck.IsNil)
+	c.Check(string(b), gocheck.Equals, "26:6:status,13:4:what,3:net,}]")
+}
+
+func (s *TnetstringSuite) TestBadInput(c *gocheck.C) {
+	for _, text := range []string{"", "5:abc,", "x:abc,", "3:abc?", "3:abc", "4:maybe!", "1:x~", "6:1:a,1#}", "4:1:a,}"} {
+		_, _, err := DecodeTnetstring([]byte(text))
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(text))
+	}
+	_, err := EncodeTnetstring(map[int]string{1: "one"})
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *TnetstringSuite) TestPayloadDecodingTnetGet(c *gocheck.C) {
+	req := []byte(TNET_GET_SAMPLE)
+	serverId, clientId, path, header, _, bodySize, err := DecodePayloadStart(req)
+
+	c.Check(err, gocheck.IsNil)
+	c.Check(serverId, gocheck.Equals, "0de9b17e-e958-4502-8de9-b17ee958d502")
+	c.Check(clientId, gocheck.Equals, 235)
+	c.Check(path, gocheck.Equals, "/echo")
+	c.Check(header["METHOD"], gocheck.Equals, "GET")
+	c.Check(header["x-forwarded-for"], gocheck.Equals, "127.0.0.1")
+	c.Check(bodySize, gocheck.Equals, 0)
+}
+
+func (s *TnetstringSuite) TestPayloadDecodingTnetPost(c *gocheck.C) {
+	req := []byte(TNET_POST_SAMPLE)
+	_, clientId, _, header, bodyStart, bodySize, err := DecodePayloadStart(req)
+
+	c.Check(err, gocheck.IsNil)
+	c.Check(clientId, gocheck.Equals, 17)
+	c.Check(header["METHOD"], gocheck.Equals, "POST")
+	c.Check(header["size"], gocheck.Equals, "11")
+	c.Check(string(req[bodyStart:bodyStart+bodySize]), gocheck.Equals, "hello there")
+}
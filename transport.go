@@ -0,0 +1,117 @@
+package mongrel2
+
+import (
+	"errors"
+	"time"
+)
+
+//ErrTransportClosed is returned by a Transport that has been closed.  The read and
+//write loops treat it as the signal to stop.
+var ErrTransportClosed = errors.New("mongrel2: transport closed")
+
+//Transport is how a RawHandlerDefault exchanges messages with mongrel2: it receives
+//the requests mongrel2 pushes to the handler and publishes the responses.  The two
+//directions can be closed separately because they are often used by different
+//goroutines (see ReadLoop and WriteLoop).  Closing a direction while another
+//goroutine is waiting in Recv or Send must make that call return ErrTransportClosed,
+//which is how RunReadLoop is stopped, and closing one twice must be harmless.  There
+//are two implementations: the one made by Bind uses libzmq through gozmq, the one
+//made by DialZMTP (and by BindZMTP, or Bind with a nil context) is written in Go and
+//needs neither cgo nor libzmq.
+type Transport interface {
+	Recv() ([]byte, error)
+	Send(data []byte) error
+	CloseRecv() error
+	CloseSend() error
+}
+
+//lingerer is implemented by transports that can go on delivering the messages they
+//have queued after CloseSend, such as ZMQTransport.
+type lingerer interface {
+	SetLinger(d time.Duration) error
+}
+
+//BindTransport connects the handler to mongrel2 through t, which should already be
+//connected to the addresses in spec.  If the handler already has a transport, it has
+//no effect.  For example, to talk to mongrel2 without libzmq:
+//
+//	spec, err := mongrel2.GetHandlerSpec("chat")
+//	...
+//	t, err := mongrel2.DialZMTP(spec)
+//	...
+//	err = handler.BindTransport(spec, t)
+func (self *RawHandlerDefault) BindTransport(spec *HandlerSpec, t Transport) error {
+	if self.Transport != nil {
+		return nil
+	}
+	self.PullSpec = spec.PullSpec
+	self.PubSpec = spec.PubSpec
+	self.Identity = spec.Identity
+	self.Transport = t
+	return nil
+}
+
+//BindZMTP is Bind for the pure Go transport: it asks GetHandlerSpec for the
+//addresses of the handler called name and connects to them with DialZMTP.  Unlike
+//Bind it is there whether or not the package is built with the nozmq tag.  If the
+//handler is already connected, it has no effect.
+func (self *RawHandlerDefault) BindZMTP(name string) error {
+	if self.Transport != nil {
+		return nil
+	}
+	spec := &HandlerSpec{Name: name, PullSpec: self.PullSpec, PubSpec: self.PubSpec, Identity: self.Identity}
+	if self.Identity == "" {
+		var err error
+		if spec, err = GetHandlerSpec(name); err != nil {
+			return err
+		}
+	}
+	return self.bindZMTP(spec)
+}
+
+func (self *RawHandlerDefault) bindZMTP(spec *HandlerSpec) error {
+	t, err := DialZMTP(spec)
+	if err != nil {
+		return err
+	}
+	return self.BindTransport(spec, t)
+}
+
+//zmtpTransport is the Transport made of two ZMTPSockets.
+type zmtpTransport struct {
+	in, out *ZMTPSocket
+}
+
+//DialZMTP returns a Transport that connects to the addresses in spec with ZMTPSockets:
+//a pull socket for the requests and a pub socket, with the spec's Identity, for the
+//responses.  Like zmq, it connects in the background and reconnects when mongrel2
+//is restarted.
+func DialZMTP(spec *HandlerSpec) (Transport, error) {
+	in := NewZMTPSocket(ZMTPPull)
+	if err := in.Connect(spec.PullSpec); err != nil {
+		return nil, err
+	}
+	out := NewZMTPSocket(ZMTPPub)
+	out.Identity = spec.Identity
+	if err := out.Connect(spec.PubSpec); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &zmtpTransport{in, out}, nil
+}
+
+func (self *zmtpTransport) Recv() ([]byte, error) {
+	return self.in.Recv()
+}
+
+func (self *zmtpTransport) Send(data []byte) error {
+	return self.out.Send(data)
+}
+
+func (self *zmtpTransport) CloseRecv() error {
+	return self.in.Close()
+}
+
+func (self *zmtpTransport) CloseSend() error {
+	return self.out.Close()
+}
@@ -0,0 +1,139 @@
+package mongrel2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//Headers mongrel2 uses for its asynchronous upload protocol.
+const (
+	UploadStartHeader = "X-Mongrel2-Upload-Start"
+	UploadDoneHeader  = "X-Mongrel2-Upload-Done"
+)
+
+var (
+	//ErrUploadNotDone is returned when trying to read an upload that mongrel2 has only
+	//started to receive.
+	ErrUploadNotDone = errors.New("mongrel2: upload has not finished")
+	//ErrNoUploadDir is returned when trying to use the file of an upload received by a
+	//handler without an UploadDir.
+	ErrNoUploadDir = errors.New("mongrel2: handler has no UploadDir for uploads")
+	//ErrUploadPath is returned for an upload whose file is not a plain file in the
+	//handler's UploadDir.
+	ErrUploadPath = errors.New("mongrel2: upload path is not a file in UploadDir")
+)
+
+//Upload describes a request body that was too large for mongrel2 to send to the
+//handler in the message.  Mongrel2 writes such bodies to a temporary file and sends
+//the handler two requests for them: one with Done false when the upload starts, so
+//the handler can refuse it (by closing the connection, for example) before it is
+//complete, and one with Done true when the whole body is in the file.  Path is the
+//name of the file as mongrel2 reported it.  The handler is responsible for removing
+//the file once it has been dealt with.  Since a client can send the upload headers
+//itself, Path is never trusted: the file is only looked for in the handler's
+//UploadDir.
+type Upload struct {
+	Path string
+	Done bool
+
+	//dir is the HttpHandlerDefault's UploadDir
+	dir string
+}
+
+//decodeUpload checks the upload headers of a request, if it has any.  The path in
+//the done header must match the one in the start header, otherwise somebody may be
+//trying to get the handler to read a file of their choice.
+func decodeUpload(header Header) (*Upload, error) {
+	start := header.Values(UploadStartHeader)
+	if len(start) == 0 {
+		return nil, nil
+	}
+	if len(start) > 1 || start[0] == "" {
+		return nil, &ProtocolError{0, UploadStartHeader, "expected exactly one upload path"}
+	}
+	done := header.Values(UploadDoneHeader)
+	switch {
+	case len(done) == 0:
+		return &Upload{Path: start[0]}, nil
+	case len(done) == 1 && done[0] == start[0]:
+		return &Upload{Path: start[0], Done: true}, nil
+	}
+	return nil, &ProtocolError{0, UploadDoneHeader, "upload done path does not match upload start path"}
+}
+
+//LocalPath returns the name of the upload's temporary file in the handler's file
+//system, which is the file with the same name as Path's last element in the
+//handler's UploadDir.  It is ErrNoUploadDir if the handler has no UploadDir and
+//ErrUploadPath if Path doesn't name a file.
+func (self *Upload) LocalPath() (string, error) {
+	if self.dir == "" {
+		return "", ErrNoUploadDir
+	}
+	name := filepath.Base(filepath.Clean(self.Path))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", ErrUploadPath
+	}
+	return filepath.Join(self.dir, name), nil
+}
+
+//file returns LocalPath, as long as it is a regular file and not, for example, a
+//link to somewhere outside UploadDir.
+func (self *Upload) file() (string, os.FileInfo, error) {
+	path, err := self.LocalPath()
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, ErrUploadPath
+	}
+	return path, info, nil
+}
+
+//Open opens the completed upload for reading.
+func (self *Upload) Open() (io.ReadCloser, error) {
+	if !self.Done {
+		return nil, ErrUploadNotDone
+	}
+	path, _, err := self.file()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+//Size returns the size of the completed upload.
+func (self *Upload) Size() (int64, error) {
+	_, info, err := self.file()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+//Remove deletes the upload's temporary file.
+func (self *Upload) Remove() error {
+	path, _, err := self.file()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+//BodyReader returns a reader for the body of the request, whether it was sent in the
+//message or, for a large upload, written to a file by mongrel2.  It is
+//ErrUploadNotDone to ask for the body of a request that announces an upload has
+//started.
+func (self *HttpRequest) BodyReader() (io.ReadCloser, error) {
+	if self.Upload != nil {
+		return self.Upload.Open()
+	}
+	return ioutil.NopCloser(bytes.NewReader(self.Body)), nil
+}
@@ -0,0 +1,111 @@
+package mongrel2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+type UploadSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&UploadSuite{})
+
+func uploadHeader(start, done []string) Header {
+	h := make(Header)
+	for _, v := range start {
+		h.Add("x-mongrel2-upload-start", v)
+	}
+	for _, v := range done {
+		h.Add("x-mongrel2-upload-done", v)
+	}
+	return h
+}
+
+func (s *UploadSuite) TestDecodeUpload(c *gocheck.C) {
+	u, err := decodeUpload(uploadHeader(nil, nil))
+	c.Check(u, gocheck.IsNil)
+	c.Check(err, gocheck.IsNil)
+
+	u, err = decodeUpload(uploadHeader([]string{"/tmp/upload.1"}, nil))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(*u, gocheck.Equals, Upload{Path: "/tmp/upload.1"})
+	_, err = u.Open()
+	c.Check(err, gocheck.Equals, ErrUploadNotDone)
+
+	u, err = decodeUpload(uploadHeader([]string{"/tmp/upload.1"}, []string{"/tmp/upload.1"}))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(u.Done, gocheck.Equals, true)
+
+	_, err = decodeUpload(uploadHeader([]string{"/tmp/upload.1"}, []string{"/etc/passwd"}))
+	c.Check(err, gocheck.FitsTypeOf, &ProtocolError{})
+	_, err = decodeUpload(uploadHeader([]string{"/tmp/upload.1", "/tmp/upload.2"}, nil))
+	c.Check(err, gocheck.FitsTypeOf, &ProtocolError{})
+}
+
+func (s *UploadSuite) TestUploadDir(c *gocheck.C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "upload.XyZ"), []byte("big body"), 0600), gocheck.IsNil)
+
+	req := &HttpRequest{Upload: &Upload{Path: "/run/mongrel2/tmp/upload.XyZ", Done: true, dir: dir}}
+	path, err := req.Upload.LocalPath()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(path, gocheck.Equals, filepath.Join(dir, "upload.XyZ"))
+	r, err := req.BodyReader()
+	c.Assert(err, gocheck.IsNil)
+	body, _ := ioutil.ReadAll(r)
+	r.Close()
+	c.Check(string(body), gocheck.Equals, "big body")
+
+	c.Check(req.Upload.Remove(), gocheck.IsNil)
+	_, err = os.Stat(path)
+	c.Check(os.IsNotExist(err), gocheck.Equals, true)
+}
+
+//uploadMessage is a finished upload request, with headers a client could have sent.
+func uploadMessage(path string) []byte {
+	header := fmt.Sprintf(`{"PATH":"/up","METHOD":"POST","VERSION":"HTTP/1.1","URI":"/up","PATTERN":"/up","x-mongrel2-upload-start":%q,"x-mongrel2-upload-done":%q}`, path, path)
+	return []byte(fmt.Sprintf("1ccef67e 3 /up %d:%s,0:,", len(header), header))
+}
+
+func (s *UploadSuite) TestSpoofedUpload(c *gocheck.C) {
+	secret := filepath.Join(c.MkDir(), "secret")
+	c.Assert(ioutil.WriteFile(secret, []byte("password"), 0600), gocheck.IsNil)
+	uploads := c.MkDir()
+	c.Assert(os.Symlink(secret, filepath.Join(uploads, "link")), gocheck.IsNil)
+
+	transport := newChanTransport()
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{Transport: transport}}
+	for _, test := range []struct {
+		dir, path string
+		err       error
+	}{
+		//without an UploadDir no upload file is used at all
+		{"", secret, ErrNoUploadDir},
+		{uploads, secret, nil},
+		{uploads, filepath.Join(uploads, "..", filepath.Base(filepath.Dir(secret)), "secret"), nil},
+		{uploads, "/tmp/link", ErrUploadPath},
+		{uploads, "/", ErrUploadPath},
+	} {
+		handler.UploadDir = test.dir
+		transport.in <- uploadMessage(test.path)
+		req, err := handler.ReadMessage()
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(req.Upload, gocheck.NotNil)
+
+		_, err = req.BodyReader()
+		c.Check(err, gocheck.NotNil, gocheck.Commentf(test.path))
+		if test.err != nil {
+			c.Check(err, gocheck.Equals, test.err, gocheck.Commentf(test.path))
+		}
+		c.Check(req.Upload.Remove(), gocheck.NotNil)
+		_, err = NetHttpRequest(req)
+		c.Check(err, gocheck.NotNil)
+	}
+	data, err := ioutil.ReadFile(secret)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(data), gocheck.Equals, "password")
+}
@@ -0,0 +1,272 @@
+package mongrel2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+//Opcodes of websocket frames, from RFC 6455.
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xA
+)
+
+//Values of the METHOD mongrel2 sends for websocket traffic.
+const (
+	WebSocketHandshakeMethod = "WEBSOCKET_HANDSHAKE"
+	WebSocketMethod          = "WEBSOCKET"
+)
+
+//DefaultMaxWebSocketMessage is the MaxMessageSize of a WebSocketHandler that doesn't
+//set one.
+const DefaultMaxWebSocketMessage = 16 << 20
+
+//WebSocketCloseTooBig is the status code of the close frame sent to a client whose
+//message is bigger than the handler takes.
+const WebSocketCloseTooBig = 1009
+
+//webSocketGUID is the magic value appended to the client's key to compute the
+//Sec-WebSocket-Accept header.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//WebSocketMessage is a complete websocket message from, or to, a client.  Text and
+//binary messages that the client sent in several fragments have been put back
+//together.  Opcode is one of the WebSocket* opcode constants.
+type WebSocketMessage struct {
+	ServerId string
+	ClientId int
+	Opcode   byte
+	Data     []byte
+}
+
+//WebSocketHandler talks to mongrel2 about websocket connections.  Mongrel2 sends the
+//opening handshake as a request with METHOD WEBSOCKET_HANDSHAKE and then each frame
+//from the client as a request with METHOD WEBSOCKET, the frame's payload as the body
+//and its first byte (the fin bit and opcode) in the FLAGS header.  The handler
+//completes handshakes, reassembles fragmented messages and frames outbound messages.
+//MaxMessageSize (DefaultMaxWebSocketMessage if it is zero) is the most data a
+//message, with all its fragments, may have.
+type WebSocketHandler struct {
+	*HttpHandlerDefault
+	MaxMessageSize int
+
+	lock      sync.Mutex
+	fragments map[clientKey]*WebSocketMessage
+}
+
+//NewWebSocketHandler creates a WebSocketHandler that uses the sockets of raw, which
+//should be bound to the mongrel2 handler for the websocket route.
+func NewWebSocketHandler(raw *RawHandlerDefault) *WebSocketHandler {
+	result := &WebSocketHandler{
+		HttpHandlerDefault: &HttpHandlerDefault{RawHandlerDefault: raw},
+		fragments:          make(map[clientKey]*WebSocketMessage),
+	}
+	raw.watchDisconnects(result.forget)
+	return result
+}
+
+//forget drops the unfinished message of a client that has disconnected.
+func (self *WebSocketHandler) forget(key clientKey) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.fragments, key)
+}
+
+//ReadWebSocket blocks until a complete websocket message arrives from a client.  It
+//completes handshakes by itself and doesn't return until all the fragments of a
+//message have arrived.  Control messages (close, ping and pong) are returned as they
+//arrive, even in the middle of a fragmented message; answering them is up to the
+//caller.  Disconnects go to OnDisconnect, as they do for ReadMessage, and the
+//unfinished message of a client that disconnects is dropped.  Plain HTTP requests
+//are answered with 400 Bad Request.
+func (self *WebSocketHandler) ReadWebSocket() (*WebSocketMessage, error) {
+	for {
+		req, err := self.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch req.Method {
+		case WebSocketHandshakeMethod:
+			if err := self.Handshake(req); err != nil {
+				return nil, err
+			}
+		case WebSocketMethod:
+			msg, err := self.DecodeFrame(req)
+			if err != nil || msg != nil {
+				return msg, err
+			}
+		default:
+			err := self.WriteMessage(&HttpResponse{
+				ServerId:   req.ServerId,
+				ClientId:   []int{req.ClientId},
+				StatusCode: 400,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+//Handshake accepts the websocket connection requested by req, which must be a
+//WEBSOCKET_HANDSHAKE request, by sending the 101 response with the
+//Sec-WebSocket-Accept value computed from the client's Sec-WebSocket-Key.
+func (self *WebSocketHandler) Handshake(req *HttpRequest) error {
+	accept := ""
+	if key := req.Header.Get("Sec-WebSocket-Key"); key != "" {
+		accept = WebSocketAccept(key)
+	} else {
+		//some versions of mongrel2 compute the value themselves and send it as the body
+		accept = string(req.Body)
+	}
+	if accept == "" {
+		return &ProtocolError{0, "header", "websocket handshake without Sec-WebSocket-Key"}
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	_, err := self.Write(req.ServerId, []int{req.ClientId}, []byte(response))
+	return err
+}
+
+//WebSocketAccept returns the value of the Sec-WebSocket-Accept header that answers a
+//handshake with the Sec-WebSocket-Key supplied.
+func WebSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+//DecodeFrame interprets a WEBSOCKET request from mongrel2.  If the frame completes
+//a message, the message is returned; if it is a fragment of a message that has more
+//fragments to come the result is nil and the fragment is kept until the rest arrive.
+//A message that grows bigger than MaxMessageSize is dropped, the client is sent a
+//close frame with status WebSocketCloseTooBig and the result is a *ProtocolError.
+func (self *WebSocketHandler) DecodeFrame(req *HttpRequest) (*WebSocketMessage, error) {
+	flags, err := strconv.ParseUint(req.Meta["FLAGS"], 0, 8)
+	if err != nil {
+		return nil, &ProtocolError{0, "FLAGS", fmt.Sprintf("bad websocket flags %q", req.Meta["FLAGS"])}
+	}
+	fin := flags&0x80 != 0
+	opcode := byte(flags & 0x0F)
+
+	if opcode >= WebSocketClose {
+		if !fin {
+			return nil, &ProtocolError{0, "FLAGS", "fragmented websocket control frame"}
+		}
+		return &WebSocketMessage{req.ServerId, req.ClientId, opcode, append([]byte(nil), req.Body...)}, nil
+	}
+
+	msg, err := self.reassemble(req, opcode, fin)
+	if err == errMessageTooBig {
+		return nil, self.tooBig(req)
+	}
+	return msg, err
+}
+
+//errMessageTooBig is returned by reassemble when a message grows past MaxMessageSize.
+var errMessageTooBig = errors.New("websocket message too big")
+
+//reassemble adds the data frame in req to the client's unfinished message and
+//returns the message if req was its last fragment.
+func (self *WebSocketHandler) reassemble(req *HttpRequest, opcode byte, fin bool) (*WebSocketMessage, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.fragments == nil {
+		self.fragments = make(map[clientKey]*WebSocketMessage)
+	}
+	key := clientKey{req.ServerId, req.ClientId}
+	pending := self.fragments[key]
+
+	if opcode == WebSocketContinuation {
+		if pending == nil {
+			return nil, &ProtocolError{0, "FLAGS", "websocket continuation frame without a message to continue"}
+		}
+	} else {
+		if pending != nil {
+			delete(self.fragments, key)
+			return nil, &ProtocolError{0, "FLAGS", "new websocket message before the last one was finished"}
+		}
+		pending = &WebSocketMessage{req.ServerId, req.ClientId, opcode, nil}
+	}
+
+	if len(pending.Data)+len(req.Body) > self.maxMessageSize() {
+		delete(self.fragments, key)
+		return nil, errMessageTooBig
+	}
+	pending.Data = append(pending.Data, req.Body...)
+
+	if !fin {
+		self.fragments[key] = pending
+		return nil, nil
+	}
+	delete(self.fragments, key)
+	return pending, nil
+}
+
+//maxMessageSize is MaxMessageSize, or its default.
+func (self *WebSocketHandler) maxMessageSize() int {
+	if self.MaxMessageSize <= 0 {
+		return DefaultMaxWebSocketMessage
+	}
+	return self.MaxMessageSize
+}
+
+//tooBig tells the client that sent req that its message is too big, with a close
+//frame, and returns the error for it.
+func (self *WebSocketHandler) tooBig(req *HttpRequest) error {
+	payload := make([]byte, 2, 2+len("message too big"))
+	binary.BigEndian.PutUint16(payload, WebSocketCloseTooBig)
+	payload = append(payload, "message too big"...)
+	frame := EncodeWebSocketFrame(WebSocketClose, payload)
+	if _, err := self.Write(req.ServerId, []int{req.ClientId}, frame); err != nil {
+		return err
+	}
+	return &ProtocolError{0, "body", fmt.Sprintf("websocket message bigger than %d bytes", self.maxMessageSize())}
+}
+
+//WriteWebSocket sends msg to the client it names as a single, unfragmented frame.
+func (self *WebSocketHandler) WriteWebSocket(msg *WebSocketMessage) error {
+	return self.Broadcast(msg.ServerId, []int{msg.ClientId}, msg.Opcode, msg.Data)
+}
+
+//Broadcast sends one frame to every client listed.  The frame is encoded once and
+//mongrel2 copies it to each client.
+func (self *WebSocketHandler) Broadcast(serverId string, clients []int, opcode byte, data []byte) error {
+	frame := EncodeWebSocketFrame(opcode, data)
+	return inClientGroups(clients, func(ids []int) error {
+		_, err := self.Write(serverId, ids, frame)
+		return err
+	})
+}
+
+//EncodeWebSocketFrame builds an unmasked, final frame (as sent from a server to a
+//client) with the opcode and payload supplied.
+func EncodeWebSocketFrame(opcode byte, data []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)+10))
+	buffer.WriteByte(0x80 | opcode)
+	switch {
+	case len(data) < 126:
+		buffer.WriteByte(byte(len(data)))
+	case len(data) <= 0xFFFF:
+		buffer.WriteByte(126)
+		binary.Write(buffer, binary.BigEndian, uint16(len(data)))
+	default:
+		buffer.WriteByte(127)
+		binary.Write(buffer, binary.BigEndian, uint64(len(data)))
+	}
+	buffer.Write(data)
+	return buffer.Bytes()
+}
@@ -0,0 +1,114 @@
+package mongrel2
+
+import (
+	"launchpad.net/gocheck"
+)
+
+type WebSocketSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&WebSocketSuite{})
+
+func frameRequest(clientId int, flags string, body string) *HttpRequest {
+	return &HttpRequest{
+		ServerId: "1ccef67e",
+		ClientId: clientId,
+		Method:   WebSocketMethod,
+		Meta:     map[string]string{"METHOD": WebSocketMethod, "FLAGS": flags},
+		Body:     []byte(body),
+	}
+}
+
+func (s *WebSocketSuite) TestAccept(c *gocheck.C) {
+	//the example from RFC 6455
+	c.Check(WebSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), gocheck.Equals, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+}
+
+func (s *WebSocketSuite) TestSingleFrame(c *gocheck.C) {
+	ws := NewWebSocketHandler(&RawHandlerDefault{})
+	msg, err := ws.DecodeFrame(frameRequest(3, "0x81", "hello"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(*msg, gocheck.DeepEquals, WebSocketMessage{"1ccef67e", 3, WebSocketText, []byte("hello")})
+}
+
+func (s *WebSocketSuite) TestFragmentsAreReassembled(c *gocheck.C) {
+	ws := NewWebSocketHandler(&RawHandlerDefault{})
+	msg, err := ws.DecodeFrame(frameRequest(3, "0x02", "ab"))
+	c.Check(msg, gocheck.IsNil)
+	c.Check(err, gocheck.IsNil)
+	msg, err = ws.DecodeFrame(frameRequest(4, "0x01", "other"))
+	c.Check(msg, gocheck.IsNil)
+
+	//a ping in the middle of a fragmented message is delivered at once
+	msg, err = ws.DecodeFrame(frameRequest(3, "0x89", "p"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(msg.Opcode, gocheck.Equals, byte(WebSocketPing))
+
+	msg, err = ws.DecodeFrame(frameRequest(3, "0x00", "cd"))
+	c.Check(msg, gocheck.IsNil)
+	msg, err = ws.DecodeFrame(frameRequest(3, "0x80", "ef"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(msg.Opcode, gocheck.Equals, byte(WebSocketBinary))
+	c.Check(string(msg.Data), gocheck.Equals, "abcdef")
+
+	msg, err = ws.DecodeFrame(frameRequest(4, "0x80", "!"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(msg.Data), gocheck.Equals, "other!")
+}
+
+func (s *WebSocketSuite) TestDisconnectDropsFragments(c *gocheck.C) {
+	raw := &RawHandlerDefault{}
+	ws := NewWebSocketHandler(raw)
+	msg, err := ws.DecodeFrame(frameRequest(3, "0x01", "ab"))
+	c.Check(msg, gocheck.IsNil)
+	raw.disconnected("1ccef67e", 3)
+	//mongrel2 reuses the id, so a new client must not continue the old message
+	_, err = ws.DecodeFrame(frameRequest(3, "0x80", "cd"))
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *WebSocketSuite) TestBadFrames(c *gocheck.C) {
+	ws := NewWebSocketHandler(&RawHandlerDefault{})
+	_, err := ws.DecodeFrame(frameRequest(3, "0x80", "x"))
+	c.Check(err, gocheck.NotNil)
+	_, err = ws.DecodeFrame(frameRequest(3, "0x09", "x"))
+	c.Check(err, gocheck.NotNil)
+	_, err = ws.DecodeFrame(frameRequest(3, "nope", "x"))
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *WebSocketSuite) TestEncodeFrame(c *gocheck.C) {
+	c.Check(EncodeWebSocketFrame(WebSocketText, []byte("hi")), gocheck.DeepEquals, []byte{0x81, 2, 'h', 'i'})
+	c.Check(EncodeWebSocketFrame(WebSocketBinary, make([]byte, 300))[:4], gocheck.DeepEquals, []byte{0x82, 126, 1, 44})
+	c.Check(EncodeWebSocketFrame(WebSocketBinary, make([]byte, 70000))[:10], gocheck.DeepEquals, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0x11, 0x70})
+}
+
+func (s *WebSocketSuite) TestMessageTooBig(c *gocheck.C) {
+	transport := newChanTransport()
+	ws := NewWebSocketHandler(&RawHandlerDefault{Transport: transport})
+	ws.MaxMessageSize = 4
+	msg, err := ws.DecodeFrame(frameRequest(3, "0x01", "abc"))
+	c.Check(msg, gocheck.IsNil)
+	c.Check(err, gocheck.IsNil)
+	msg, err = ws.DecodeFrame(frameRequest(3, "0x00", "de"))
+	c.Check(msg, gocheck.IsNil)
+	c.Check(err, gocheck.FitsTypeOf, &ProtocolError{})
+
+	_, ids, data, err := DecodeResponse(<-transport.sent)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(ids, gocheck.DeepEquals, []int{3})
+	c.Check(data, gocheck.DeepEquals, append([]byte{0x88, 17, 0x03, 0xF1}, "message too big"...))
+
+	//the rest of the message is dropped with it
+	_, err = ws.DecodeFrame(frameRequest(3, "0x80", "f"))
+	c.Check(err, gocheck.NotNil)
+
+	//a single frame that is too big is refused too
+	_, err = ws.DecodeFrame(frameRequest(4, "0x82", "abcde"))
+	c.Check(err, gocheck.FitsTypeOf, &ProtocolError{})
+	<-transport.sent
+	msg, err = ws.DecodeFrame(frameRequest(4, "0x82", "abcd"))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(msg.Data), gocheck.Equals, "abcd")
+}
@@ -0,0 +1,277 @@
+//go:build !nozmq
+// +build !nozmq
+
+package mongrel2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alecthomas/gozmq"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//This file holds everything that needs libzmq, through gozmq.  Building with the
+//nozmq tag leaves it out, so that handlers that use DialZMTP can be built without
+//cgo.
+
+//zmqSocket is the type of the InSocket and OutSocket fields of RawHandlerDefault.
+type zmqSocket = gozmq.Socket
+
+//RawHandler is the basic type for an object that communicate with mongrel2.  This interface
+//just knows about sockets, nothing about what to do with communication on those sockets.
+//Developers should not need this type.
+type RawHandler interface {
+	Bind(name string, ctx *gozmq.Context) error
+}
+
+//ZMQTransport is the Transport that uses libzmq sockets: a PULL socket for the
+//requests and a PUB socket for the responses.  The sockets are exported for callers
+//that want to set options on them, such as LINGER.
+type ZMQTransport struct {
+	In, Out *gozmq.Socket
+
+	//0mq sockets can't be closed under a goroutine that is using them, so Recv polls
+	//and CloseRecv waits for it to notice that closing has been set
+	closing    int32
+	recvLock   sync.Mutex
+	sendClosed int32
+}
+
+//zmqPollInterval is how often a Recv that is waiting for a message checks whether
+//CloseRecv has been called.
+const zmqPollInterval = 100 * time.Millisecond
+
+//NewZMQTransport allocates the sockets from ctx and connects them to the addresses
+//in spec.
+func NewZMQTransport(ctx *gozmq.Context, spec *HandlerSpec) (*ZMQTransport, error) {
+	result := new(ZMQTransport)
+	s, err := ctx.NewSocket(gozmq.PULL)
+	if err != nil {
+		return nil, err
+	}
+	result.In = s
+
+	err = result.In.Connect(spec.PullSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.In.SetSockOptInt(gozmq.LINGER, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err = ctx.NewSocket(gozmq.PUB)
+	if err != nil {
+		return nil, err
+	}
+	result.Out = s
+
+	err = result.Out.SetSockOptString(gozmq.IDENTITY, spec.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.Out.SetSockOptInt(gozmq.LINGER, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.Out.Connect(spec.PubSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+//Recv waits for the next request.  It returns ErrTransportClosed, within
+//zmqPollInterval, if CloseRecv is called from another goroutine.
+func (self *ZMQTransport) Recv() ([]byte, error) {
+	self.recvLock.Lock()
+	defer self.recvLock.Unlock()
+	for atomic.LoadInt32(&self.closing) == 0 {
+		items := gozmq.PollItems{{Socket: self.In, Events: gozmq.POLLIN}}
+		n, err := gozmq.Poll(items, zmqPollInterval)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return self.In.Recv(0)
+		}
+	}
+	return nil, ErrTransportClosed
+}
+
+func (self *ZMQTransport) Send(data []byte) error {
+	return self.Out.Send(data, 0)
+}
+
+func (self *ZMQTransport) CloseRecv() error {
+	if !atomic.CompareAndSwapInt32(&self.closing, 0, 1) {
+		return nil
+	}
+	self.recvLock.Lock()
+	defer self.recvLock.Unlock()
+	return self.In.Close()
+}
+
+func (self *ZMQTransport) CloseSend() error {
+	if !atomic.CompareAndSwapInt32(&self.sendClosed, 0, 1) {
+		return nil
+	}
+	return self.Out.Close()
+}
+
+//SetLinger sets how long libzmq goes on trying to deliver the responses it has queued
+//once the transport is closed; less than zero means until they are delivered.  Note
+//that with libzmq 2.x it is closing the context that waits for them.
+func (self *ZMQTransport) SetLinger(d time.Duration) error {
+	ms := int(d / time.Millisecond)
+	if d < 0 {
+		ms = -1
+	}
+	return self.Out.SetSockOptInt(gozmq.LINGER, ms)
+}
+
+//initZMQ creates the necessary ZMQ machinery and sets the fields of the
+//Mongrel2 struct.  This is normally called via the Init() method.
+func (self *RawHandlerDefault) InitZMQ(ctx *gozmq.Context) error {
+	t, err := NewZMQTransport(ctx, &HandlerSpec{PullSpec: self.PullSpec, PubSpec: self.PubSpec, Identity: self.Identity})
+	if err != nil {
+		return err
+	}
+	self.Transport = t
+	self.InSocket, self.OutSocket = t.In, t.Out
+	return nil
+}
+
+//Bind is a method that allocates the zmq resources needed for a connection
+//to mongrel2.  It uses the supplied context to allocate the resources and allocates
+//an address based on the name and uses that for the send and receive sockets.  If
+//ctx is nil, the handler connects with the pure Go transport of DialZMTP instead,
+//as BindZMTP does.  If called multiple times, it has no effect.
+func (self *RawHandlerDefault) Bind(name string, ctx *gozmq.Context) error {
+	//this only needs to be done once for a particular name, even if you call
+	//Shutdown() and Bind() again.
+	if self.Identity == "" {
+		address, err := GetHandlerSpec(name)
+		if err != nil {
+			return err
+		}
+		return self.BindSpec(address, ctx)
+	}
+	return self.BindSpec(&HandlerSpec{Name: name, PullSpec: self.PullSpec, PubSpec: self.PubSpec, Identity: self.Identity}, ctx)
+}
+
+//BindSpec is like Bind but connects to the addresses in spec, such as one read from
+//mongrel2's configuration with LoadConfigDB, instead of asking GetHandlerSpec for
+//them.  As with Bind, a nil ctx means DialZMTP.  If the handler is already
+//connected, it has no effect.
+func (self *RawHandlerDefault) BindSpec(spec *HandlerSpec, ctx *gozmq.Context) error {
+	if self.Transport != nil {
+		return nil
+	}
+	if ctx == nil {
+		return self.bindZMTP(spec)
+	}
+	t, err := NewZMQTransport(ctx, spec)
+	if err != nil {
+		return errors.New("0mq init:" + err.Error())
+	}
+	self.InSocket, self.OutSocket = t.In, t.Out
+	return self.BindTransport(spec, t)
+}
+
+//MustCreateContext is a function that creates a ZMQ context or panics trying to do so.
+//Useful if you can't do any work without a ZMQ context.
+func MustCreateContext() *gozmq.Context {
+	// do a version check
+	x, y, z := gozmq.Version()
+	if x != 2 && y != 1 {
+		fmt.Fprintf(os.Stderr, "version of zmq is %d.%d.%d and this code was tested primarily on 2.1.10\n", x, y, z)
+	}
+
+	//initialize zmq... only once per address space
+	ctx, err := gozmq.NewContext()
+	if err != nil {
+		panic(fmt.Sprintf("unable to initialize zmq context:%s\n", err))
+	}
+	return ctx
+}
+
+//Serve allocates an HttpHandlerDefault, binds it to the handler called name and
+//then serves every request mongrel2 sends to it with h, much like http.Serve does
+//for a net.Listener.  This lets code written for net/http, such as routers and
+//middleware, be mounted directly on mongrel2.  Serve returns nil when ctx is closed
+//and otherwise only when reading from mongrel2 fails.  A nil ctx serves through
+//DialZMTP, which nothing closes; to be able to stop serving, bind a handler yourself
+//and call its Serve with a context.Context.
+func Serve(name string, ctx *gozmq.Context, h http.Handler) error {
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{}}
+	if err := handler.Bind(name, ctx); err != nil {
+		return err
+	}
+	return handler.Serve(context.Background(), h)
+}
+
+//zmqReqSocket adapts a zmq REQ socket for the ControlClient.
+type zmqReqSocket struct {
+	*gozmq.Socket
+}
+
+func (self zmqReqSocket) Send(data []byte) error {
+	return self.Socket.Send(data, 0)
+}
+
+func (self zmqReqSocket) Recv(timeout time.Duration) ([]byte, error) {
+	items := gozmq.PollItems{{Socket: self.Socket, Events: gozmq.POLLIN}}
+	n, err := gozmq.Poll(items, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrControlTimeout
+	}
+	return self.Socket.Recv(0)
+}
+
+//NewControlClient connects to the control port at spec (DefaultControlSpec if it is
+//empty) with a REQ socket allocated from ctx.  The client connects a new socket from
+//ctx whenever it has to replace one that failed.
+func NewControlClient(spec string, ctx *gozmq.Context) (*ControlClient, error) {
+	if spec == "" {
+		spec = DefaultControlSpec
+	}
+	dial := func() (controlSocket, error) {
+		s, err := ctx.NewSocket(gozmq.REQ)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.SetSockOptInt(gozmq.LINGER, 0); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if err = s.Connect(spec); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return zmqReqSocket{s}, nil
+	}
+	socket, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &ControlClient{Spec: spec, socket: socket, dial: dial}, nil
+}
+
+//terminated reports whether err means that the transport has been shut down, in
+//which case the read and write loops stop quietly.
+func terminated(err error) bool {
+	return err == gozmq.ETERM || err == ErrTransportClosed
+}
@@ -0,0 +1,506 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ZMTPType is the kind of a ZMTPSocket.  The types behave like the zmq socket types of
+//the same name.
+type ZMTPType int
+
+const (
+	ZMTPPull ZMTPType = iota
+	ZMTPPush
+	ZMTPPub
+	ZMTPSub
+)
+
+const (
+	//zmtpReconnectInterval is how long a connecting socket waits before trying again
+	//when the peer isn't there or the connection drops.
+	zmtpReconnectInterval = 100 * time.Millisecond
+	//zmtpQueueSize is how many received messages a socket holds before it stops
+	//reading from its peers.
+	zmtpQueueSize = 1000
+	//zmtpMaxFrame is the largest frame a socket accepts.
+	zmtpMaxFrame = 1 << 30
+	//zmtpMore is the flag of a frame that is followed by more parts of the message.
+	zmtpMore = 0x01
+)
+
+//ZMTPSocket is a pure Go implementation of the zmq sockets that talk to mongrel2,
+//using version 1.0 of the ZMTP wire protocol, the one spoken by libzmq 2.x (later
+//versions of libzmq fall back to it when the peer asks for it).  Like a zmq socket
+//it can connect and bind to several endpoints (tcp://, ipc:// and inproc://), it
+//reconnects by itself when a connection is lost and it queues messages until they
+//are read.  Inproc endpoints are shared by the whole process rather than by a zmq
+//context.  Mongrel2 never sends multipart messages, so Recv returns the parts of
+//one joined together.  Set Identity before calling Bind or Connect.
+type ZMTPSocket struct {
+	Type     ZMTPType
+	Identity string
+
+	lock      sync.Mutex
+	peers     []*zmtpPeer
+	next      int
+	peerAdded chan bool
+	listeners []net.Listener
+	subs      [][]byte
+	in        chan []byte
+	done      chan bool
+	closed    bool
+}
+
+//zmtpPeer is one connection of a socket.
+type zmtpPeer struct {
+	conn      net.Conn
+	identity  []byte
+	writeLock sync.Mutex
+}
+
+//NewZMTPSocket returns a socket of the type supplied that isn't bound or connected
+//to anything yet.
+func NewZMTPSocket(t ZMTPType) *ZMTPSocket {
+	return &ZMTPSocket{
+		Type:      t,
+		peerAdded: make(chan bool),
+		in:        make(chan []byte, zmtpQueueSize),
+		done:      make(chan bool),
+	}
+}
+
+//Subscribe makes a ZMTPSub socket receive the messages that start with prefix.  Like
+//zmq, a SUB socket receives nothing until it subscribes to something; subscribe to
+//"" to receive everything.
+func (self *ZMTPSocket) Subscribe(prefix string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subs = append(self.subs, []byte(prefix))
+}
+
+//Connect starts connecting the socket to endpoint.  As with zmq, the connection is
+//made in the background and it is not an error for the other end not to be there
+//yet; only an endpoint that can't be understood is.
+func (self *ZMTPSocket) Connect(endpoint string) error {
+	network, address, err := zmtpEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := zmtpDial(network, address)
+			if err == nil {
+				self.serve(conn)
+			}
+			select {
+			case <-self.done:
+				return
+			case <-time.After(zmtpReconnectInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+//Bind listens on endpoint and accepts connections from peers in the background.
+func (self *ZMTPSocket) Bind(endpoint string) error {
+	network, address, err := zmtpEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	var l net.Listener
+	switch network {
+	case "inproc":
+		l, err = inprocListen(address)
+	case "unix":
+		//like libzmq, take over the socket file left behind by an earlier process
+		os.Remove(address)
+		l, err = net.Listen(network, address)
+	default:
+		l, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		l.Close()
+		return ErrTransportClosed
+	}
+	self.listeners = append(self.listeners, l)
+	self.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go self.serve(conn)
+		}
+	}()
+	return nil
+}
+
+//Send sends data as a single part message.  A ZMTPPush socket sends each message to
+//one of its peers in turn, waiting for a peer to connect if there are none.  A
+//ZMTPPub socket sends each message to all its peers, and drops it if there are none.
+func (self *ZMTPSocket) Send(data []byte) error {
+	switch self.Type {
+	case ZMTPPub:
+		self.lock.Lock()
+		if self.closed {
+			self.lock.Unlock()
+			return ErrTransportClosed
+		}
+		peers := append([]*zmtpPeer(nil), self.peers...)
+		self.lock.Unlock()
+		for _, p := range peers {
+			if err := p.write(data); err != nil {
+				self.dropPeer(p)
+			}
+		}
+		return nil
+	case ZMTPPush:
+		for {
+			self.lock.Lock()
+			if self.closed {
+				self.lock.Unlock()
+				return ErrTransportClosed
+			}
+			if len(self.peers) == 0 {
+				added := self.peerAdded
+				self.lock.Unlock()
+				select {
+				case <-added:
+				case <-self.done:
+				}
+				continue
+			}
+			p := self.peers[self.next%len(self.peers)]
+			self.next++
+			self.lock.Unlock()
+			if err := p.write(data); err != nil {
+				self.dropPeer(p)
+				continue
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("zmtp: can't send on a socket of type %d", self.Type)
+}
+
+//Recv blocks until a message arrives on a ZMTPPull or ZMTPSub socket.  After Close it
+//returns ErrTransportClosed.
+func (self *ZMTPSocket) Recv() ([]byte, error) {
+	if self.Type != ZMTPPull && self.Type != ZMTPSub {
+		return nil, fmt.Errorf("zmtp: can't receive on a socket of type %d", self.Type)
+	}
+	select {
+	case msg := <-self.in:
+		return msg, nil
+	case <-self.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+//Peers returns the number of peers the socket has completed the greeting with.  A pub
+//socket drops the messages sent before its peers connect, so tests use this to wait
+//for them.
+func (self *ZMTPSocket) Peers() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.peers)
+}
+
+//Close closes all the connections and listeners of the socket.  Messages that have
+//been received but not read are discarded.
+func (self *ZMTPSocket) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	close(self.done)
+	for _, l := range self.listeners {
+		l.Close()
+	}
+	for _, p := range self.peers {
+		p.conn.Close()
+	}
+	self.peers = nil
+	return nil
+}
+
+//serve runs a connection until it fails or the socket is closed: it exchanges
+//identities with the peer and then reads messages from it.  Sockets that only send
+//still read, to find out when the peer goes away.
+func (self *ZMTPSocket) serve(conn net.Conn) {
+	defer conn.Close()
+	p := &zmtpPeer{conn: conn}
+	r := bufio.NewReader(conn)
+
+	//the connection isn't one of the peers yet, so Close can't reach it
+	greeted := make(chan bool)
+	go func() {
+		select {
+		case <-self.done:
+			conn.Close()
+		case <-greeted:
+		}
+	}()
+
+	//write and read the greetings at the same time, the peer may be doing the same
+	written := make(chan error, 1)
+	go func() {
+		written <- p.writeFrame([]byte(self.Identity), 0)
+	}()
+	identity, _, err := readZMTPFrame(r)
+	if err == nil {
+		err = <-written
+	}
+	close(greeted)
+	if err != nil {
+		return
+	}
+	p.identity = identity
+
+	if !self.addPeer(p) {
+		return
+	}
+	defer self.dropPeer(p)
+
+	var msg []byte
+	for {
+		frame, flags, err := readZMTPFrame(r)
+		if err != nil {
+			return
+		}
+		msg = append(msg, frame...)
+		if flags&zmtpMore != 0 {
+			continue
+		}
+		if self.accepts(msg) {
+			select {
+			case self.in <- msg:
+			case <-self.done:
+				return
+			}
+		}
+		msg = nil
+	}
+}
+
+//accepts reports whether a message from a peer should be queued for Recv.
+func (self *ZMTPSocket) accepts(msg []byte) bool {
+	switch self.Type {
+	case ZMTPPull:
+		return true
+	case ZMTPSub:
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		for _, prefix := range self.subs {
+			if bytes.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *ZMTPSocket) addPeer(p *zmtpPeer) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return false
+	}
+	self.peers = append(self.peers, p)
+	close(self.peerAdded)
+	self.peerAdded = make(chan bool)
+	return true
+}
+
+func (self *ZMTPSocket) dropPeer(p *zmtpPeer) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, other := range self.peers {
+		if other == p {
+			self.peers = append(self.peers[:i], self.peers[i+1:]...)
+			break
+		}
+	}
+	p.conn.Close()
+}
+
+//write sends a single part message to the peer.
+func (self *zmtpPeer) write(data []byte) error {
+	return self.writeFrame(data, 0)
+}
+
+//writeFrame sends one ZMTP/1.0 frame: the length of the flags and body (in one byte
+//or, if it doesn't fit, 0xFF and eight bytes), the flags and the body.
+func (self *zmtpPeer) writeFrame(body []byte, flags byte) error {
+	frame := make([]byte, 0, len(body)+10)
+	size := uint64(len(body)) + 1
+	if size < 0xFF {
+		frame = append(frame, byte(size))
+	} else {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], size)
+		frame = append(frame, 0xFF)
+		frame = append(frame, length[:]...)
+	}
+	frame = append(frame, flags)
+	frame = append(frame, body...)
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	_, err := self.conn.Write(frame)
+	return err
+}
+
+//readZMTPFrame reads one ZMTP/1.0 frame.  The greeting that newer versions of libzmq
+//send is built to read as a valid ZMTP/1.0 identity frame, so it needs no special
+//treatment.
+func readZMTPFrame(r *bufio.Reader) (body []byte, flags byte, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := uint64(first)
+	if first == 0xFF {
+		var length [8]byte
+		if _, err = io.ReadFull(r, length[:]); err != nil {
+			return nil, 0, err
+		}
+		size = binary.BigEndian.Uint64(length[:])
+	}
+	if size == 0 || size > zmtpMaxFrame {
+		return nil, 0, fmt.Errorf("zmtp: bad frame length %d", size)
+	}
+	if flags, err = r.ReadByte(); err != nil {
+		return nil, 0, err
+	}
+	body = make([]byte, size-1)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, 0, err
+	}
+	return body, flags, nil
+}
+
+//zmtpEndpoint splits a zmq endpoint into a network and an address.  A "*" host
+//means all interfaces, as it does for zmq.
+func zmtpEndpoint(endpoint string) (network, address string, err error) {
+	i := strings.Index(endpoint, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf("zmtp: bad endpoint %q", endpoint)
+	}
+	scheme, address := endpoint[:i], endpoint[i+3:]
+	if address == "" {
+		return "", "", fmt.Errorf("zmtp: bad endpoint %q", endpoint)
+	}
+	switch scheme {
+	case "tcp":
+		if strings.HasPrefix(address, "*:") {
+			address = address[1:]
+		}
+		return "tcp", address, nil
+	case "ipc":
+		return "unix", address, nil
+	case "inproc":
+		return "inproc", address, nil
+	}
+	return "", "", fmt.Errorf("zmtp: unsupported transport %q", scheme)
+}
+
+func zmtpDial(network, address string) (net.Conn, error) {
+	if network == "inproc" {
+		return inprocDial(address)
+	}
+	return net.Dial(network, address)
+}
+
+var (
+	errInprocInUse  = errors.New("zmtp: inproc address already in use")
+	errInprocClosed = errors.New("zmtp: inproc listener closed")
+
+	inprocLock      sync.Mutex
+	inprocListeners = make(map[string]*inprocListener)
+)
+
+//inprocListener is the net.Listener of an inproc endpoint.  Connections are pairs of
+//net.Pipe ends.
+type inprocListener struct {
+	name  string
+	conns chan net.Conn
+	done  chan bool
+	once  sync.Once
+}
+
+func inprocListen(name string) (*inprocListener, error) {
+	inprocLock.Lock()
+	defer inprocLock.Unlock()
+	if inprocListeners[name] != nil {
+		return nil, errInprocInUse
+	}
+	l := &inprocListener{name: name, conns: make(chan net.Conn), done: make(chan bool)}
+	inprocListeners[name] = l
+	return l, nil
+}
+
+func inprocDial(name string) (net.Conn, error) {
+	inprocLock.Lock()
+	l := inprocListeners[name]
+	inprocLock.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("zmtp: nothing bound to inproc://%s", name)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errInprocClosed
+	}
+}
+
+func (self *inprocListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.done:
+		return nil, errInprocClosed
+	}
+}
+
+func (self *inprocListener) Close() error {
+	self.once.Do(func() {
+		inprocLock.Lock()
+		delete(inprocListeners, self.name)
+		inprocLock.Unlock()
+		close(self.done)
+	})
+	return nil
+}
+
+func (self *inprocListener) Addr() net.Addr {
+	return inprocAddr(self.name)
+}
+
+type inprocAddr string
+
+func (self inprocAddr) Network() string { return "inproc" }
+func (self inprocAddr) String() string  { return string(self) }
@@ -0,0 +1,171 @@
+package mongrel2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ZMTPSuite struct {
+}
+
+// hook up suite to gocheck
+var _ = gocheck.Suite(&ZMTPSuite{})
+
+func (s *ZMTPSuite) TestFrames(c *gocheck.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+	long := bytes.Repeat([]byte("x"), 300)
+	go func() {
+		p := &zmtpPeer{conn: client}
+		p.writeFrame([]byte("short"), zmtpMore)
+		p.writeFrame(long, 0)
+	}()
+	r := bufio.NewReader(server)
+	body, flags, err := readZMTPFrame(r)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(body), gocheck.Equals, "short")
+	c.Check(flags, gocheck.Equals, byte(zmtpMore))
+	body, flags, err = readZMTPFrame(r)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(body, gocheck.DeepEquals, long)
+	c.Check(flags, gocheck.Equals, byte(0))
+}
+
+func (s *ZMTPSuite) TestNewerGreeting(c *gocheck.C) {
+	//what libzmq 3 and later send first: 0xFF, the identity length plus one in
+	//eight bytes, 0x7F and then the identity
+	greeting := []byte{0xFF, 0, 0, 0, 0, 0, 0, 0, 4, 0x7F, 'a', 'b', 'c'}
+	body, _, err := readZMTPFrame(bufio.NewReader(bytes.NewReader(greeting)))
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(body), gocheck.Equals, "abc")
+
+	_, _, err = readZMTPFrame(bufio.NewReader(bytes.NewReader([]byte{0})))
+	c.Check(err, gocheck.ErrorMatches, "zmtp: bad frame length 0")
+}
+
+func (s *ZMTPSuite) TestEndpoints(c *gocheck.C) {
+	network, address, err := zmtpEndpoint("tcp://*:9999")
+	c.Assert(err, gocheck.IsNil)
+	c.Check(network+" "+address, gocheck.Equals, "tcp :9999")
+	network, address, _ = zmtpEndpoint("ipc://run/handler")
+	c.Check(network+" "+address, gocheck.Equals, "unix run/handler")
+	_, _, err = zmtpEndpoint("pgm://eth0;239.192.1.1:5555")
+	c.Check(err, gocheck.NotNil)
+	_, _, err = zmtpEndpoint("127.0.0.1:80")
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *ZMTPSuite) TestPushPullInproc(c *gocheck.C) {
+	push := NewZMTPSocket(ZMTPPush)
+	defer push.Close()
+	c.Assert(push.Bind("inproc://zmtp-push-pull"), gocheck.IsNil)
+	c.Check(NewZMTPSocket(ZMTPPush).Bind("inproc://zmtp-push-pull"), gocheck.NotNil)
+
+	pull := NewZMTPSocket(ZMTPPull)
+	defer pull.Close()
+	c.Assert(pull.Connect("inproc://zmtp-push-pull"), gocheck.IsNil)
+
+	//push blocks until the pull socket has connected
+	c.Assert(push.Send([]byte("one")), gocheck.IsNil)
+	c.Assert(push.Send([]byte("two")), gocheck.IsNil)
+	for _, expected := range []string{"one", "two"} {
+		msg, err := pull.Recv()
+		c.Assert(err, gocheck.IsNil)
+		c.Check(string(msg), gocheck.Equals, expected)
+	}
+}
+
+func (s *ZMTPSuite) TestClose(c *gocheck.C) {
+	pull := NewZMTPSocket(ZMTPPull)
+	c.Assert(pull.Connect("inproc://nobody-home"), gocheck.IsNil)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pull.Close()
+	}()
+	_, err := pull.Recv()
+	c.Check(err, gocheck.Equals, ErrTransportClosed)
+	c.Check(NewZMTPSocket(ZMTPPull).Send(nil), gocheck.NotNil)
+}
+
+//TestHandler plays mongrel2 over unix sockets, with a handler that uses DialZMTP.
+func (s *ZMTPSuite) TestHandler(c *gocheck.C) {
+	dir, err := ioutil.TempDir("", "zmtp")
+	c.Assert(err, gocheck.IsNil)
+	defer os.RemoveAll(dir)
+	spec := &HandlerSpec{
+		Name:     "zmtp",
+		PullSpec: "ipc://" + filepath.Join(dir, "send"),
+		PubSpec:  "ipc://" + filepath.Join(dir, "recv"),
+		Identity: Checksum("zmtp"),
+	}
+
+	push := NewZMTPSocket(ZMTPPush)
+	defer push.Close()
+	c.Assert(push.Bind(spec.PullSpec), gocheck.IsNil)
+	sub := NewZMTPSocket(ZMTPSub)
+	defer sub.Close()
+	sub.Subscribe("server-1 ")
+	c.Assert(sub.Bind(spec.PubSpec), gocheck.IsNil)
+
+	t, err := DialZMTP(spec)
+	c.Assert(err, gocheck.IsNil)
+	handler := &HttpHandlerDefault{RawHandlerDefault: &RawHandlerDefault{}}
+	c.Assert(handler.BindTransport(spec, t), gocheck.IsNil)
+	defer t.CloseRecv()
+	defer t.CloseSend()
+
+	headers := `{"PATH":"/zmtp","METHOD":"GET","VERSION":"HTTP/1.1","URI":"/zmtp"}`
+	c.Assert(push.Send([]byte(fmt.Sprintf("server-1 7 /zmtp %d:%s,0:,", len(headers), headers))), gocheck.IsNil)
+	req, err := handler.ReadMessage()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(req.ClientId, gocheck.Equals, 7)
+	c.Check(req.Path, gocheck.Equals, "/zmtp")
+
+	//the pub socket drops messages until mongrel2's sub socket has connected
+	waitForPeer(c, t.(*zmtpTransport).out)
+	response := NewHttpResponse(req)
+	response.Body = ioutil.NopCloser(strings.NewReader("hello"))
+	response.ContentLength = 5
+	c.Assert(handler.WriteMessage(response), gocheck.IsNil)
+	msg, err := sub.Recv()
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(msg), gocheck.Matches, `(?s)server-1 1:7, HTTP/1.1 200 OK\r\n.*\r\n\r\nhello`)
+}
+
+func (s *ZMTPSuite) TestBindZMTP(c *gocheck.C) {
+	saved := Registry
+	defer func() { Registry = saved }()
+	Registry = &MemoryRegistry{Allocator: new(InprocAllocator)}
+
+	handler := &RawHandlerDefault{}
+	c.Assert(handler.BindZMTP("bindzmtp"), gocheck.IsNil)
+	c.Assert(handler.Transport, gocheck.FitsTypeOf, &zmtpTransport{})
+	defer handler.Transport.CloseRecv()
+	defer handler.Transport.CloseSend()
+	c.Check(handler.PullSpec, gocheck.Equals, "inproc://bindzmtp/pull")
+	c.Check(handler.Identity, gocheck.Equals, Checksum("bindzmtp"))
+	c.Check(handler.InSocket, gocheck.IsNil)
+
+	//a second bind leaves the transport alone
+	t := handler.Transport
+	c.Assert(handler.BindZMTP("other"), gocheck.IsNil)
+	c.Check(handler.Transport, gocheck.Equals, t)
+}
+
+func waitForPeer(c *gocheck.C, s *ZMTPSocket) {
+	for i := 0; i < 200; i++ {
+		if s.Peers() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("no peer connected")
+}